@@ -1,11 +1,19 @@
 module git.torproject.org/pluggable-transports/meek.git
 
-go 1.13
+go 1.24
 
 require (
 	git.torproject.org/pluggable-transports/goptlib.git v1.1.0
-	github.com/refraction-networking/utls v0.0.0-20210713165636-0b2885c8c0d4
-	golang.org/x/crypto v0.0.0-20200429183012-4b2356b1ed79
-	golang.org/x/net v0.0.0-20200425230154-ff2c4b7c35a0
-	golang.org/x/sys v0.0.0-20200428200454-593003d681fa
+	github.com/refraction-networking/utls v1.8.2
+	github.com/robertkrimen/otto v0.2.1
+	golang.org/x/crypto v0.36.0
+	golang.org/x/net v0.38.0
+	golang.org/x/sys v0.31.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.6 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+	gopkg.in/sourcemap.v1 v1.0.5 // indirect
 )
@@ -11,9 +11,13 @@
 // meek-http-helper profile, which must have configured the meek-http-helper
 // extension. This program reads the stdout of firefox, looking for a special
 // line with the listening port number of the extension, one that looks like
-// "meek-http-helper: listen <address>". The meek-client command is then
-// executed as given, except that a --helper option is added that points to the
-// port number read from firefox.
+// "meek-http-helper: listen <address> secret <secret>". The meek-client command
+// is then executed as given, except that a --helper option is added that points
+// to the port number read from firefox, and the secret is passed in the
+// MEEK_HELPER_SECRET environment variable. With the --helper-unix-socket
+// option, the extension listens on a Unix domain socket in a private directory
+// instead of a TCP port, and the address is "unix:" followed by its path. The
+// option is not supported on Windows.
 //
 // On Windows, this program assumes that it has exclusive control over the
 // HKEY_CURRENT_USER\SOFTWARE\Mozilla\NativeMessagingHosts\meek.http.helper
@@ -38,14 +42,25 @@ import (
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
-// This magic string is emitted by meek-http-helper.
-var helperAddrPattern = regexp.MustCompile(`^meek-http-helper: listen (127\.0\.0\.1:\d+)$`)
+// This magic string is emitted by meek-http-helper. Older versions do not
+// emit the secret.
+var helperAddrPattern = regexp.MustCompile(`^meek-http-helper: listen (127\.0\.0\.1:\d+|unix:/.+?)(?: secret ([0-9a-f]+))?$`)
+
+const (
+	// The environment variable in which meek-client expects the helper's
+	// secret.
+	helperSecretEnvVar = "MEEK_HELPER_SECRET"
+	// The environment variable that tells the native part of the helper to
+	// listen on a Unix domain socket.
+	helperUnixSocketEnvVar = "MEEK_HTTP_HELPER_UNIX_SOCKET"
+)
 
 // How long to wait for child processes to exit gracefully before killing them.
 const terminateTimeout = 2 * time.Second
@@ -272,33 +287,35 @@ func runFirefox() (cmd *exec.Cmd, stdout io.Reader, err error) {
 }
 
 // Look for the magic meek-http-helper address string in the Reader, and return
-// the address it contains. Start a goroutine to continue reading and discarding
-// output of the Reader before returning.
-func grepHelperAddr(r io.Reader) (string, error) {
-	var helperAddr string
+// the address and secret it contains. The secret is empty if the helper did not
+// report one. Start a goroutine to continue reading and discarding output of the
+// Reader before returning.
+func grepHelperAddr(r io.Reader) (string, string, error) {
+	var helperAddr, helperSecret string
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
 		if m := helperAddrPattern.FindStringSubmatch(line); m != nil {
 			helperAddr = m[1]
+			helperSecret = m[2]
 			break
 		}
 	}
 	err := scanner.Err()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	// Ran out of input before finding the pattern.
 	if helperAddr == "" {
-		return "", io.EOF
+		return "", "", io.EOF
 	}
 	// Keep reading from the browser to avoid its output buffer filling.
 	go io.Copy(ioutil.Discard, r)
-	return helperAddr, nil
+	return helperAddr, helperSecret, nil
 }
 
 // Run meek-client and return its exec.Cmd.
-func runMeekClient(helperAddr string, meekClientCommandLine []string) (cmd *ptCmd, err error) {
+func runMeekClient(helperAddr, helperSecret string, meekClientCommandLine []string) (cmd *ptCmd, err error) {
 	meekClientPath := meekClientCommandLine[0]
 	args := meekClientCommandLine[1:]
 	args = append(args, []string{"--helper", helperAddr}...)
@@ -307,6 +324,13 @@ func runMeekClient(helperAddr string, meekClientCommandLine []string) (cmd *ptCm
 	// Give the subprocess a stdin for TOR_PT_EXIT_ON_STDIN_CLOSE purposes.
 	// https://bugs.torproject.org/24642
 	cmd.Env = append(os.Environ(), "TOR_PT_EXIT_ON_STDIN_CLOSE=1")
+	// Pass the secret in the environment, not on the command line, where
+	// other local users could see it.
+	if helperSecret != "" {
+		cmd.Env = append(cmd.Env, helperSecretEnvVar+"="+helperSecret)
+	} else {
+		log.Printf("helper did not report a secret")
+	}
 	cmd.StdinCloser, err = cmd.StdinPipe()
 	if err != nil {
 		return
@@ -337,18 +361,21 @@ func startProcesses(sigChan <-chan os.Signal, meekClientCommandLine []string) (f
 		return
 	}
 
-	// Find out the helper's listening address.
-	addrChan := make(chan string)
+	// Find out the helper's listening address and secret.
+	type helperInfo struct {
+		addr, secret string
+	}
+	addrChan := make(chan helperInfo)
 	errChan := make(chan error)
 	go func() {
-		addr, err := grepHelperAddr(stdout)
+		addr, secret, err := grepHelperAddr(stdout)
 		if err == nil {
-			addrChan <- addr
+			addrChan <- helperInfo{addr, secret}
 		} else {
 			errChan <- err
 		}
 	}()
-	var helperAddr string
+	var helper helperInfo
 	select {
 	case sig := <-sigChan:
 		err = fmt.Errorf("received signal %v before starting meek-client", sig)
@@ -356,11 +383,11 @@ func startProcesses(sigChan <-chan os.Signal, meekClientCommandLine []string) (f
 	case err = <-errChan:
 		err = fmt.Errorf("error looking for helper address: %v", err)
 		return
-	case helperAddr = <-addrChan:
+	case helper = <-addrChan:
 	}
 
-	// Start meek-client with the helper address.
-	meekClientCmd, err = runMeekClient(helperAddr, meekClientCommandLine)
+	// Start meek-client with the helper address and secret.
+	meekClientCmd, err = runMeekClient(helper.addr, helper.secret, meekClientCommandLine)
 	if err != nil {
 		meekClientCmd = nil
 		err = fmt.Errorf("error running meek-client: %v", err)
@@ -371,8 +398,10 @@ func startProcesses(sigChan <-chan os.Signal, meekClientCommandLine []string) (f
 
 func main() {
 	var logFilename string
+	var helperUnixSocket bool
 
 	flag.Usage = usage
+	flag.BoolVar(&helperUnixSocket, "helper-unix-socket", false, "have the helper listen on a Unix domain socket instead of a TCP port")
 	flag.StringVar(&logFilename, "log", "", "name of log file")
 	flag.Parse()
 
@@ -391,6 +420,21 @@ func main() {
 		log.Fatal("need a meek-client command line")
 	}
 
+	// On Windows, the directory that would hold the socket does not get a
+	// restrictive ACL, so other users could connect to it.
+	if helperUnixSocket && runtime.GOOS == "windows" {
+		log.Fatal("--helper-unix-socket is not supported on Windows")
+	}
+
+	// The native part of the helper inherits the environment of firefox,
+	// which inherits ours.
+	if helperUnixSocket {
+		err := os.Setenv(helperUnixSocketEnvVar, "1")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// By default, writes to file descriptor 1 and 2 when the descriptor has
 	// been closed will terminate the program with a SIGPIPE signal. This is
 	// a problem because the default log destination is stderr (file
@@ -21,69 +21,88 @@ func (r *infiniteReader) Read(p []byte) (int, error) {
 	return len(p), nil
 }
 
-func grepHelperAddrTimeout(r io.Reader) (string, error) {
+func grepHelperAddrTimeout(r io.Reader) (string, string, error) {
 	type result struct {
-		s   string
-		err error
+		s      string
+		secret string
+		err    error
 	}
 	ch := make(chan result)
 	go func() {
-		s, err := grepHelperAddr(r)
+		s, secret, err := grepHelperAddr(r)
 		ch <- result{
-			s:   s,
-			err: err,
+			s:      s,
+			secret: secret,
+			err:    err,
 		}
 	}()
 
 	select {
 	case result := <-ch:
-		return result.s, result.err
+		return result.s, result.secret, result.err
 	case <-time.After(timeout):
-		return "", errTimedout
+		return "", "", errTimedout
 	}
 }
 
 func TestGrepHelperAddr(t *testing.T) {
 	const expectedAddr = "127.0.0.1:1000"
+	const expectedSecret = "0123456789abcdef"
 
 	// bad tests
 	for _, test := range []string{
 		"",
 		"xmeek-http-helper: listen " + expectedAddr + "\n",
 		"meek-http-helper: listen 127.0.0.1:\n",
+		"meek-http-helper: listen 1.2.3.4:1000\n",
 		"meek-http-helper: listen " + expectedAddr + " \n",
 		"meek-http-helper: listen " + expectedAddr + "abc\n",
+		"meek-http-helper: listen " + expectedAddr + " secret\n",
+		"meek-http-helper: listen " + expectedAddr + " secret \n",
+		"meek-http-helper: listen " + expectedAddr + " secret xyz\n",
+		"meek-http-helper: listen " + expectedAddr + " secret " + expectedSecret + " \n",
+		"meek-http-helper: listen unix:\n",
+		"meek-http-helper: listen unix:relative/helper.sock\n",
 	} {
 		b := bytes.NewReader([]byte(test))
-		s, err := grepHelperAddrTimeout(b)
+		s, _, err := grepHelperAddrTimeout(b)
 		if err != io.EOF {
 			t.Errorf("%q → (%q, %v), should have been %v", test, s, err, io.EOF)
 		}
 		// test again with an endless reader
 		b = bytes.NewReader([]byte(test))
-		s, err = grepHelperAddrTimeout(io.MultiReader(b, &infiniteReader{}))
+		s, _, err = grepHelperAddrTimeout(io.MultiReader(b, &infiniteReader{}))
 		if err != errTimedout {
 			t.Errorf("%q → (%q, %v), should have been %v", test, s, err, errTimedout)
 		}
 	}
 
 	// good tests
-	for _, test := range []string{
-		"meek-http-helper: listen " + expectedAddr,
-		"meek-http-helper: listen " + expectedAddr + "\njunk",
-		"junk\nmeek-http-helper: listen " + expectedAddr + "\njunk",
-		"meek-http-helper: listen " + expectedAddr + "\nmeek-http-helper: listen 1.2.3.4:9999\n",
+	for _, test := range []struct {
+		input  string
+		addr   string
+		secret string
+	}{
+		{"meek-http-helper: listen " + expectedAddr, expectedAddr, ""},
+		{"meek-http-helper: listen " + expectedAddr + "\njunk", expectedAddr, ""},
+		{"junk\nmeek-http-helper: listen " + expectedAddr + "\njunk", expectedAddr, ""},
+		{"meek-http-helper: listen " + expectedAddr + "\nmeek-http-helper: listen 1.2.3.4:9999\n", expectedAddr, ""},
+		{"meek-http-helper: listen " + expectedAddr + " secret " + expectedSecret, expectedAddr, expectedSecret},
+		{"junk\nmeek-http-helper: listen " + expectedAddr + " secret " + expectedSecret + "\njunk", expectedAddr, expectedSecret},
+		{"meek-http-helper: listen unix:/tmp/helper.sock secret " + expectedSecret, "unix:/tmp/helper.sock", expectedSecret},
+		{"meek-http-helper: listen unix:/home/user/Tor Browser/helper.sock secret " + expectedSecret, "unix:/home/user/Tor Browser/helper.sock", expectedSecret},
+		{"meek-http-helper: listen unix:/tmp/helper.sock", "unix:/tmp/helper.sock", ""},
 	} {
-		b := bytes.NewReader([]byte(test))
-		s, err := grepHelperAddrTimeout(b)
-		if err != nil || s != expectedAddr {
-			t.Errorf("%q → (%q, %v), should have been %q", test, s, err, expectedAddr)
+		b := bytes.NewReader([]byte(test.input))
+		s, secret, err := grepHelperAddrTimeout(b)
+		if err != nil || s != test.addr || secret != test.secret {
+			t.Errorf("%q → (%q, %q, %v), should have been (%q, %q)", test.input, s, secret, err, test.addr, test.secret)
 		}
 		// test again with an endless reader
-		b = bytes.NewReader([]byte(test))
-		s, err = grepHelperAddrTimeout(io.MultiReader(b, &infiniteReader{}))
-		if err != nil || s != expectedAddr {
-			t.Errorf("%q → (%q, %v), should have been %q", test, s, err, expectedAddr)
+		b = bytes.NewReader([]byte(test.input))
+		s, secret, err = grepHelperAddrTimeout(io.MultiReader(b, &infiniteReader{}))
+		if err != nil || s != test.addr || secret != test.secret {
+			t.Errorf("%q → (%q, %q, %v), should have been (%q, %q)", test.input, s, secret, err, test.addr, test.secret)
 		}
 	}
 }
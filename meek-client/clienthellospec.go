@@ -0,0 +1,411 @@
+// Loading of custom uTLS ClientHelloSpecs from JSON files.
+//
+// The built-in uTLS fingerprints (clientHelloIDMap) change only when meek-client
+// is rebuilt with a newer uTLS. A "utls=file:/path/to/spec.json" bridge line
+// argument or --utls option instead reads the ClientHello to imitate from a
+// file, so that fingerprints can track current browsers between releases.
+//
+// The file describes the ClientHello as a JSON object. Codepoints may be given
+// as numbers or as names; "GREASE" stands for a GREASE value wherever one is
+// allowed. For example:
+//
+//	{
+//	  "cipher_suites": ["GREASE", "TLS_AES_128_GCM_SHA256", 49195],
+//	  "compression_methods": [0],
+//	  "extensions": [
+//	    {"name": "GREASE"},
+//	    {"name": "server_name"},
+//	    {"name": "extended_master_secret"},
+//	    {"name": "renegotiation_info"},
+//	    {"name": "supported_groups", "groups": ["GREASE", "X25519", "P-256"]},
+//	    {"name": "ec_point_formats", "formats": [0]},
+//	    {"name": "session_ticket"},
+//	    {"name": "application_layer_protocol_negotiation", "protocols": ["h2", "http/1.1"]},
+//	    {"name": "status_request"},
+//	    {"name": "signature_algorithms", "algorithms": ["ecdsa_secp256r1_sha256", "rsa_pss_rsae_sha256"]},
+//	    {"name": "signed_certificate_timestamp"},
+//	    {"name": "key_share", "groups": ["GREASE", "X25519"]},
+//	    {"name": "psk_key_exchange_modes", "modes": [1]},
+//	    {"name": "supported_versions", "versions": ["GREASE", "1.3", "1.2"]},
+//	    {"name": "compress_certificate", "algorithms": [2]},
+//	    {"name": "GREASE"},
+//	    {"name": "padding"}
+//	  ]
+//	}
+//
+// Extensions not otherwise supported can be given as
+// {"name": "generic", "id": 17513, "data": "<base64>"}.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// The prefix of a uTLS name that refers to a spec file rather than a built-in
+// ClientHelloID.
+const clientHelloSpecFilePrefix = "file:"
+
+var cipherSuiteNames = func() map[string]uint16 {
+	m := map[string]uint16{"GREASE": utls.GREASE_PLACEHOLDER}
+	for _, list := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, cs := range list {
+			m[cs.Name] = cs.ID
+		}
+	}
+	return m
+}()
+
+var curveNames = map[string]uint16{
+	"GREASE": utls.GREASE_PLACEHOLDER,
+	"X25519": uint16(utls.X25519),
+	"P-256":  uint16(utls.CurveP256),
+	"P-384":  uint16(utls.CurveP384),
+	"P-521":  uint16(utls.CurveP521),
+}
+
+var signatureAlgorithmNames = map[string]uint16{
+	"rsa_pkcs1_sha1":         uint16(utls.PKCS1WithSHA1),
+	"rsa_pkcs1_sha256":       uint16(utls.PKCS1WithSHA256),
+	"rsa_pkcs1_sha384":       uint16(utls.PKCS1WithSHA384),
+	"rsa_pkcs1_sha512":       uint16(utls.PKCS1WithSHA512),
+	"rsa_pss_rsae_sha256":    uint16(utls.PSSWithSHA256),
+	"rsa_pss_rsae_sha384":    uint16(utls.PSSWithSHA384),
+	"rsa_pss_rsae_sha512":    uint16(utls.PSSWithSHA512),
+	"ecdsa_sha1":             uint16(utls.ECDSAWithSHA1),
+	"ecdsa_secp256r1_sha256": uint16(utls.ECDSAWithP256AndSHA256),
+	"ecdsa_secp384r1_sha384": uint16(utls.ECDSAWithP384AndSHA384),
+	"ecdsa_secp521r1_sha512": uint16(utls.ECDSAWithP521AndSHA512),
+	"ed25519":                uint16(utls.Ed25519),
+}
+
+var versionNames = map[string]uint16{
+	"GREASE": utls.GREASE_PLACEHOLDER,
+	"1.0":    utls.VersionTLS10,
+	"1.1":    utls.VersionTLS11,
+	"1.2":    utls.VersionTLS12,
+	"1.3":    utls.VersionTLS13,
+}
+
+// Decode a 16-bit codepoint that is either a JSON number or a string found in
+// names.
+func unmarshalCodepoint(data []byte, names map[string]uint16) (uint16, error) {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		v, ok := names[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown name %q", name)
+		}
+		return v, nil
+	}
+	var v uint16
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+type cipherSuiteValue uint16
+
+func (v *cipherSuiteValue) UnmarshalJSON(data []byte) error {
+	x, err := unmarshalCodepoint(data, cipherSuiteNames)
+	*v = cipherSuiteValue(x)
+	return err
+}
+
+type curveValue uint16
+
+func (v *curveValue) UnmarshalJSON(data []byte) error {
+	x, err := unmarshalCodepoint(data, curveNames)
+	*v = curveValue(x)
+	return err
+}
+
+type signatureAlgorithmValue uint16
+
+func (v *signatureAlgorithmValue) UnmarshalJSON(data []byte) error {
+	x, err := unmarshalCodepoint(data, signatureAlgorithmNames)
+	*v = signatureAlgorithmValue(x)
+	return err
+}
+
+type versionValue uint16
+
+func (v *versionValue) UnmarshalJSON(data []byte) error {
+	x, err := unmarshalCodepoint(data, versionNames)
+	*v = versionValue(x)
+	return err
+}
+
+// One entry in the "extensions" list of a spec file. Which of the parameter
+// fields are used depends on Name.
+type clientHelloExtensionJSON struct {
+	Name string `json:"name"`
+
+	// application_layer_protocol_negotiation
+	Protocols []string `json:"protocols,omitempty"`
+	// supported_groups, key_share
+	Groups []curveValue `json:"groups,omitempty"`
+	// ec_point_formats
+	Formats []uint8 `json:"formats,omitempty"`
+	// signature_algorithms; compress_certificate uses Algorithms as plain
+	// numbers.
+	Algorithms []signatureAlgorithmValue `json:"algorithms,omitempty"`
+	// supported_versions
+	Versions []versionValue `json:"versions,omitempty"`
+	// psk_key_exchange_modes
+	Modes []uint8 `json:"modes,omitempty"`
+	// record_size_limit
+	Limit uint16 `json:"limit,omitempty"`
+	// generic
+	ID   uint16 `json:"id,omitempty"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// The contents of a spec file.
+type clientHelloSpecJSON struct {
+	CipherSuites       []cipherSuiteValue         `json:"cipher_suites"`
+	CompressionMethods []uint8                    `json:"compression_methods,omitempty"`
+	Extensions         []clientHelloExtensionJSON `json:"extensions"`
+	// Optional; by default derived from the supported_versions extension.
+	TLSVersMin versionValue `json:"tls_version_min,omitempty"`
+	TLSVersMax versionValue `json:"tls_version_max,omitempty"`
+	// Optional HTTP/2 profile; see h2fingerprint.go.
+	HTTP2 *http2FingerprintJSON `json:"http2,omitempty"`
+}
+
+// Make a uTLS extension from its JSON description. Every call returns a new
+// object, because uTLS extensions hold per-connection state.
+func (e *clientHelloExtensionJSON) extension() (utls.TLSExtension, error) {
+	switch e.Name {
+	case "GREASE":
+		return &utls.UtlsGREASEExtension{}, nil
+	case "server_name":
+		return &utls.SNIExtension{}, nil
+	case "status_request":
+		return &utls.StatusRequestExtension{}, nil
+	case "supported_groups":
+		curves := make([]utls.CurveID, len(e.Groups))
+		for i, g := range e.Groups {
+			curves[i] = utls.CurveID(g)
+		}
+		return &utls.SupportedCurvesExtension{Curves: curves}, nil
+	case "ec_point_formats":
+		return &utls.SupportedPointsExtension{SupportedPoints: append([]uint8(nil), e.Formats...)}, nil
+	case "signature_algorithms":
+		algs := make([]utls.SignatureScheme, len(e.Algorithms))
+		for i, a := range e.Algorithms {
+			algs[i] = utls.SignatureScheme(a)
+		}
+		return &utls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: algs}, nil
+	case "application_layer_protocol_negotiation":
+		return &utls.ALPNExtension{AlpnProtocols: append([]string(nil), e.Protocols...)}, nil
+	case "signed_certificate_timestamp":
+		return &utls.SCTExtension{}, nil
+	case "padding":
+		return &utls.UtlsPaddingExtension{GetPaddingLen: utls.BoringPaddingStyle}, nil
+	case "extended_master_secret":
+		return &utls.UtlsExtendedMasterSecretExtension{}, nil
+	case "compress_certificate":
+		algs := make([]utls.CertCompressionAlgo, len(e.Algorithms))
+		for i, a := range e.Algorithms {
+			algs[i] = utls.CertCompressionAlgo(a)
+		}
+		return &utls.UtlsCompressCertExtension{Algorithms: algs}, nil
+	case "record_size_limit":
+		return &utls.FakeRecordSizeLimitExtension{Limit: e.Limit}, nil
+	case "session_ticket":
+		return &utls.SessionTicketExtension{}, nil
+	case "supported_versions":
+		versions := make([]uint16, len(e.Versions))
+		for i, v := range e.Versions {
+			versions[i] = uint16(v)
+		}
+		return &utls.SupportedVersionsExtension{Versions: versions}, nil
+	case "psk_key_exchange_modes":
+		return &utls.PSKKeyExchangeModesExtension{Modes: append([]uint8(nil), e.Modes...)}, nil
+	case "key_share":
+		shares := make([]utls.KeyShare, len(e.Groups))
+		for i, g := range e.Groups {
+			shares[i].Group = utls.CurveID(g)
+			if g == utls.GREASE_PLACEHOLDER {
+				// A GREASE key share has a 1-byte dummy key.
+				shares[i].Data = []byte{0}
+			}
+		}
+		return &utls.KeyShareExtension{KeyShares: shares}, nil
+	case "renegotiation_info":
+		return &utls.RenegotiationInfoExtension{Renegotiation: utls.RenegotiateOnceAsClient}, nil
+	case "encrypted_client_hello":
+		// A GREASE ECH extension, like Chrome's, which uTLS replaces
+		// with a real one when there is an ech= config.
+		return utls.BoringGREASEECH(), nil
+	case "generic":
+		return &utls.GenericExtension{Id: e.ID, Data: append([]byte(nil), e.Data...)}, nil
+	default:
+		return nil, fmt.Errorf("unknown extension %q", e.Name)
+	}
+}
+
+// Make a new ClientHelloSpec, with fresh extension objects, from the JSON
+// description.
+func (j *clientHelloSpecJSON) spec() (*utls.ClientHelloSpec, error) {
+	spec := &utls.ClientHelloSpec{
+		TLSVersMin: uint16(j.TLSVersMin),
+		TLSVersMax: uint16(j.TLSVersMax),
+	}
+	spec.CipherSuites = make([]uint16, len(j.CipherSuites))
+	for i, cs := range j.CipherSuites {
+		spec.CipherSuites[i] = uint16(cs)
+	}
+	if j.CompressionMethods == nil {
+		spec.CompressionMethods = []uint8{0} // null compression
+	} else {
+		spec.CompressionMethods = append([]uint8(nil), j.CompressionMethods...)
+	}
+	for _, e := range j.Extensions {
+		ext, err := e.extension()
+		if err != nil {
+			return nil, err
+		}
+		spec.Extensions = append(spec.Extensions, ext)
+	}
+	return spec, nil
+}
+
+// Parse and validate the JSON encoding of a ClientHelloSpec. Validation
+// consists of building a ClientHello from it, without sending it anywhere.
+func parseClientHelloSpec(data []byte) (*clientHelloSpecJSON, error) {
+	var j clientHelloSpecJSON
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&j)
+	if err != nil {
+		return nil, err
+	}
+	if len(j.CipherSuites) == 0 {
+		return nil, fmt.Errorf("no cipher_suites")
+	}
+
+	spec, err := j.spec()
+	if err != nil {
+		return nil, err
+	}
+	uconn := utls.UClient(&net.TCPConn{}, &utls.Config{ServerName: "example.com"}, utls.HelloCustom)
+	err = uconn.ApplyPreset(spec)
+	if err != nil {
+		return nil, err
+	}
+	err = uconn.BuildHandshakeState()
+	if err != nil {
+		return nil, err
+	}
+	if j.HTTP2 != nil {
+		_, err = j.HTTP2.fingerprint()
+		if err != nil {
+			return nil, fmt.Errorf("http2: %v", err)
+		}
+	}
+	return &j, nil
+}
+
+// Spec files that have been loaded, indexed by file name. Each is loaded only
+// once, so changes to a file take effect only after a restart.
+var clientHelloSpecFiles = struct {
+	sync.Mutex
+	m map[string]*clientHelloSpecFile
+}{m: make(map[string]*clientHelloSpecFile)}
+
+type clientHelloSpecFile struct {
+	// A ClientHelloID that stands for this file. Its Client is that of
+	// utls.HelloCustom, and its Version is the file name.
+	id    utls.ClientHelloID
+	spec  *clientHelloSpecJSON
+	http2 *http2Fingerprint
+}
+
+// Return a ClientHelloID that stands for the spec in the named file, loading
+// and validating the file if it has not been loaded before. dialUTLS
+// recognizes the returned ClientHelloID and applies the spec.
+func loadClientHelloSpecFile(filename string) (*utls.ClientHelloID, error) {
+	clientHelloSpecFiles.Lock()
+	defer clientHelloSpecFiles.Unlock()
+
+	if f, ok := clientHelloSpecFiles.m[filename]; ok {
+		return &f.id, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := parseClientHelloSpec(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	f := &clientHelloSpecFile{
+		id: utls.ClientHelloID{
+			Client:  utls.HelloCustom.Client,
+			Version: filename,
+		},
+		spec: spec,
+	}
+	if spec.HTTP2 != nil {
+		// Already checked by parseClientHelloSpec.
+		f.http2, _ = spec.HTTP2.fingerprint()
+	}
+	clientHelloSpecFiles.m[filename] = f
+	return &f.id, nil
+}
+
+// Return a new ClientHelloSpec for a ClientHelloID returned by
+// loadClientHelloSpecFile.
+func clientHelloSpecForID(id *utls.ClientHelloID) (*utls.ClientHelloSpec, error) {
+	clientHelloSpecFiles.Lock()
+	f, ok := clientHelloSpecFiles.m[id.Version]
+	clientHelloSpecFiles.Unlock()
+	if !ok || id.Client != utls.HelloCustom.Client {
+		return nil, fmt.Errorf("no ClientHelloSpec for %s", id.Str())
+	}
+	return f.spec.spec()
+}
+
+// Return the HTTP/2 profile of a spec file, given a ClientHelloID returned by
+// loadClientHelloSpecFile, or nil if the file has none.
+func http2FingerprintForSpecID(id *utls.ClientHelloID) *http2Fingerprint {
+	clientHelloSpecFiles.Lock()
+	defer clientHelloSpecFiles.Unlock()
+	f, ok := clientHelloSpecFiles.m[id.Version]
+	if !ok {
+		return nil
+	}
+	return f.http2
+}
+
+// Look up a uTLS ClientHelloID by name, either in clientHelloIDMap
+// (case-insensitively) or, with a "file:" prefix, by loading a spec file.
+// Returns nil (with no error) for the names that mean not to use uTLS.
+func lookupClientHelloID(name string) (*utls.ClientHelloID, error) {
+	if strings.HasPrefix(strings.ToLower(name), clientHelloSpecFilePrefix) {
+		return loadClientHelloSpecFile(name[len(clientHelloSpecFilePrefix):])
+	}
+	clientHelloID, ok := clientHelloIDMap[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("no uTLS Client Hello ID named %q", name)
+	}
+	return clientHelloID, nil
+}
+
+// Return a form of a uTLS name suitable for comparison: built-in names are
+// case-insensitive but file names are not.
+func canonicalUTLSName(name string) string {
+	if strings.HasPrefix(strings.ToLower(name), clientHelloSpecFilePrefix) {
+		return clientHelloSpecFilePrefix + name[len(clientHelloSpecFilePrefix):]
+	}
+	return strings.ToLower(name)
+}
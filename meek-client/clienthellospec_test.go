@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestParseClientHelloSpec(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		ok    bool
+	}{
+		{`{"cipher_suites": [4865], "extensions": []}`, true},
+		{`{"cipher_suites": ["GREASE", "TLS_AES_128_GCM_SHA256"], "extensions": [{"name": "GREASE"}, {"name": "server_name"}]}`, true},
+		{`{"cipher_suites": ["TLS_AES_128_GCM_SHA256"], "extensions": [{"name": "supported_groups", "groups": ["X25519", 23]}, {"name": "key_share", "groups": ["GREASE", "X25519"]}, {"name": "supported_versions", "versions": ["1.3", "1.2"]}]}`, true},
+		{`{"cipher_suites": [4865], "extensions": [{"name": "generic", "id": 17513, "data": "AAMCaDI="}]}`, true},
+		{`{"cipher_suites": [4865], "extensions": [{"name": "server_name"}, {"name": "encrypted_client_hello"}]}`, true},
+		{`{"cipher_suites": [4865], "tls_version_min": "1.2", "tls_version_max": "1.3", "extensions": []}`, true},
+		{`{"cipher_suites": [4865], "extensions": [], "http2": {"settings": [{"id": "HEADER_TABLE_SIZE", "value": 65536}, {"id": 4, "value": 131072}], "connection_window_increment": 12517377, "priority_frames": [{"stream": 3, "depends_on": 0, "weight": 201}], "headers_priority": {"depends_on": 3, "weight": 256, "exclusive": true}, "pseudo_header_order": [":method", ":path", ":authority", ":scheme"]}}`, true},
+		// Not JSON.
+		{`cipher_suites: [4865]`, false},
+		// No cipher suites.
+		{`{"cipher_suites": [], "extensions": []}`, false},
+		// Unknown cipher suite name.
+		{`{"cipher_suites": ["TLS_NONEXISTENT"], "extensions": []}`, false},
+		// Cipher suite out of range.
+		{`{"cipher_suites": [65536], "extensions": []}`, false},
+		// Unknown extension.
+		{`{"cipher_suites": [4865], "extensions": [{"name": "nonexistent"}]}`, false},
+		// Unknown field.
+		{`{"cipher_suites": [4865], "extensions": [], "nonexistent": 1}`, false},
+		// Unknown group name.
+		{`{"cipher_suites": [4865], "extensions": [{"name": "supported_groups", "groups": ["X448"]}]}`, false},
+		// Server push enabled.
+		{`{"cipher_suites": [4865], "extensions": [], "http2": {"settings": [{"id": "ENABLE_PUSH", "value": 1}]}}`, false},
+		// Stream window larger than the transport's.
+		{`{"cipher_suites": [4865], "extensions": [], "http2": {"settings": [{"id": "INITIAL_WINDOW_SIZE", "value": 6291456}]}}`, false},
+		// Bad HTTP/2 setting value.
+		{`{"cipher_suites": [4865], "extensions": [], "http2": {"settings": [{"id": "ENABLE_PUSH", "value": 2}]}}`, false},
+		// Unknown HTTP/2 setting name.
+		{`{"cipher_suites": [4865], "extensions": [], "http2": {"settings": [{"id": "NONEXISTENT", "value": 2}]}}`, false},
+		// Bad HTTP/2 priority weight.
+		{`{"cipher_suites": [4865], "extensions": [], "http2": {"headers_priority": {"depends_on": 0, "weight": 0}}}`, false},
+		// Not a pseudo-header.
+		{`{"cipher_suites": [4865], "extensions": [], "http2": {"pseudo_header_order": ["method"]}}`, false},
+		// Unknown signature algorithm name.
+		{`{"cipher_suites": [4865], "extensions": [{"name": "signature_algorithms", "algorithms": ["rsa_md5"]}]}`, false},
+	} {
+		_, err := parseClientHelloSpec([]byte(test.input))
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", test.input, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: expected error", test.input)
+		}
+	}
+}
+
+func TestCanonicalUTLSName(t *testing.T) {
+	for _, test := range []struct {
+		input, expected string
+	}{
+		{"HelloChrome_Auto", "hellochrome_auto"},
+		{"file:/tmp/Spec.json", "file:/tmp/Spec.json"},
+		{"FILE:/tmp/Spec.json", "file:/tmp/Spec.json"},
+	} {
+		output := canonicalUTLSName(test.input)
+		if output != test.expected {
+			t.Errorf("%q → %q, expected %q", test.input, output, test.expected)
+		}
+	}
+}
+
+func TestClientHelloSpecFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meek-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = NewUTLSRoundTripper("file:"+filepath.Join(dir, "nonexistent.json"), nil, nil, nil)
+	if err == nil {
+		t.Errorf("nonexistent spec file did not cause an error")
+	}
+
+	// No GREASE, so that the ClientHello does not vary.
+	filename := filepath.Join(dir, "spec.json")
+	err = ioutil.WriteFile(filename, []byte(`{
+		"cipher_suites": ["TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", 255],
+		"extensions": [
+			{"name": "server_name"},
+			{"name": "supported_groups", "groups": ["X25519", "P-256"]},
+			{"name": "ec_point_formats", "formats": [0]},
+			{"name": "signature_algorithms", "algorithms": ["ecdsa_secp256r1_sha256", "rsa_pss_rsae_sha256", "rsa_pkcs1_sha256"]},
+			{"name": "application_layer_protocol_negotiation", "protocols": ["http/1.1"]},
+			{"name": "generic", "id": 4660, "data": "q80="}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt, err := NewUTLSRoundTripper("file:"+filename, &utls.Config{InsecureSkipVerify: true, ServerName: "localhost"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Twice, to check that every connection gets a usable spec.
+	for i := 0; i < 2; i++ {
+		buf, err := clientHelloResultingFromRoundTrip(t, "127.0.0.1", rt.(*UTLSRoundTripper))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range []string{
+			// Ciphersuites and compression methods
+			"\x00\x06\xc0\x2b\xc0\x2f\x00\xff\x01\x00",
+			// server_name
+			"\x00\x00\x00\x0e\x00\x0c\x00\x00\x09localhost",
+			// supported_groups
+			"\x00\x0a\x00\x06\x00\x04\x00\x1d\x00\x17",
+			// ec_point_formats
+			"\x00\x0b\x00\x02\x01\x00",
+			// signature_algorithms
+			"\x00\x0d\x00\x08\x00\x06\x04\x03\x08\x04\x04\x01",
+			// application_layer_protocol_negotiation
+			"\x00\x10\x00\x0b\x00\x09\x08http/1.1",
+			// generic
+			"\x12\x34\x00\x02\xab\xcd",
+		} {
+			if !bytes.Contains(buf, []byte(expected)) {
+				t.Errorf("ClientHello %+q does not contain %+q", buf, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Whether err is from the peer resetting a TCP connection. Windows socket
+// calls return WSAECONNRESET and WSAECONNABORTED, not ECONNRESET.
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.WSAECONNRESET) || errors.Is(err, syscall.WSAECONNABORTED)
+}
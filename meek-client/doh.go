@@ -0,0 +1,261 @@
+// Resolution of the front's name using DNS over HTTPS (RFC 8484).
+//
+// A censor that poisons DNS can steer connections to the front to an address
+// of its choosing, or block the front by making its name unresolvable. With
+// the doh= SOCKS arg (or --doh option), meek-client instead looks up the
+// front's A and AAAA records by sending DNS messages in HTTPS requests to a
+// DoH server. The DoH server's own name is not looked up in DNS if its IP
+// address is given by doh-bootstrap= (or --doh-bootstrap).
+//
+// DoH queries go through the configured proxy, if any. Without uTLS, a proxy
+// looks up the front's name itself, so DoH is used only when there is no
+// proxy. Answers are cached for their TTL, up to dohMaxTTL.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// The media type of DNS messages in DoH requests and responses.
+	dohMediaType = "application/dns-message"
+	// The largest DNS message we will read.
+	dohMaxMessageLength = 65535
+	// Cache answers for at most this long, even if their TTL is longer.
+	dohMaxTTL = time.Hour
+)
+
+type dohCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// dohResolver looks up names using a DoH server.
+type dohResolver struct {
+	endpoint *url.URL
+	client   *http.Client
+
+	lock  sync.Mutex
+	cache map[string]dohCacheEntry
+}
+
+// Make a dohResolver that sends queries to endpoint, an https URL. If bootstrap
+// is not nil, connections to the DoH server go to that address instead of
+// resolving the name in endpoint. Connections go through proxies, if any; in
+// that case, bootstrap is not used.
+func newDoHResolver(endpoint *url.URL, bootstrap net.IP, proxies proxyChain) (*dohResolver, error) {
+	if endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("DoH URL %q must have https scheme", endpoint)
+	}
+	tr := httpRoundTripper.Clone()
+	err := setTransportProxy(tr, proxies)
+	if err != nil {
+		return nil, err
+	}
+	if bootstrap != nil && len(proxies) == 0 {
+		dialer := newNetDialer()
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			return dialer.DialContext(ctx, network, net.JoinHostPort(bootstrap.String(), port))
+		}
+	}
+	return &dohResolver{
+		endpoint: endpoint,
+		client:   &http.Client{Transport: tr, Timeout: 30 * time.Second},
+		cache:    make(map[string]dohCacheEntry),
+	}, nil
+}
+
+// Resolvers that have been made, so that they share a cache, indexed by their
+// getDoHResolver arguments.
+var dohResolvers = struct {
+	sync.Mutex
+	m map[string]*dohResolver
+}{m: make(map[string]*dohResolver)}
+
+// Return a dohResolver for the given doh= and doh-bootstrap= values (the latter
+// may be empty), making one if necessary.
+func getDoHResolver(endpointArg, bootstrapArg string, proxies proxyChain) (*dohResolver, error) {
+	key := endpointArg + " " + bootstrapArg
+	if len(proxies) > 0 {
+		key += " " + proxies.key()
+	}
+
+	dohResolvers.Lock()
+	defer dohResolvers.Unlock()
+	if r, ok := dohResolvers.m[key]; ok {
+		return r, nil
+	}
+
+	endpoint, err := url.Parse(endpointArg)
+	if err != nil {
+		return nil, err
+	}
+	var bootstrap net.IP
+	if bootstrapArg != "" {
+		bootstrap = net.ParseIP(bootstrapArg)
+		if bootstrap == nil {
+			return nil, fmt.Errorf("cannot parse doh-bootstrap %q", bootstrapArg)
+		}
+	}
+	r, err := newDoHResolver(endpoint, bootstrap, proxies)
+	if err != nil {
+		return nil, err
+	}
+	dohResolvers.m[key] = r
+	return r, nil
+}
+
+// Look up the IPv6 and IPv4 addresses of host, IPv6 first. An IP address is
+// returned as is.
+func (r *dohResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	host = strings.ToLower(host)
+
+	r.lock.Lock()
+	entry, ok := r.cache[host]
+	r.lock.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	qtypes := []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	results := make([]chan result, len(qtypes))
+	for i, qtype := range qtypes {
+		results[i] = make(chan result, 1)
+		go func(ch chan<- result, qtype dnsmessage.Type) {
+			ips, ttl, err := r.query(ctx, host, qtype)
+			ch <- result{ips, ttl, err}
+		}(results[i], qtype)
+	}
+
+	var ips []net.IP
+	ttl := dohMaxTTL
+	var firstErr error
+	for _, ch := range results {
+		res := <-ch
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		ips = append(ips, res.ips...)
+		if res.ttl < ttl {
+			ttl = res.ttl
+		}
+	}
+	if len(ips) == 0 {
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return nil, fmt.Errorf("DoH: no addresses for %s", host)
+	}
+
+	r.lock.Lock()
+	r.cache[host] = dohCacheEntry{ips: ips, expires: time.Now().Add(ttl)}
+	r.lock.Unlock()
+	return ips, nil
+}
+
+// Send one query to the DoH server, returning the addresses in the answer and
+// the smallest TTL among them.
+func (r *dohResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	// The ID is 0, as RFC 8484 section 4.1 recommends.
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	u := *r.endpoint
+	query := u.Query()
+	query.Set("dns", base64.RawURLEncoding.EncodeToString(buf))
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", dohMediaType)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH: status code %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohMediaType {
+		return nil, 0, fmt.Errorf("DoH: Content-Type %q", ct)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dohMaxMessageLength+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(body) > dohMaxMessageLength {
+		return nil, 0, errors.New("DoH: response is too long")
+	}
+
+	err = msg.Unpack(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !msg.Header.Response || msg.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("DoH: %s for %s", msg.Header.RCode, host)
+	}
+	// The answer may include CNAME records before the addresses; the
+	// server has already followed them, so take all the addresses of the
+	// type we asked for.
+	var ips []net.IP
+	ttl := dohMaxTTL
+	for _, answer := range msg.Answers {
+		if answer.Header.Type != qtype || answer.Header.Class != dnsmessage.ClassINET {
+			continue
+		}
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+		if t := time.Duration(answer.Header.TTL) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	return ips, ttl, nil
+}
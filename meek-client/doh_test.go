@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// A DoH server that answers from a fixed table of names and addresses, and
+// counts the queries it gets.
+type dohTestServer struct {
+	*httptest.Server
+	records map[string][]net.IP
+
+	lock       sync.Mutex
+	numQueries int
+}
+
+func newDoHTestServer(records map[string][]net.IP) *dohTestServer {
+	s := &dohTestServer{records: records}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *dohTestServer) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	s.numQueries++
+	s.lock.Unlock()
+
+	buf, err := base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var msg dnsmessage.Message
+	err = msg.Unpack(buf)
+	if err != nil || len(msg.Questions) != 1 {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+	q := msg.Questions[0]
+	msg.Header.Response = true
+	ips, ok := s.records[q.Name.String()]
+	if !ok {
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	}
+	for _, ip := range ips {
+		header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 300}
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			var body dnsmessage.AResource
+			copy(body.A[:], ip4)
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: &body})
+		} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+			var body dnsmessage.AAAAResource
+			copy(body.AAAA[:], ip)
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: &body})
+		}
+	}
+	buf, err = msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Write(buf)
+}
+
+// Make a dohResolver for the test server, whose certificate is valid for
+// example.com, using bootstrap to connect to it.
+func newTestDoHResolver(t *testing.T, s *dohTestServer) *dohResolver {
+	_, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := &url.URL{Scheme: "https", Host: net.JoinHostPort("example.com", port), Path: "/dns-query"}
+	r, err := newDoHResolver(endpoint, net.ParseIP("127.0.0.1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	r.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: roots}
+	return r
+}
+
+func TestDoHResolver(t *testing.T) {
+	s := newDoHTestServer(map[string][]net.IP{
+		"front.example.": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+		"v4.example.":    {net.ParseIP("192.0.2.2")},
+	})
+	defer s.Close()
+	r := newTestDoHResolver(t, s)
+
+	ips, err := r.lookup(context.Background(), "Front.Example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// IPv6 first.
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("2001:db8::1")) || !ips[1].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got %v", ips)
+	}
+	if s.numQueries != 2 {
+		t.Errorf("%d queries", s.numQueries)
+	}
+	// Cached.
+	_, err = r.lookup(context.Background(), "front.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.numQueries != 2 {
+		t.Errorf("%d queries after a cached lookup", s.numQueries)
+	}
+
+	ips, err = r.lookup(context.Background(), "v4.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.2")) {
+		t.Errorf("got %v", ips)
+	}
+
+	_, err = r.lookup(context.Background(), "nonexistent.example")
+	if err == nil {
+		t.Errorf("nonexistent name gave no error")
+	}
+
+	// IP addresses are not looked up.
+	ips, err = r.lookup(context.Background(), "192.0.2.3")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.3")) {
+		t.Errorf("got %v %v", ips, err)
+	}
+}
+
+func TestGetDoHResolver(t *testing.T) {
+	r1, err := getDoHResolver("https://doh.example/dns-query", "192.0.2.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := getDoHResolver("https://doh.example/dns-query", "192.0.2.1", nil)
+	if err != nil || r1 != r2 {
+		t.Errorf("resolver was not shared: %v", err)
+	}
+	for _, test := range []struct {
+		endpoint, bootstrap string
+	}{
+		{"http://doh.example/dns-query", ""},
+		{"https://doh.example/dns-query", "doh.example"},
+		{"%", ""},
+	} {
+		_, err = getDoHResolver(test.endpoint, test.bootstrap, nil)
+		if err == nil {
+			t.Errorf("%q %q: no error", test.endpoint, test.bootstrap)
+		}
+	}
+}
+
+// Test that the front's name is looked up with DoH, with native TLS and with
+// uTLS, with and without a proxy.
+func TestDoHFront(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	proxyServer := newConnectProxy()
+	defer proxyServer.Close()
+	proxyURL, err := url.Parse(proxyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	// The server's certificate is valid for example.com.
+	s := newDoHTestServer(map[string][]net.IP{
+		"example.com.": {net.ParseIP("127.0.0.1")},
+	})
+	defer s.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontURL := "https://" + net.JoinHostPort("example.com", port) + "/"
+	for _, test := range []struct {
+		name    string
+		cfg     *utls.Config
+		proxies proxyChain
+	}{
+		{"none", nil, nil},
+		{"HelloFirefox_63", nil, nil},
+		// net/http would have the proxy resolve example.com.
+		{"none", nil, proxyChain{proxyURL}},
+		// The ServerName is for the proxy, whose URL has an IP
+		// address.
+		{"HelloFirefox_63", &utls.Config{ServerName: "example.com"}, proxyChain{proxyURL}},
+	} {
+		// A new resolver, so that no lookup is cached.
+		settings := &frontSettings{RootCAs: roots, Resolver: newTestDoHResolver(t, s), key: "doh"}
+		s.lock.Lock()
+		numQueries := s.numQueries
+		s.lock.Unlock()
+		rt, err := NewUTLSRoundTripper(test.name, test.cfg, test.proxies, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("GET", frontURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Errorf("%s proxy %v: unexpected error %v", test.name, test.proxies, err)
+		} else {
+			resp.Body.Close()
+		}
+		if tr, ok := rt.(interface{ CloseIdleConnections() }); ok {
+			tr.CloseIdleConnections()
+		}
+		s.lock.Lock()
+		if s.numQueries == numQueries {
+			t.Errorf("%s proxy %v: DoH server got no queries", test.name, test.proxies)
+		}
+		s.lock.Unlock()
+	}
+}
@@ -0,0 +1,173 @@
+// Encrypted Client Hello (ECH).
+//
+// An "ech=" bridge line argument or --ech option gives an ECHConfigList, as
+// published by the front in its HTTPS DNS record. With ECH, the SNI that an
+// observer sees is the config's public name, while the real server name is
+// encrypted in the ClientHello.
+//
+// The value is the ECHConfigList in base64, or "file:" followed by the name of
+// a file that contains the ECHConfigList either in base64 or in binary.
+//
+// With utls=, ECH uses uTLS, which builds the encrypted inner ClientHello and
+// the outer one around it from the fingerprint. The fingerprint must have an
+// encrypted_client_hello extension (as the recent Chrome and Firefox ones do),
+// which in a browser would carry a GREASE value when it has no ECH config; uTLS
+// puts the real encrypted ClientHello there instead. Without utls=, or with
+// utls=none, ECH uses Go's crypto/tls.
+//
+// When the front rejects ECH, the error says so, and includes the retry configs
+// it offered, if any, in the form of an ech= argument.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// The prefix of an ECH argument that refers to a file.
+const echFilePrefix = "file:"
+
+// Decode an ech= argument into an ECHConfigList.
+func loadECHConfigList(arg string) ([]byte, error) {
+	var data []byte
+	if strings.HasPrefix(strings.ToLower(arg), echFilePrefix) {
+		contents, err := ioutil.ReadFile(arg[len(echFilePrefix):])
+		if err != nil {
+			return nil, err
+		}
+		data, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(contents)))
+		if err != nil {
+			// Not base64; take the file as binary.
+			data = contents
+		}
+	} else {
+		var err error
+		data, err = base64.StdEncoding.DecodeString(arg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode ECH config list: %v", err)
+		}
+	}
+	err := checkECHConfigList(data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Check the framing of an ECHConfigList (draft-ietf-tls-esni section 4). The
+// contents of each ECHConfig are checked by crypto/tls when it is used.
+func checkECHConfigList(data []byte) error {
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return fmt.Errorf("malformed ECH config list")
+	}
+	data = data[2:]
+	if len(data) == 0 {
+		return fmt.Errorf("empty ECH config list")
+	}
+	for len(data) > 0 {
+		// version (2 bytes), length (2 bytes), contents.
+		if len(data) < 4 || int(binary.BigEndian.Uint16(data[2:])) > len(data)-4 {
+			return fmt.Errorf("malformed ECH config list")
+		}
+		data = data[4+binary.BigEndian.Uint16(data[2:]):]
+	}
+	return nil
+}
+
+// Check that a uTLS fingerprint has an encrypted_client_hello extension, which
+// uTLS needs in order to send ECH.
+func checkECHClientHelloID(name string, id *utls.ClientHelloID) error {
+	var spec *utls.ClientHelloSpec
+	var err error
+	if id.Client == utls.HelloCustom.Client {
+		spec, err = clientHelloSpecForID(id)
+	} else {
+		var s utls.ClientHelloSpec
+		s, err = utls.UTLSIdToSpec(*id)
+		spec = &s
+	}
+	if err != nil {
+		return fmt.Errorf("cannot use ech with utls=%s: %v", name, err)
+	}
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(utls.EncryptedClientHelloExtension); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot use ech with utls=%s: it has no encrypted_client_hello extension", name)
+}
+
+// An http.RoundTripper that uses ECH, and turns ECH rejections into errors that
+// say what happened.
+type echRoundTripper struct {
+	http.RoundTripper
+}
+
+// Make an http.RoundTripper that uses ECH with the given ECHConfigList, and
+// the uTLS fingerprint utlsName, or native TLS if utlsName is "" or names
+// native TLS. A rotation list must already have been resolved to one name.
+func newECHRoundTripper(echConfigList []byte, utlsName string, proxies proxyChain, settings *frontSettings) (*echRoundTripper, error) {
+	var clientHelloID *utls.ClientHelloID
+	if utlsName != "" {
+		var err error
+		clientHelloID, err = lookupClientHelloID(utlsName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if clientHelloID == nil {
+		tr, err := newNativeECHRoundTripper(echConfigList, proxies, settings)
+		if err != nil {
+			return nil, err
+		}
+		return &echRoundTripper{tr}, nil
+	}
+	err := checkECHClientHelloID(utlsName, clientHelloID)
+	if err != nil {
+		return nil, err
+	}
+	rt, err := NewUTLSRoundTripper(utlsName, &utls.Config{EncryptedClientHelloConfigList: echConfigList}, proxies, settings)
+	if err != nil {
+		return nil, err
+	}
+	return &echRoundTripper{rt}, nil
+}
+
+func (rt *echRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.RoundTripper.RoundTrip(req)
+	if retryConfigList, ok := echRejection(err); ok {
+		if len(retryConfigList) == 0 {
+			return nil, fmt.Errorf("%s rejected ECH and offered no retry configs: %w", req.URL.Host, err)
+		}
+		return nil, fmt.Errorf("%s rejected ECH; it offered ech=%s: %w",
+			req.URL.Host, base64.StdEncoding.EncodeToString(retryConfigList), err)
+	}
+	return resp, err
+}
+
+func (rt *echRoundTripper) CloseIdleConnections() {
+	closeIdleConnections(rt.RoundTripper)
+}
+
+// If err is an ECH rejection, from crypto/tls or from uTLS, return the retry
+// configs the server sent (which may be empty).
+func echRejection(err error) ([]byte, bool) {
+	var echErr *tls.ECHRejectionError
+	if errors.As(err, &echErr) {
+		return echErr.RetryConfigList, true
+	}
+	var uechErr *utls.ECHRejectionError
+	if errors.As(err, &uechErr) {
+		return uechErr.RetryConfigList, true
+	}
+	return nil, false
+}
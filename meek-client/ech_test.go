@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckECHConfigList(t *testing.T) {
+	for _, test := range []struct {
+		input []byte
+		ok    bool
+	}{
+		{[]byte("\x00\x06\xfe\x0d\x00\x02\xaa\xbb"), true},
+		{[]byte("\x00\x0b\xfe\x0d\x00\x02\xaa\xbb\xfe\x0d\x00\x01\xcc"), true},
+		{[]byte(""), false},
+		{[]byte("\x00"), false},
+		// Empty list.
+		{[]byte("\x00\x00"), false},
+		// List length too long.
+		{[]byte("\x00\x07\xfe\x0d\x00\x02\xaa\xbb"), false},
+		// List length too short.
+		{[]byte("\x00\x05\xfe\x0d\x00\x02\xaa\xbb"), false},
+		// Config length too long.
+		{[]byte("\x00\x06\xfe\x0d\x00\x03\xaa\xbb"), false},
+		// Truncated config header.
+		{[]byte("\x00\x03\xfe\x0d\x00"), false},
+	} {
+		err := checkECHConfigList(test.input)
+		if test.ok && err != nil {
+			t.Errorf("%x: unexpected error %v", test.input, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%x: expected error", test.input)
+		}
+	}
+}
+
+func TestLoadECHConfigList(t *testing.T) {
+	list := []byte("\x00\x06\xfe\x0d\x00\x02\xaa\xbb")
+	encoded := base64.StdEncoding.EncodeToString(list)
+
+	dir, err := ioutil.TempDir("", "meek-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binFilename := filepath.Join(dir, "ech.bin")
+	err = ioutil.WriteFile(binFilename, list, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64Filename := filepath.Join(dir, "ech.b64")
+	err = ioutil.WriteFile(b64Filename, []byte(encoded+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, arg := range []string{encoded, "file:" + binFilename, "FILE:" + b64Filename} {
+		output, err := loadECHConfigList(arg)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", arg, err)
+		} else if string(output) != string(list) {
+			t.Errorf("%q → %x, expected %x", arg, output, list)
+		}
+	}
+	for _, arg := range []string{"", "!!!", base64.StdEncoding.EncodeToString([]byte("\x00\x05")), "file:" + filepath.Join(dir, "nonexistent")} {
+		_, err := loadECHConfigList(arg)
+		if err == nil {
+			t.Errorf("%q: expected error", arg)
+		}
+	}
+}
+
+// Make an ECHConfig (draft-ietf-tls-esni section 4) for an X25519 key, using
+// HKDF-SHA256 and AES-128-GCM.
+func makeECHConfig(configID uint8, publicKey []byte, publicName string) []byte {
+	var contents []byte
+	contents = append(contents, configID)
+	contents = binary.BigEndian.AppendUint16(contents, 0x0020) // DHKEM(X25519, HKDF-SHA256)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(publicKey)))
+	contents = append(contents, publicKey...)
+	contents = binary.BigEndian.AppendUint16(contents, 4)
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001) // HKDF-SHA256
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001) // AES-128-GCM
+	contents = append(contents, 0)                             // maximum_name_length
+	contents = append(contents, uint8(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0) // extensions
+
+	config := binary.BigEndian.AppendUint16(nil, 0xfe0d)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	return append(config, contents...)
+}
+
+// Return an ECHConfig and the corresponding server key.
+func makeECHKey(t *testing.T, configID uint8) ([]byte, tls.EncryptedClientHelloKey) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The httptest certificate is valid for example.com, which the client
+	// checks when ECH is rejected.
+	config := makeECHConfig(configID, priv.PublicKey().Bytes(), "example.com")
+	return config, tls.EncryptedClientHelloKey{
+		Config:      config,
+		PrivateKey:  priv.Bytes(),
+		SendAsRetry: true,
+	}
+}
+
+func makeECHConfigList(configs ...[]byte) []byte {
+	var list []byte
+	for _, config := range configs {
+		list = append(list, config...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(list))), list...)
+}
+
+func TestECHRoundTripper(t *testing.T) {
+	serverConfig, serverKey := makeECHKey(t, 1)
+	otherConfig, _ := makeECHKey(t, 2)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !req.TLS.ECHAccepted {
+			t.Errorf("request without ECH")
+		}
+	}))
+	server.TLS = &tls.Config{EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{serverKey}}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	// The front's name is example.com, for which the server's certificate
+	// is valid, and front-ip sends connections to the server.
+	settings := &frontSettings{RootCAs: roots, FrontIPs: []net.IP{net.ParseIP("127.0.0.1")}, key: "test"}
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontURL := "https://" + net.JoinHostPort("example.com", port) + "/"
+
+	// A spec file with an encrypted_client_hello extension.
+	dir, err := ioutil.TempDir("", "meek-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	specFilename := filepath.Join(dir, "spec.json")
+	err = ioutil.WriteFile(specFilename, []byte(`{
+		"cipher_suites": ["TLS_AES_128_GCM_SHA256"],
+		"extensions": [
+			{"name": "server_name"},
+			{"name": "supported_groups", "groups": ["X25519"]},
+			{"name": "signature_algorithms", "algorithms": ["ecdsa_secp256r1_sha256", "rsa_pss_rsae_sha256"]},
+			{"name": "key_share", "groups": ["X25519"]},
+			{"name": "supported_versions", "versions": ["1.3"]},
+			{"name": "application_layer_protocol_negotiation", "protocols": ["http/1.1"]},
+			{"name": "encrypted_client_hello"}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, utlsName := range []string{"", "none", "HelloChrome_Auto", "HelloFirefox_Auto", "file:" + specFilename} {
+		for _, test := range []struct {
+			config   []byte
+			errorStr string
+		}{
+			{serverConfig, ""},
+			{otherConfig, "rejected ECH; it offered ech="},
+		} {
+			rt, err := newECHRoundTripper(makeECHConfigList(test.config), utlsName, nil, settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest("GET", frontURL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := rt.RoundTrip(req)
+			if test.errorStr == "" {
+				if err != nil {
+					t.Errorf("utls=%q: unexpected error %v", utlsName, err)
+					continue
+				}
+				resp.Body.Close()
+			} else if err == nil || !strings.Contains(err.Error(), test.errorStr) {
+				t.Errorf("utls=%q: expected error containing %q, got %v", utlsName, test.errorStr, err)
+			}
+			rt.CloseIdleConnections()
+		}
+	}
+
+	// Fingerprints without an encrypted_client_hello extension cannot
+	// carry ECH.
+	_, err = newECHRoundTripper(makeECHConfigList(serverConfig), "HelloChrome_83", nil, settings)
+	if err == nil || !strings.Contains(err.Error(), "no encrypted_client_hello extension") {
+		t.Errorf("HelloChrome_83: expected error, got %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+// Per-bridge settings for connections to the front.
+//
+// These settings control how meek-client connects to the front and verifies
+// its certificate. Each can come from a SOCKS arg on a bridge line or from
+// the equivalent command-line option, and each applies to the native, uTLS,
+// and ECH ways of connecting (but not to --helper, which leaves connections
+// to the browser).
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/proxy"
+)
+
+type frontSettings struct {
+	// Roots for verifying the certificates of the front and of an HTTPS
+	// proxy; nil means the system roots.
+	RootCAs *x509.CertPool
+	// Checked in addition to the usual certificate verification; nil
+	// means no pinning.
+	Pins pinSet
+	// Addresses to connect to instead of resolving the front's name; nil
+	// means resolve the name as usual.
+	FrontIPs []net.IP
+	// Looks up the front's name when there is no FrontIPs; nil means use
+	// the system resolver.
+	Resolver *dohResolver
+
+	// Identifies the settings, for RoundTripper pool keys.
+	key string
+	// Identifies the settings that decide which certificates are
+	// accepted (ca-file and pin), for TLS session cache keys.
+	trustKey string
+	// Names of the settings that were given, for error messages.
+	names []string
+}
+
+// Get the front settings from SOCKS args, falling back to command-line
+// options.
+func getFrontSettings(args pt.Args) (*frontSettings, error) {
+	var settings frontSettings
+	var keys []string
+
+	// First check ca-file= SOCKS arg, then --ca-file option.
+	caFile, ok := args.Get("ca-file")
+	if ok {
+	} else if options.CAFile != "" {
+		caFile = options.CAFile
+		ok = true
+	}
+	if ok {
+		var err error
+		settings.RootCAs, err = loadCAFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, "ca-file="+caFile)
+		settings.names = append(settings.names, "ca-file")
+	}
+
+	// First check pin= SOCKS arg, then --pin option.
+	pinArg, ok := args.Get("pin")
+	if ok {
+	} else if options.Pins != "" {
+		pinArg = options.Pins
+		ok = true
+	}
+	if ok {
+		var err error
+		settings.Pins, err = parsePins(pinArg)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, "pin="+settings.Pins.String())
+		settings.names = append(settings.names, "pin")
+	}
+	settings.trustKey = strings.Join(keys, ";")
+
+	// First check front-ip= SOCKS arg, then --front-ip option.
+	frontIPArg, ok := args.Get("front-ip")
+	if ok {
+	} else if options.FrontIPs != "" {
+		frontIPArg = options.FrontIPs
+		ok = true
+	}
+	if ok {
+		var err error
+		settings.FrontIPs, err = parseFrontIPs(frontIPArg)
+		if err != nil {
+			return nil, err
+		}
+		var ips []string
+		for _, ip := range settings.FrontIPs {
+			ips = append(ips, ip.String())
+		}
+		keys = append(keys, "front-ip="+strings.Join(ips, ","))
+		settings.names = append(settings.names, "front-ip")
+	}
+
+	// First check doh= SOCKS arg, then --doh option. doh-bootstrap= goes
+	// with doh=, and --doh-bootstrap with --doh.
+	dohArg, ok := args.Get("doh")
+	var dohBootstrapArg string
+	if ok {
+		dohBootstrapArg, _ = args.Get("doh-bootstrap")
+	} else if options.DoH != "" {
+		dohArg = options.DoH
+		dohBootstrapArg = options.DoHBootstrap
+		ok = true
+	}
+	if ok {
+		proxies, err := dohProxies(dohArg)
+		if err != nil {
+			return nil, err
+		}
+		settings.Resolver, err = getDoHResolver(dohArg, dohBootstrapArg, proxies)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, "doh="+dohArg+" "+dohBootstrapArg)
+		settings.names = append(settings.names, "doh")
+	}
+
+	settings.key = strings.Join(keys, ";")
+	return &settings, nil
+}
+
+// Return the view of utlsSessionCache for connections with these settings, so
+// that sessions are resumed only by connections with the same trust settings.
+func (settings *frontSettings) sessionCache() utls.ClientSessionCache {
+	if settings == nil {
+		return utlsSessionCache.scoped("", nil)
+	}
+	return utlsSessionCache.scoped(settings.trustKey, settings.RootCAs)
+}
+
+// Whether the settings are all defaults, so that httpRoundTripper can be used
+// for native connections.
+func (settings *frontSettings) isDefault() bool {
+	return settings == nil || settings.key == ""
+}
+
+// Make an http.RoundTripper that uses native TLS according to the settings.
+func newNativeRoundTripper(proxies proxyChain, settings *frontSettings) (*http.Transport, error) {
+	return newNativeECHRoundTripper(nil, proxies, settings)
+}
+
+// Make an http.RoundTripper that uses native TLS according to the settings,
+// and ECH with echConfigList if it is not nil.
+func newNativeECHRoundTripper(echConfigList []byte, proxies proxyChain, settings *frontSettings) (*http.Transport, error) {
+	tr := httpRoundTripper.Clone()
+	// net/http uses TLSClientConfig for an HTTPS proxy as well as for the
+	// front. That is what we want for RootCAs, but pins and ECH are for
+	// the front only.
+	tr.TLSClientConfig = &tls.Config{EncryptedClientHelloConfigList: echConfigList}
+	var forward proxy.Dialer = newNetDialer()
+	var proxyCfg *utls.Config
+	if settings != nil && settings.RootCAs != nil {
+		proxyCfg = &utls.Config{
+			RootCAs:            settings.RootCAs,
+			ClientSessionCache: settings.sessionCache(),
+		}
+	}
+	proxyDialer, err := makeNativeProxyDialer(proxies, forward, proxyCfg)
+	if err != nil {
+		return nil, err
+	}
+	frontOnlyTLS := echConfigList != nil || settings != nil && settings.Pins != nil
+	if proxyDialer == nil && len(proxies) > 0 && (settings.needsDialer() ||
+		frontOnlyTLS && proxies.single().Scheme == "https") {
+		// With a proxy that net/http handles, the proxy would resolve
+		// the front's name, ignoring front-ip and doh. And net/http
+		// would use TLSClientConfig, and so the pins and ECH, for the
+		// TLS connection to an HTTPS proxy too. In either case, dial
+		// through the proxy ourselves, as in uTLS mode.
+		proxyDialer, err = makeProxyDialer(proxies, forward, proxyCfg, &utls.HelloGolang)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if proxyDialer != nil {
+		// Proxies that net/http cannot use itself, or may not; we
+		// dial through them.
+		tr.Proxy = nil
+		forward = proxyDialer
+	} else {
+		tr.Proxy = http.ProxyURL(proxies.single())
+	}
+	// With a proxy that net/http handles, DialContext connects to the
+	// proxy, and the settings need no dialer.
+	if len(proxies) == 0 || proxyDialer != nil {
+		dialer := settings.dialer(forward)
+		tr.DialContext = dialer.DialContext
+	}
+	if settings == nil {
+		return tr, nil
+	}
+	tr.TLSClientConfig.RootCAs = settings.RootCAs
+	if pins := settings.Pins; pins != nil {
+		// TLSClientConfig is used only for the front, because an
+		// HTTPS proxy is dialed above.
+		tr.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return pins.check(cs.ServerName, cs.VerifiedChains)
+		}
+	}
+	return tr, nil
+}
+
+// Parse a comma-separated list of IPv4 and IPv6 addresses.
+func parseFrontIPs(arg string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, s := range strings.Split(arg, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return nil, fmt.Errorf("cannot parse front-ip %q", s)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// Return a dialer for connections to the front, which makes connections
+// through forward. All the connections that the dialer makes are assumed to
+// be to the front.
+func (settings *frontSettings) dialer(forward proxy.Dialer) *frontDialer {
+	d := &frontDialer{forward: forward}
+	if settings != nil {
+		d.ips = interleaveAddressFamilies(settings.FrontIPs)
+		d.resolver = settings.Resolver
+	}
+	return d
+}
+
+// Whether connections to the front need a frontDialer rather than dialing the
+// front's name.
+func (settings *frontSettings) needsDialer() bool {
+	return settings != nil && (settings.FrontIPs != nil || settings.Resolver != nil)
+}
+
+// A proxy.Dialer that connects to the front's addresses from front-ip, or
+// else those that resolver looks up, racing them with dialHappyEyeballs. The
+// name in the address to dial is still used for SNI and certificate
+// verification by the TLS layer above.
+type frontDialer struct {
+	forward  proxy.Dialer
+	ips      []net.IP
+	resolver *dohResolver
+}
+
+func (d *frontDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *frontDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.ips == nil && d.resolver == nil {
+		return dialContext(ctx, d.forward, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips := d.ips
+	if ips == nil {
+		ips, err = d.resolver.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips = interleaveAddressFamilies(ips)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return dialHappyEyeballs(ctx, d.forward, network, addrs)
+}
+
+// CA files that have been loaded, indexed by file name. Each is loaded only
+// once, so changes to a file take effect only after a restart.
+var caFiles = struct {
+	sync.Mutex
+	m map[string]*x509.CertPool
+}{m: make(map[string]*x509.CertPool)}
+
+// Load a file of PEM-encoded CA certificates into a CertPool.
+func loadCAFile(filename string) (*x509.CertPool, error) {
+	caFiles.Lock()
+	defer caFiles.Unlock()
+
+	if pool, ok := caFiles.m[filename]; ok {
+		return pool, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", filename)
+	}
+	caFiles.m[filename] = pool
+	return pool, nil
+}
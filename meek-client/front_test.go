@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+	utls "github.com/refraction-networking/utls"
+)
+
+// Write the certificate of an httptest server to a PEM file in dir.
+func writeCAFile(t *testing.T, dir string, server *httptest.Server) string {
+	filename := filepath.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err := ioutil.WriteFile(filename, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// An HTTPS proxy that handles CONNECT requests.
+func newConnectProxy() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		conn, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer conn.Close()
+		clientConn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer clientConn.Close()
+		_, err = bufrw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+		if err == nil {
+			err = bufrw.Flush()
+		}
+		if err != nil {
+			return
+		}
+		go io.Copy(conn, bufrw)
+		io.Copy(clientConn, conn)
+	}))
+}
+
+func TestLoadCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "meek-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := writeCAFile(t, dir, server)
+	pool, err := loadCAFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.Subjects()) != 1 {
+		t.Errorf("expected 1 certificate, got %d", len(pool.Subjects()))
+	}
+	// Loaded only once.
+	pool2, err := loadCAFile(filename)
+	if err != nil || pool2 != pool {
+		t.Errorf("file was not cached: %v", err)
+	}
+
+	notPEM := filepath.Join(dir, "not.pem")
+	err = ioutil.WriteFile(notPEM, []byte("not PEM\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{notPEM, filepath.Join(dir, "nonexistent.pem")} {
+		_, err = loadCAFile(filename)
+		if err == nil {
+			t.Errorf("%s: no error", filename)
+		}
+	}
+}
+
+func TestGetFrontSettings(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	good, _ := testPins(t, server)
+
+	dir, err := ioutil.TempDir("", "meek-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := writeCAFile(t, dir, server)
+
+	settings, err := getFrontSettings(pt.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !settings.isDefault() || settings.RootCAs != nil || settings.Pins != nil {
+		t.Errorf("no args gave non-default settings %+v", settings)
+	}
+
+	args := pt.Args{}
+	args.Add("ca-file", filename)
+	args.Add("pin", good.String())
+	settings, err = getFrontSettings(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.isDefault() || settings.RootCAs == nil || settings.Pins == nil {
+		t.Errorf("args gave default settings %+v", settings)
+	}
+	expected := "ca-file=" + filename + ";pin=" + good.String()
+	if settings.key != expected {
+		t.Errorf("key %q, expected %q", settings.key, expected)
+	}
+
+	args = pt.Args{}
+	args.Add("ca-file", filepath.Join(dir, "nonexistent.pem"))
+	_, err = getFrontSettings(args)
+	if err == nil {
+		t.Errorf("nonexistent ca-file gave no error")
+	}
+}
+
+// Test that a CA file is used to verify the front, with native TLS and with
+// uTLS, directly and through an HTTPS proxy.
+func TestCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	proxyServer := newConnectProxy()
+	defer proxyServer.Close()
+	proxyURL, err := url.Parse(proxyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "meek-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The httptest servers share a certificate, so this trusts both.
+	roots, err := loadCAFile(writeCAFile(t, dir, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"none", "HelloFirefox_63"} {
+		for _, proxies := range []proxyChain{nil, {proxyURL}} {
+			for _, settings := range []*frontSettings{
+				{RootCAs: roots, key: "ca-file"},
+				// The system roots do not trust the server.
+				{},
+			} {
+				// The server's certificate is valid for
+				// example.com. The ServerName is ignored for
+				// native TLS.
+				rt, err := NewUTLSRoundTripper(name, &utls.Config{ServerName: "example.com"}, proxies, settings)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req, err := http.NewRequest("GET", server.URL, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := rt.RoundTrip(req)
+				if settings.RootCAs != nil {
+					if err != nil {
+						t.Errorf("%s proxy %v: unexpected error %v", name, proxies, err)
+					} else {
+						resp.Body.Close()
+					}
+				} else if err == nil {
+					resp.Body.Close()
+					t.Errorf("%s proxy %v: untrusted server was accepted", name, proxies)
+				}
+				if tr, ok := rt.(interface{ CloseIdleConnections() }); ok {
+					tr.CloseIdleConnections()
+				}
+			}
+		}
+	}
+}
+
+// Test that front-ip addresses are dialed instead of resolving the front's
+// name, which is still used for certificate verification.
+func TestFrontIP(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	proxyServer := newConnectProxy()
+	defer proxyServer.Close()
+	proxyURL, err := url.Parse(proxyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	// The server's certificate is valid for example.com. The first
+	// address does not answer.
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontURL := "https://" + net.JoinHostPort("example.com", port) + "/"
+	frontIPs, err := parseFrontIPs("192.0.2.1,127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := &frontSettings{RootCAs: roots, FrontIPs: frontIPs, key: "front-ip"}
+
+	for _, test := range []struct {
+		name    string
+		cfg     *utls.Config
+		proxies proxyChain
+	}{
+		{"none", nil, nil},
+		{"HelloFirefox_63", nil, nil},
+		// net/http would have the proxy resolve example.com.
+		{"none", nil, proxyChain{proxyURL}},
+		// The ServerName is for the proxy, whose URL has an IP
+		// address.
+		{"HelloFirefox_63", &utls.Config{ServerName: "example.com"}, proxyChain{proxyURL}},
+	} {
+		rt, err := NewUTLSRoundTripper(test.name, test.cfg, test.proxies, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("GET", frontURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Errorf("%s proxy %v: unexpected error %v", test.name, test.proxies, err)
+		} else {
+			resp.Body.Close()
+		}
+		if tr, ok := rt.(interface{ CloseIdleConnections() }); ok {
+			tr.CloseIdleConnections()
+		}
+	}
+}
+
+func TestParseFrontIPs(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		ok    bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.1,2001:db8::1", true},
+		{"192.0.2.1, 2001:db8::1", true},
+		{"", false},
+		{"192.0.2.1,", false},
+		{"example.com", false},
+		{"[2001:db8::1]", false},
+		{"192.0.2.1:443", false},
+	} {
+		_, err := parseFrontIPs(test.input)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error %v", test.input, err)
+		}
+	}
+}
@@ -0,0 +1,555 @@
+// HTTP/2 fingerprint imitation for uTLS connections.
+//
+// Even with a browser's TLS ClientHello, the golang.org/x/net/http2 transport
+// is recognizable by the HTTP/2 frames it sends: its initial SETTINGS, its
+// connection WINDOW_UPDATE, its lack of PRIORITY information, and the order
+// of its pseudo-header fields. http2.Transport offers no way to change most of
+// these, so http2FingerprintConn sits between the transport and the TLS
+// connection and rewrites the frames the transport writes:
+//   - The transport's initial SETTINGS frame is replaced by the profile's
+//     settings, in the profile's order.
+//   - The transport's initial connection WINDOW_UPDATE is replaced by the
+//     profile's (or dropped, if the profile has none).
+//   - The profile's PRIORITY frames are sent after the initial SETTINGS.
+//   - Request HEADERS frames are re-encoded with the pseudo-header fields in
+//     the profile's order, and with the profile's priority.
+//
+// Some things cannot be changed this way and remain as http2.Transport does
+// them:
+//   - Stream IDs start at 1. (Firefox, for example, starts at 15, after the
+//     streams it uses for its PRIORITY frames.)
+//   - The order and case of regular header fields are those of net/http.
+//   - The timing and size of later WINDOW_UPDATE frames, and PING frames.
+//   - The transport's flow control enforces a stream window of 4 MB, so a
+//     profile may not advertise a larger INITIAL_WINDOW_SIZE. The Chrome
+//     profile advertises 4 MB rather than Chrome's 6 MB.
+//   - The transport refuses server push, so every profile sends
+//     ENABLE_PUSH 0.
+//
+// Profiles are paired with ClientHelloIDs: the built-in ClientHelloIDs use
+// http2FingerprintMap according to their Client, and spec files (see
+// clienthellospec.go) may have an "http2" member.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// The largest frame payload we write. Every HTTP/2 peer must accept at least
+// this much.
+const http2MaxFrameSize = 16384
+
+// The stream receive window that http2.Transport enforces
+// (transportDefaultStreamFlow in golang.org/x/net/http2). Advertising a larger
+// INITIAL_WINDOW_SIZE would let the server send more than the transport
+// accepts.
+const http2MaxInitialWindowSize = 4 << 20
+
+// The parameters of a PRIORITY frame.
+type http2PriorityFrame struct {
+	StreamID uint32
+	http2.PriorityParam
+}
+
+// How to imitate a browser's HTTP/2 frames.
+type http2Fingerprint struct {
+	// Sent, in order, in the initial SETTINGS frame.
+	Settings []http2.Setting
+	// Increment of the initial connection WINDOW_UPDATE frame; 0 means
+	// none.
+	ConnectionFlow uint32
+	// PRIORITY frames to send after the initial SETTINGS.
+	PriorityFrames []http2PriorityFrame
+	// Priority of request HEADERS frames; nil means none.
+	HeadersPriority *http2.PriorityParam
+	// The order of pseudo-header fields, e.g. ":method", ":authority",
+	// ":scheme", ":path". Pseudo-header fields not listed come after those
+	// that are, in their original order.
+	PseudoHeaderOrder []string
+}
+
+// Profiles for the built-in ClientHelloIDs, by ClientHelloID.Client. The values
+// are those of the browser versions of the latest ClientHelloIDs of each
+// family. ClientHelloIDs not in this map, such as HelloRandomizedALPN, use the
+// unmodified http2.Transport.
+var http2FingerprintMap = map[string]*http2Fingerprint{
+	utls.HelloChrome_Auto.Client: {
+		Settings: []http2.Setting{
+			{ID: http2.SettingHeaderTableSize, Val: 65536},
+			{ID: http2.SettingEnablePush, Val: 0},
+			{ID: http2.SettingMaxConcurrentStreams, Val: 1000},
+			{ID: http2.SettingInitialWindowSize, Val: http2MaxInitialWindowSize},
+			{ID: http2.SettingMaxHeaderListSize, Val: 262144},
+		},
+		ConnectionFlow:    15663105,
+		HeadersPriority:   &http2.PriorityParam{StreamDep: 0, Exclusive: true, Weight: 255},
+		PseudoHeaderOrder: []string{":method", ":authority", ":scheme", ":path"},
+	},
+	utls.HelloFirefox_Auto.Client: {
+		Settings: []http2.Setting{
+			{ID: http2.SettingHeaderTableSize, Val: 65536},
+			{ID: http2.SettingEnablePush, Val: 0},
+			{ID: http2.SettingInitialWindowSize, Val: 131072},
+			{ID: http2.SettingMaxFrameSize, Val: 16384},
+		},
+		ConnectionFlow: 12517377,
+		PriorityFrames: []http2PriorityFrame{
+			{3, http2.PriorityParam{StreamDep: 0, Weight: 200}},
+			{5, http2.PriorityParam{StreamDep: 0, Weight: 100}},
+			{7, http2.PriorityParam{StreamDep: 0, Weight: 0}},
+			{9, http2.PriorityParam{StreamDep: 7, Weight: 0}},
+			{11, http2.PriorityParam{StreamDep: 3, Weight: 0}},
+			{13, http2.PriorityParam{StreamDep: 0, Weight: 240}},
+		},
+		HeadersPriority:   &http2.PriorityParam{StreamDep: 13, Weight: 41},
+		PseudoHeaderOrder: []string{":method", ":path", ":authority", ":scheme"},
+	},
+	utls.HelloIOS_Auto.Client: {
+		Settings: []http2.Setting{
+			{ID: http2.SettingEnablePush, Val: 0},
+			{ID: http2.SettingInitialWindowSize, Val: 2097152},
+			{ID: http2.SettingMaxConcurrentStreams, Val: 100},
+		},
+		ConnectionFlow:    10485760,
+		HeadersPriority:   &http2.PriorityParam{StreamDep: 0, Weight: 254},
+		PseudoHeaderOrder: []string{":method", ":scheme", ":path", ":authority"},
+	},
+}
+
+// Return the HTTP/2 profile that goes with a ClientHelloID, or nil if there is
+// none.
+func http2FingerprintForID(id *utls.ClientHelloID) *http2Fingerprint {
+	if id.Client == utls.HelloCustom.Client {
+		return http2FingerprintForSpecID(id)
+	}
+	return http2FingerprintMap[id.Client]
+}
+
+// Set the http2.Transport options that must agree with the settings we
+// advertise. For example, if we advertise a larger HEADER_TABLE_SIZE than the
+// transport's decoder allows, the transport will fail to decode responses.
+func (fp *http2Fingerprint) configureTransport(tr *http2.Transport) {
+	for _, s := range fp.Settings {
+		switch s.ID {
+		case http2.SettingHeaderTableSize:
+			tr.MaxDecoderHeaderTableSize = s.Val
+		case http2.SettingMaxHeaderListSize:
+			tr.MaxHeaderListSize = s.Val
+		case http2.SettingMaxFrameSize:
+			tr.MaxReadFrameSize = s.Val
+		}
+	}
+}
+
+// Check that the settings are ones the transport enforces: push disabled, and
+// a stream window no larger than the transport's.
+func (fp *http2Fingerprint) checkSettings() error {
+	push := false
+	for _, s := range fp.Settings {
+		switch s.ID {
+		case http2.SettingEnablePush:
+			if s.Val != 0 {
+				return fmt.Errorf("ENABLE_PUSH must be 0")
+			}
+			push = true
+		case http2.SettingInitialWindowSize:
+			if s.Val > http2MaxInitialWindowSize {
+				return fmt.Errorf("INITIAL_WINDOW_SIZE %d is larger than %d", s.Val, http2MaxInitialWindowSize)
+			}
+		}
+	}
+	if !push {
+		return fmt.Errorf("settings do not include ENABLE_PUSH 0")
+	}
+	return nil
+}
+
+// A net.Conn that rewrites the HTTP/2 frames written to it, as described at
+// the top of this file. Reads are not modified.
+type http2FingerprintConn struct {
+	net.Conn
+	fp *http2Fingerprint
+
+	// Bytes written but not yet forming a complete frame.
+	pending []byte
+	// Rewritten frames ready to go to the underlying Conn.
+	out bytes.Buffer
+	fr  *http2.Framer
+
+	prefaceDone      bool
+	settingsDone     bool
+	dropWindowUpdate bool
+	headersStreamID  uint32
+	headersEndStream bool
+	headersBlock     []byte
+	inHeaders        bool
+	dec              *hpack.Decoder
+	enc              *hpack.Encoder
+	encBuf           bytes.Buffer
+}
+
+func newHTTP2FingerprintConn(conn net.Conn, fp *http2Fingerprint) *http2FingerprintConn {
+	c := &http2FingerprintConn{
+		Conn: conn,
+		fp:   fp,
+		// http2.Transport's encoder never uses a dynamic table larger
+		// than the initial 4096 bytes.
+		dec: hpack.NewDecoder(4096, nil),
+	}
+	c.fr = http2.NewFramer(&c.out, nil)
+	c.enc = hpack.NewEncoder(&c.encBuf)
+	return c
+}
+
+// Write rewrites whatever complete frames are in p (along with earlier
+// incomplete writes), and writes the result to the underlying Conn.
+func (c *http2FingerprintConn) Write(p []byte) (int, error) {
+	c.pending = append(c.pending, p...)
+	err := c.process()
+	if err != nil {
+		return 0, err
+	}
+	if c.out.Len() > 0 {
+		_, err = c.Conn.Write(c.out.Bytes())
+		c.out.Reset()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *http2FingerprintConn) process() error {
+	if !c.prefaceDone {
+		if len(c.pending) < len(http2.ClientPreface) {
+			return nil
+		}
+		if string(c.pending[:len(http2.ClientPreface)]) != http2.ClientPreface {
+			return fmt.Errorf("missing HTTP/2 client preface")
+		}
+		c.out.WriteString(http2.ClientPreface)
+		c.pending = c.pending[len(http2.ClientPreface):]
+		c.prefaceDone = true
+	}
+
+	p := c.pending
+	for len(p) >= 9 {
+		length := int(p[0])<<16 | int(p[1])<<8 | int(p[2])
+		if len(p) < 9+length {
+			break
+		}
+		typ := http2.FrameType(p[3])
+		flags := http2.Flags(p[4])
+		streamID := binary.BigEndian.Uint32(p[5:9]) & (1<<31 - 1)
+		frame := p[:9+length]
+		p = p[9+length:]
+
+		var err error
+		switch {
+		case typ == http2.FrameSettings && !flags.Has(http2.FlagSettingsAck) && !c.settingsDone:
+			err = c.writeInitialFrames()
+		case typ == http2.FrameWindowUpdate && streamID == 0 && c.dropWindowUpdate:
+			// Replaced by the one in writeInitialFrames.
+			c.dropWindowUpdate = false
+		case typ == http2.FrameHeaders:
+			err = c.startHeaders(streamID, flags, frame[9:])
+		case typ == http2.FrameContinuation && c.inHeaders:
+			c.headersBlock = append(c.headersBlock, frame[9:]...)
+			if flags.Has(http2.FlagContinuationEndHeaders) {
+				err = c.writeHeaders()
+			}
+		default:
+			c.out.Write(frame)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	c.pending = append(c.pending[:0], p...)
+	return nil
+}
+
+// Write the profile's replacement for the transport's initial SETTINGS and
+// WINDOW_UPDATE frames.
+func (c *http2FingerprintConn) writeInitialFrames() error {
+	c.settingsDone = true
+	c.dropWindowUpdate = true
+	err := c.fr.WriteSettings(c.fp.Settings...)
+	if err != nil {
+		return err
+	}
+	if c.fp.ConnectionFlow != 0 {
+		err = c.fr.WriteWindowUpdate(0, c.fp.ConnectionFlow)
+		if err != nil {
+			return err
+		}
+	}
+	for _, pf := range c.fp.PriorityFrames {
+		err = c.fr.WritePriority(pf.StreamID, pf.PriorityParam)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Begin collecting a header block from a HEADERS frame payload.
+func (c *http2FingerprintConn) startHeaders(streamID uint32, flags http2.Flags, payload []byte) error {
+	if flags.Has(http2.FlagHeadersPadded) {
+		if len(payload) < 1 || int(payload[0]) > len(payload)-1 {
+			return fmt.Errorf("bad HEADERS padding")
+		}
+		payload = payload[1 : len(payload)-int(payload[0])]
+	}
+	if flags.Has(http2.FlagHeadersPriority) {
+		if len(payload) < 5 {
+			return fmt.Errorf("bad HEADERS priority")
+		}
+		payload = payload[5:]
+	}
+	c.inHeaders = true
+	c.headersStreamID = streamID
+	c.headersEndStream = flags.Has(http2.FlagHeadersEndStream)
+	c.headersBlock = append(c.headersBlock[:0], payload...)
+	if flags.Has(http2.FlagHeadersEndHeaders) {
+		return c.writeHeaders()
+	}
+	return nil
+}
+
+// Re-encode a complete header block and write it in HEADERS and CONTINUATION
+// frames.
+func (c *http2FingerprintConn) writeHeaders() error {
+	c.inHeaders = false
+	// Mirror any dynamic table size change the transport makes, so that
+	// our encoder stays within what the server allows.
+	if size, ok := hpackTableSizeUpdate(c.headersBlock); ok {
+		c.enc.SetMaxDynamicTableSizeLimit(size)
+	}
+	fields, err := c.dec.DecodeFull(c.headersBlock)
+	if err != nil {
+		return err
+	}
+	isRequest := len(fields) > 0 && strings.HasPrefix(fields[0].Name, ":")
+	orderPseudoHeaders(fields, c.fp.PseudoHeaderOrder)
+
+	c.encBuf.Reset()
+	for _, f := range fields {
+		err = c.enc.WriteField(f)
+		if err != nil {
+			return err
+		}
+	}
+	block := c.encBuf.Bytes()
+
+	// The HEADERS frame, whose flags and priority we build ourselves
+	// because http2.Framer.WriteHeaders omits a priority that equals the
+	// default.
+	var payload []byte
+	flags := http2.Flags(0)
+	if c.headersEndStream {
+		flags |= http2.FlagHeadersEndStream
+	}
+	if isRequest && c.fp.HeadersPriority != nil {
+		flags |= http2.FlagHeadersPriority
+		dep := c.fp.HeadersPriority.StreamDep
+		if c.fp.HeadersPriority.Exclusive {
+			dep |= 1 << 31
+		}
+		payload = append(payload, byte(dep>>24), byte(dep>>16), byte(dep>>8), byte(dep), c.fp.HeadersPriority.Weight)
+	}
+	n := len(block)
+	if n > http2MaxFrameSize-len(payload) {
+		n = http2MaxFrameSize - len(payload)
+	}
+	payload = append(payload, block[:n]...)
+	block = block[n:]
+	if len(block) == 0 {
+		flags |= http2.FlagHeadersEndHeaders
+	}
+	err = c.fr.WriteRawFrame(http2.FrameHeaders, flags, c.headersStreamID, payload)
+	if err != nil {
+		return err
+	}
+
+	// Any CONTINUATION frames.
+	for len(block) > 0 {
+		n := len(block)
+		if n > http2MaxFrameSize {
+			n = http2MaxFrameSize
+		}
+		err = c.fr.WriteContinuation(c.headersStreamID, n == len(block), block[:n])
+		if err != nil {
+			return err
+		}
+		block = block[n:]
+	}
+	return nil
+}
+
+// Stably sort pseudo-header fields according to order, leaving other fields
+// after them in their original order.
+func orderPseudoHeaders(fields []hpack.HeaderField, order []string) {
+	rank := func(f hpack.HeaderField) int {
+		if !f.IsPseudo() {
+			return len(order) + 1
+		}
+		for i, name := range order {
+			if f.Name == name {
+				return i
+			}
+		}
+		return len(order)
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return rank(fields[i]) < rank(fields[j])
+	})
+}
+
+// Return the value of the last dynamic table size update at the beginning of
+// an HPACK header block, if there is one (RFC 7541 section 6.3).
+func hpackTableSizeUpdate(block []byte) (uint32, bool) {
+	var size uint64
+	found := false
+	for len(block) > 0 && block[0]&0xe0 == 0x20 {
+		// An integer with a 5-bit prefix (RFC 7541 section 5.1).
+		size = uint64(block[0] & 0x1f)
+		block = block[1:]
+		if size == 0x1f {
+			for m := uint(0); ; m += 7 {
+				if len(block) == 0 || m > 28 {
+					return 0, false
+				}
+				b := block[0]
+				block = block[1:]
+				size += uint64(b&0x7f) << m
+				if b&0x80 == 0 {
+					break
+				}
+			}
+		}
+		found = true
+	}
+	if size > 1<<32-1 {
+		return 0, false
+	}
+	return uint32(size), found
+}
+
+// The "http2" member of a spec file.
+type http2FingerprintJSON struct {
+	Settings []struct {
+		ID    http2SettingIDValue `json:"id"`
+		Value uint32              `json:"value"`
+	} `json:"settings"`
+	ConnectionWindowIncrement uint32 `json:"connection_window_increment,omitempty"`
+	PriorityFrames            []struct {
+		StreamID uint32 `json:"stream"`
+		http2PriorityJSON
+	} `json:"priority_frames,omitempty"`
+	HeadersPriority   *http2PriorityJSON `json:"headers_priority,omitempty"`
+	PseudoHeaderOrder []string           `json:"pseudo_header_order,omitempty"`
+}
+
+// Priority parameters as written in a spec file. Weight is the actual weight,
+// 1–256, not the weight−1 that goes in a frame.
+type http2PriorityJSON struct {
+	DependsOn uint32 `json:"depends_on"`
+	Weight    int    `json:"weight"`
+	Exclusive bool   `json:"exclusive,omitempty"`
+}
+
+func (p *http2PriorityJSON) param() (http2.PriorityParam, error) {
+	if p.Weight < 1 || p.Weight > 256 {
+		return http2.PriorityParam{}, fmt.Errorf("priority weight %d is not between 1 and 256", p.Weight)
+	}
+	if p.DependsOn >= 1<<31 {
+		return http2.PriorityParam{}, fmt.Errorf("bad priority stream dependency %d", p.DependsOn)
+	}
+	return http2.PriorityParam{
+		StreamDep: p.DependsOn,
+		Exclusive: p.Exclusive,
+		Weight:    uint8(p.Weight - 1),
+	}, nil
+}
+
+var http2SettingNames = map[string]uint16{
+	"HEADER_TABLE_SIZE":      uint16(http2.SettingHeaderTableSize),
+	"ENABLE_PUSH":            uint16(http2.SettingEnablePush),
+	"MAX_CONCURRENT_STREAMS": uint16(http2.SettingMaxConcurrentStreams),
+	"INITIAL_WINDOW_SIZE":    uint16(http2.SettingInitialWindowSize),
+	"MAX_FRAME_SIZE":         uint16(http2.SettingMaxFrameSize),
+	"MAX_HEADER_LIST_SIZE":   uint16(http2.SettingMaxHeaderListSize),
+}
+
+type http2SettingIDValue uint16
+
+func (v *http2SettingIDValue) UnmarshalJSON(data []byte) error {
+	x, err := unmarshalCodepoint(data, http2SettingNames)
+	*v = http2SettingIDValue(x)
+	return err
+}
+
+// Convert and check the "http2" member of a spec file.
+func (j *http2FingerprintJSON) fingerprint() (*http2Fingerprint, error) {
+	fp := &http2Fingerprint{
+		ConnectionFlow:    j.ConnectionWindowIncrement,
+		PseudoHeaderOrder: j.PseudoHeaderOrder,
+	}
+	for _, s := range j.Settings {
+		setting := http2.Setting{ID: http2.SettingID(s.ID), Val: s.Value}
+		err := setting.Valid()
+		if err != nil {
+			return nil, err
+		}
+		fp.Settings = append(fp.Settings, setting)
+	}
+	// The transport cannot handle server push, so disable it if the spec
+	// file does not say to.
+	hasPush := false
+	for _, s := range fp.Settings {
+		hasPush = hasPush || s.ID == http2.SettingEnablePush
+	}
+	if !hasPush {
+		fp.Settings = append(fp.Settings, http2.Setting{ID: http2.SettingEnablePush, Val: 0})
+	}
+	err := fp.checkSettings()
+	if err != nil {
+		return nil, err
+	}
+	if fp.ConnectionFlow >= 1<<31 {
+		return nil, fmt.Errorf("connection_window_increment %d is too large", fp.ConnectionFlow)
+	}
+	for _, pf := range j.PriorityFrames {
+		if pf.StreamID == 0 || pf.StreamID >= 1<<31 {
+			return nil, fmt.Errorf("bad priority frame stream %d", pf.StreamID)
+		}
+		param, err := pf.param()
+		if err != nil {
+			return nil, err
+		}
+		fp.PriorityFrames = append(fp.PriorityFrames, http2PriorityFrame{pf.StreamID, param})
+	}
+	if j.HeadersPriority != nil {
+		param, err := j.HeadersPriority.param()
+		if err != nil {
+			return nil, err
+		}
+		fp.HeadersPriority = &param
+	}
+	for _, name := range fp.PseudoHeaderOrder {
+		if !strings.HasPrefix(name, ":") {
+			return nil, fmt.Errorf("%q in pseudo_header_order is not a pseudo-header", name)
+		}
+	}
+	return fp, nil
+}
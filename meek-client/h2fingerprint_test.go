@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// Act as an HTTP/2 server on conn, checking that the client's frames match fp,
+// and answering numRequests requests. Returns the pseudo-header names of each
+// request, in order.
+func http2FingerprintServer(t *testing.T, conn net.Conn, fp *http2Fingerprint, numRequests int) [][]string {
+	defer conn.Close()
+
+	preface := make([]byte, len(http2.ClientPreface))
+	_, err := io.ReadFull(conn, preface)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	if string(preface) != http2.ClientPreface {
+		t.Errorf("bad preface %+q", preface)
+		return nil
+	}
+
+	fr := http2.NewFramer(conn, conn)
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	settings, ok := f.(*http2.SettingsFrame)
+	if !ok {
+		t.Errorf("expected SETTINGS, got %v", f)
+		return nil
+	}
+	if settings.NumSettings() != len(fp.Settings) {
+		t.Errorf("expected %d settings, got %d", len(fp.Settings), settings.NumSettings())
+	} else {
+		for i, s := range fp.Settings {
+			if settings.Setting(i) != s {
+				t.Errorf("setting %d: expected %v, got %v", i, s, settings.Setting(i))
+			}
+		}
+	}
+
+	if fp.ConnectionFlow != 0 {
+		f, err = fr.ReadFrame()
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		wu, ok := f.(*http2.WindowUpdateFrame)
+		if !ok || wu.StreamID != 0 || wu.Increment != fp.ConnectionFlow {
+			t.Errorf("expected WINDOW_UPDATE %d, got %v", fp.ConnectionFlow, f)
+		}
+	}
+
+	for _, pf := range fp.PriorityFrames {
+		f, err = fr.ReadFrame()
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		p, ok := f.(*http2.PriorityFrame)
+		if !ok || p.StreamID != pf.StreamID || p.PriorityParam != pf.PriorityParam {
+			t.Errorf("expected PRIORITY %+v, got %v", pf, f)
+		}
+	}
+
+	err = fr.WriteSettings()
+	if err == nil {
+		err = fr.WriteSettingsAck()
+	}
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	dec := hpack.NewDecoder(4096, nil)
+	var encBuf bytes.Buffer
+	enc := hpack.NewEncoder(&encBuf)
+	var result [][]string
+	for len(result) < numRequests {
+		f, err = fr.ReadFrame()
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame, *http2.WindowUpdateFrame:
+			continue
+		case *http2.HeadersFrame:
+			if !f.HeadersEnded() {
+				t.Errorf("unexpected CONTINUATION")
+				return nil
+			}
+			if fp.HeadersPriority != nil && (!f.HasPriority() || f.Priority != *fp.HeadersPriority) {
+				t.Errorf("expected HEADERS priority %+v, got %v %+v", *fp.HeadersPriority, f.HasPriority(), f.Priority)
+			}
+			fields, err := dec.DecodeFull(f.HeaderBlockFragment())
+			if err != nil {
+				t.Error(err)
+				return nil
+			}
+			var names []string
+			for _, field := range fields {
+				if field.IsPseudo() {
+					names = append(names, field.Name)
+				}
+			}
+			result = append(result, names)
+
+			encBuf.Reset()
+			enc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+			err = fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      f.StreamID,
+				BlockFragment: encBuf.Bytes(),
+				EndStream:     true,
+				EndHeaders:    true,
+			})
+			if err != nil {
+				t.Error(err)
+				return nil
+			}
+		default:
+			t.Errorf("unexpected frame %v", f)
+			return nil
+		}
+	}
+	return result
+}
+
+// Return the two ends of a loopback TCP connection.
+func tcpConnPair() (net.Conn, net.Conn, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ln.Close()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	serverConn, err := ln.Accept()
+	if err != nil {
+		clientConn.Close()
+		return nil, nil, err
+	}
+	return clientConn, serverConn, nil
+}
+
+func TestHTTP2FingerprintConn(t *testing.T) {
+	for _, name := range []string{"Chrome", "Firefox", "iOS"} {
+		fp := http2FingerprintMap[name]
+		// Not net.Pipe, which is unbuffered and would deadlock when
+		// client and server write at the same time.
+		clientConn, serverConn, err := tcpConnPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := &http2.Transport{
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return newHTTP2FingerprintConn(clientConn, fp), nil
+			},
+		}
+		fp.configureTransport(tr)
+
+		// Do more than one request, to check that the re-encoding of
+		// headers keeps the HPACK dynamic table consistent.
+		const numRequests = 3
+		ch := make(chan [][]string)
+		go func() {
+			ch <- http2FingerprintServer(t, serverConn, fp, numRequests)
+		}()
+		for i := 0; i < numRequests; i++ {
+			req, err := http.NewRequest("GET", "https://example.com/path", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Test", "test")
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		result := <-ch
+		tr.CloseIdleConnections()
+
+		if len(result) != numRequests {
+			t.Fatalf("%s: got %d requests, expected %d", name, len(result), numRequests)
+		}
+		for _, names := range result {
+			if len(names) != len(fp.PseudoHeaderOrder) {
+				t.Errorf("%s: pseudo-headers %q, expected %q", name, names, fp.PseudoHeaderOrder)
+				continue
+			}
+			for i := range names {
+				if names[i] != fp.PseudoHeaderOrder[i] {
+					t.Errorf("%s: pseudo-headers %q, expected %q", name, names, fp.PseudoHeaderOrder)
+					break
+				}
+			}
+		}
+	}
+}
+
+// The built-in profiles must advertise only settings that the transport
+// enforces.
+func TestHTTP2FingerprintMapSettings(t *testing.T) {
+	for name, fp := range http2FingerprintMap {
+		err := fp.checkSettings()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestHPACKTableSizeUpdate(t *testing.T) {
+	for _, test := range []struct {
+		input    []byte
+		expected uint32
+		ok       bool
+	}{
+		{[]byte{}, 0, false},
+		{[]byte{0x82}, 0, false},
+		{[]byte{0x20, 0x82}, 0, true},
+		{[]byte{0x3e, 0x82}, 30, true},
+		// 4096 = 31 + 4065; 4065 = 0x61 + 0x1f<<7
+		{[]byte{0x3f, 0xe1, 0x1f, 0x82}, 4096, true},
+		// Two updates; the last counts.
+		{[]byte{0x20, 0x3f, 0xe1, 0x1f}, 4096, true},
+		// Truncated integer.
+		{[]byte{0x3f, 0xe1}, 0, false},
+	} {
+		size, ok := hpackTableSizeUpdate(test.input)
+		if size != test.expected || ok != test.ok {
+			t.Errorf("%x → %v %v, expected %v %v", test.input, size, ok, test.expected, test.ok)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Racing connections to several addresses, in the style of Happy Eyeballs
+// (RFC 8305).
+//
+// When the front has more than one address, trying them one after another
+// means waiting for a full connect timeout on each one that is blocked.
+// Instead, we start a new attempt every happyEyeballsDelay (or as soon as an
+// attempt fails), without cancelling earlier attempts, and use whichever
+// connection is established first. The addresses are tried in an order that
+// alternates between IPv6 and IPv4, so that a broken address family does not
+// hold up the other one.
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// The delay between starting connection attempts, as recommended by RFC 8305
+// section 8.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// Reorder ips so that address families alternate, starting with the family of
+// the first address. Addresses within a family keep their relative order.
+func interleaveAddressFamilies(ips []net.IP) []net.IP {
+	if len(ips) == 0 {
+		return nil
+	}
+	var first, second []net.IP
+	firstIs4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIs4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	result := make([]net.IP, 0, len(ips))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			result = append(result, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			result = append(result, second[0])
+			second = second[1:]
+		}
+	}
+	return result
+}
+
+// Connect to one of addrs through forward, racing the attempts as described
+// above. Returns the first connection to be established, or the error of the
+// first attempt to fail if all of them fail.
+func dialHappyEyeballs(ctx context.Context, forward proxy.Dialer, network string, addrs []string) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+
+	// Cancelling ctx aborts the attempts that are still running once one
+	// has succeeded.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	// Buffered so that attempts never block on sending their result.
+	results := make(chan result, len(addrs))
+	next := 0
+	pending := 0
+	var delay <-chan time.Time
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dialContext(ctx, forward, network, addr)
+			results <- result{conn, err}
+		}()
+		if next < len(addrs) {
+			delay = time.After(happyEyeballsDelay)
+		} else {
+			delay = nil
+		}
+	}
+
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close any connections that the remaining
+				// attempts manage to make before they notice
+				// the cancellation.
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInterleaveAddressFamilies(t *testing.T) {
+	parse := func(ss ...string) []net.IP {
+		var ips []net.IP
+		for _, s := range ss {
+			ips = append(ips, net.ParseIP(s))
+		}
+		return ips
+	}
+	for _, test := range []struct {
+		input, expected []net.IP
+	}{
+		{nil, nil},
+		{parse("192.0.2.1"), parse("192.0.2.1")},
+		{parse("192.0.2.1", "192.0.2.2", "2001:db8::1"), parse("192.0.2.1", "2001:db8::1", "192.0.2.2")},
+		{parse("2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2", "192.0.2.3"),
+			parse("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3")},
+	} {
+		output := interleaveAddressFamilies(test.input)
+		if len(output) != len(test.expected) {
+			t.Errorf("%v → %v, expected %v", test.input, output, test.expected)
+			continue
+		}
+		for i := range output {
+			if !output[i].Equal(test.expected[i]) {
+				t.Errorf("%v → %v, expected %v", test.input, output, test.expected)
+				break
+			}
+		}
+	}
+}
+
+// A proxy.Dialer that connects every address to a fixed listener address,
+// except for those in hang, for which it waits until the context is done, and
+// those in fail, for which it fails immediately.
+type fakeDialer struct {
+	target string
+	hang   map[string]bool
+	fail   map[string]bool
+
+	lock  sync.Mutex
+	order []string
+}
+
+func (d *fakeDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.lock.Lock()
+	d.order = append(d.order, addr)
+	d.lock.Unlock()
+	if d.hang[addr] {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if d.fail[addr] {
+		return nil, errors.New("connection refused")
+	}
+	return net.Dial(network, d.target)
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	addrs := []string{"192.0.2.1:443", "[2001:db8::1]:443", "192.0.2.2:443"}
+
+	// A failed attempt starts the next one without waiting.
+	d := &fakeDialer{target: ln.Addr().String(), fail: map[string]bool{addrs[0]: true}}
+	begin := time.Now()
+	conn, err := dialHappyEyeballs(context.Background(), d, "tcp", addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(begin); elapsed >= happyEyeballsDelay {
+		t.Errorf("took %v after a failure", elapsed)
+	}
+	if len(d.order) != 2 || d.order[1] != addrs[1] {
+		t.Errorf("tried %q", d.order)
+	}
+
+	// A hanging attempt is raced by the next one after a delay.
+	d = &fakeDialer{target: ln.Addr().String(), hang: map[string]bool{addrs[0]: true}}
+	begin = time.Now()
+	conn, err = dialHappyEyeballs(context.Background(), d, "tcp", addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(begin); elapsed < happyEyeballsDelay {
+		t.Errorf("second attempt started after only %v", elapsed)
+	}
+
+	// All attempts fail.
+	d = &fakeDialer{target: ln.Addr().String(), fail: map[string]bool{addrs[0]: true, addrs[1]: true, addrs[2]: true}}
+	_, err = dialHappyEyeballs(context.Background(), d, "tcp", addrs)
+	if err == nil {
+		t.Errorf("no error when all attempts failed")
+	}
+	if len(d.order) != len(addrs) {
+		t.Errorf("tried %q", d.order)
+	}
+
+	// Cancellation stops all attempts.
+	d = &fakeDialer{target: ln.Addr().String(), hang: map[string]bool{addrs[0]: true, addrs[1]: true, addrs[2]: true}}
+	ctx, cancel := context.WithTimeout(context.Background(), happyEyeballsDelay/2)
+	defer cancel()
+	_, err = dialHappyEyeballs(ctx, d, "tcp", addrs)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -12,6 +13,8 @@ import (
 	"net/textproto"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,17 +22,21 @@ import (
 // the meek-http-helper browser extension.
 
 type JSONRequest struct {
-	Method string            `json:"method,omitempty"`
-	URL    string            `json:"url,omitempty"`
-	Header map[string]string `json:"header,omitempty"`
-	Body   []byte            `json:"body,omitempty"`
-	Proxy  *ProxySpec        `json:"proxy,omitempty"`
+	Method string      `json:"method,omitempty"`
+	URL    string      `json:"url,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+	Proxy  *ProxySpec  `json:"proxy,omitempty"`
+	// Secret is the helper's secret, which proves to the helper that the
+	// request comes from us and not some other local process.
+	Secret string `json:"secret,omitempty"`
 }
 
 type JSONResponse struct {
-	Error  string `json:"error,omitempty"`
-	Status int    `json:"status"`
-	Body   []byte `json:"body"`
+	Error  string      `json:"error,omitempty"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body"`
 }
 
 // ProxySpec encodes information we need to connect through a proxy.
@@ -41,11 +48,38 @@ type ProxySpec struct {
 	Port int    `json:"port"`
 }
 
+// HelperRoundTripper sends requests through the helper. It uses version 2 of
+// the helper protocol, which multiplexes all requests over one long-lived
+// connection (see helper_mux.go), if the helper supports it, and otherwise
+// version 1, which uses a new connection for each request.
 type HelperRoundTripper struct {
-	HelperAddr   *net.TCPAddr
+	// HelperAddr is a *net.TCPAddr or a *net.UnixAddr.
+	HelperAddr   net.Addr
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
-	proxySpec    *ProxySpec
+	// Secret is sent with every request, if not empty.
+	Secret    string
+	proxySpec *ProxySpec
+
+	// lock protects muxConn and v1Only.
+	lock    sync.Mutex
+	muxConn *helperMuxConn
+	// v1Only is set after the helper closes the connection on being
+	// asked for version 2.
+	v1Only bool
+}
+
+// Parse a --helper address, which is either a TCP host:port or "unix:" followed
+// by the path of a Unix domain socket.
+func resolveHelperAddr(s string) (net.Addr, error) {
+	if strings.HasPrefix(s, "unix:") {
+		path := s[len("unix:"):]
+		if path == "" {
+			return nil, fmt.Errorf("missing Unix socket path")
+		}
+		return net.ResolveUnixAddr("unix", path)
+	}
+	return net.ResolveTCPAddr("tcp", s)
 }
 
 func (rt *HelperRoundTripper) SetProxy(u *url.URL) error {
@@ -94,37 +128,29 @@ func makeProxySpec(u *url.URL) (*ProxySpec, error) {
 	return spec, nil
 }
 
+// RoundTrip honors the request's context: cancelling it abandons the request,
+// unblocking any read or write in progress.
 func (rt *HelperRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	s, err := net.DialTCP("tcp", nil, rt.HelperAddr)
-	if err != nil {
-		return nil, err
-	}
-	defer s.Close()
+	ctx := req.Context()
 
 	// Encode our JSON.
 	jsonReq := JSONRequest{
 		Method: req.Method,
 		URL:    req.URL.String(),
-		Header: make(map[string]string),
+		Header: make(http.Header),
 		Body:   make([]byte, 0),
 	}
-
-	// We take only the first value for each header key, due to limitations
-	// in the helper JSON protocol.
 	for key, values := range req.Header {
-		if len(values) == 0 {
-			continue
-		}
-		value := values[0]
 		key = textproto.CanonicalMIMEHeaderKey(key)
-		jsonReq.Header[key] = value
+		jsonReq.Header[key] = append(jsonReq.Header[key], values...)
 	}
 	// req.Host overrides req.Header.
 	if req.Host != "" {
-		jsonReq.Header["Host"] = req.Host
+		jsonReq.Header["Host"] = []string{req.Host}
 	}
 
 	if req.Body != nil {
+		var err error
 		jsonReq.Body, err = ioutil.ReadAll(req.Body)
 		if err != nil {
 			return nil, err
@@ -136,58 +162,133 @@ func (rt *HelperRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 	}
 
 	jsonReq.Proxy = rt.proxySpec
-	encReq, err := json.Marshal(&jsonReq)
+	jsonReq.Secret = rt.Secret
+
+	// Use the helper's shared connection if it has one, otherwise a
+	// connection of our own.
+	c, err := rt.getMuxConn(ctx)
 	if err != nil {
 		return nil, err
 	}
-	// log.Printf("encoded %s", encReq)
-
-	// Send the request.
-	s.SetWriteDeadline(time.Now().Add(rt.WriteTimeout))
-	err = binary.Write(s, binary.BigEndian, uint32(len(encReq)))
+	var jsonResp *JSONResponse
+	if c != nil {
+		jsonResp, err = c.roundTrip(ctx, &jsonReq, rt.ReadTimeout)
+	} else {
+		jsonResp, err = rt.roundTripV1(ctx, &jsonReq)
+	}
 	if err != nil {
 		return nil, err
 	}
-	_, err = s.Write(encReq)
+	if jsonResp.Error != "" {
+		return nil, fmt.Errorf("helper returned error: %s", jsonResp.Error)
+	}
+
+	// Mock up an HTTP response.
+	resp := http.Response{
+		Status:        http.StatusText(jsonResp.Status),
+		StatusCode:    jsonResp.Status,
+		Header:        makeHelperResponseHeader(jsonResp.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(jsonResp.Body)),
+		ContentLength: int64(len(jsonResp.Body)),
+		Request:       req,
+	}
+	return &resp, nil
+}
+
+// Do a roundtrip using version 1 of the helper protocol, with a new connection
+// for just this request. Cancelling ctx closes the connection.
+func (rt *HelperRoundTripper) roundTripV1(ctx context.Context, jsonReq *JSONRequest) (*JSONResponse, error) {
+	var dialer net.Dialer
+	s, err := dialer.DialContext(ctx, rt.HelperAddr.Network(), rt.HelperAddr.String())
 	if err != nil {
 		return nil, err
 	}
+	defer s.Close()
+
+	// Close the connection if the context is cancelled while we are still
+	// using it.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-done:
+		}
+	}()
+	// Prefer reporting cancellation over the I/O error it causes.
+	wrapErr := func(err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	// Send the request.
+	s.SetWriteDeadline(time.Now().Add(rt.WriteTimeout))
+	err = writeHelperMessage(s, jsonReq)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
 
 	// Read the response.
-	var length uint32
+	var jsonResp JSONResponse
 	s.SetReadDeadline(time.Now().Add(rt.ReadTimeout))
-	err = binary.Read(s, binary.BigEndian, &length)
+	err = readHelperMessage(s, &jsonResp)
 	if err != nil {
-		return nil, err
+		return nil, wrapErr(err)
 	}
-	if length > maxHelperResponseLength {
-		return nil, fmt.Errorf("helper's returned data is too big (%d > %d)",
-			length, maxHelperResponseLength)
+	return &jsonResp, nil
+}
 
+// Encode v as JSON and write it to w with a 4-byte big-endian length prefix.
+func writeHelperMessage(w io.Writer, v interface{}) error {
+	enc, err := json.Marshal(v)
+	if err != nil {
+		return err
 	}
-	encResp := make([]byte, length)
-	_, err = io.ReadFull(s, encResp)
+	// log.Printf("encoded %s", enc)
+	err = binary.Write(w, binary.BigEndian, uint32(len(enc)))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// log.Printf("received %s", encResp)
+	_, err = w.Write(enc)
+	return err
+}
 
-	// Decode their JSON.
-	var jsonResp JSONResponse
-	err = json.Unmarshal(encResp, &jsonResp)
+// Read a length-prefixed JSON message written by the helper and decode it
+// into v.
+func readHelperMessage(r io.Reader, v interface{}) error {
+	var length uint32
+	err := binary.Read(r, binary.BigEndian, &length)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if jsonResp.Error != "" {
-		return nil, fmt.Errorf("helper returned error: %s", jsonResp.Error)
+	if length > maxHelperResponseLength {
+		return fmt.Errorf("helper's returned data is too big (%d > %d)",
+			length, maxHelperResponseLength)
 	}
+	enc := make([]byte, length)
+	_, err = io.ReadFull(r, enc)
+	if err != nil {
+		return err
+	}
+	// log.Printf("received %s", enc)
+	return json.Unmarshal(enc, v)
+}
 
-	// Mock up an HTTP response.
-	resp := http.Response{
-		Status:        http.StatusText(jsonResp.Status),
-		StatusCode:    jsonResp.Status,
-		Body:          ioutil.NopCloser(bytes.NewReader(jsonResp.Body)),
-		ContentLength: int64(len(jsonResp.Body)),
+// Return an http.Header for a response from the helper, with canonical keys.
+// The browser has already removed any transfer and content encodings from the
+// body, so header fields that describe the encoded body are left out.
+func makeHelperResponseHeader(header http.Header) http.Header {
+	result := make(http.Header)
+	for key, values := range header {
+		key = textproto.CanonicalMIMEHeaderKey(key)
+		switch key {
+		case "Content-Encoding", "Content-Length", "Transfer-Encoding":
+			continue
+		}
+		result[key] = append(result[key], values...)
 	}
-	return &resp, nil
+	return result
 }
@@ -0,0 +1,261 @@
+package main
+
+// Version 2 of the helper protocol uses one long-lived connection for many
+// concurrent requests. meek-client begins the connection by sending
+// helperProtocolV2Magic, and the helper acknowledges by sending the same bytes
+// back. After that, each side sends length-prefixed JSON messages as in
+// version 1, but wrapped with an ID that matches responses to requests:
+//
+//	meek-client → helper: {"id": 1, "request": {...JSONRequest...}}
+//	meek-client → helper: {"id": 1, "cancel": true}
+//	helper → meek-client: {"id": 1, "response": {...JSONResponse...}}
+//
+// The helper sends no response for a cancelled request. A helper that only
+// knows version 1 reads the first 4 bytes of the magic as a length that is too
+// long, and closes the connection, which tells meek-client to fall back to
+// version 1. Any other failure to negotiate is an error for the request that
+// caused it, and the next request tries version 2 again.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// The first 4 bytes, read as a big-endian length, are much greater than any
+// request length a version 1 helper will accept.
+const helperProtocolV2Magic = "MEEK-HELPER/2\n"
+
+// errHelperNoV2 means that the helper closed or reset the connection after
+// getting the version 2 magic, as a version 1 helper does.
+var errHelperNoV2 = errors.New("helper closed the connection after the version 2 magic")
+
+type helperMuxRequest struct {
+	ID      uint64       `json:"id"`
+	Request *JSONRequest `json:"request,omitempty"`
+	Cancel  bool         `json:"cancel,omitempty"`
+}
+
+type helperMuxResponse struct {
+	ID       uint64        `json:"id"`
+	Response *JSONResponse `json:"response"`
+}
+
+// A connection to the helper using version 2 of the protocol.
+type helperMuxConn struct {
+	conn         net.Conn
+	writeTimeout time.Duration
+	// writeLock serializes writes to conn.
+	writeLock sync.Mutex
+
+	// lock protects the fields below.
+	lock   sync.Mutex
+	nextID uint64
+	// Channels on which readLoop delivers responses, indexed by ID.
+	pending map[uint64]chan<- *JSONResponse
+	// err is set when the connection is closed.
+	err error
+}
+
+// Return the helper's shared version 2 connection, connecting and negotiating
+// the protocol version if necessary. Returns nil and no error if the helper
+// supports only version 1.
+func (rt *HelperRoundTripper) getMuxConn(ctx context.Context) (*helperMuxConn, error) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	if rt.v1Only {
+		return nil, nil
+	}
+	if rt.muxConn != nil && !rt.muxConn.closed() {
+		return rt.muxConn, nil
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, rt.HelperAddr.Network(), rt.HelperAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	err = negotiateHelperV2(ctx, conn, rt.ReadTimeout, rt.WriteTimeout)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !errors.Is(err, errHelperNoV2) {
+			return nil, err
+		}
+		log.Printf("helper does not support protocol version 2, using version 1: %v", err)
+		rt.v1Only = true
+		return nil, nil
+	}
+	rt.muxConn = newHelperMuxConn(conn, rt.WriteTimeout)
+	return rt.muxConn, nil
+}
+
+// Send the version 2 magic on conn and wait for the helper to send it back.
+// Returns an error that wraps errHelperNoV2 if the helper closes or resets the
+// connection instead. Cancelling ctx closes conn.
+func negotiateHelperV2(ctx context.Context, conn net.Conn, readTimeout, writeTimeout time.Duration) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := io.WriteString(conn, helperProtocolV2Magic)
+	if err != nil {
+		return helperNegotiationError(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	reply := make([]byte, len(helperProtocolV2Magic))
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return helperNegotiationError(err)
+	}
+	if string(reply) != helperProtocolV2Magic {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	// From now on, the connection may be idle for any length of time
+	// between requests.
+	return conn.SetReadDeadline(time.Time{})
+}
+
+// Wrap err with errHelperNoV2 if it means that the helper closed or reset the
+// connection.
+func helperNegotiationError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || isConnReset(err) {
+		return fmt.Errorf("%w: %v", errHelperNoV2, err)
+	}
+	return err
+}
+
+func newHelperMuxConn(conn net.Conn, writeTimeout time.Duration) *helperMuxConn {
+	c := &helperMuxConn{
+		conn:         conn,
+		writeTimeout: writeTimeout,
+		pending:      make(map[uint64]chan<- *JSONResponse),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Read responses and deliver them to the roundTrip calls waiting for them,
+// until the connection is closed.
+func (c *helperMuxConn) readLoop() {
+	var err error
+	for {
+		var msg helperMuxResponse
+		err = readHelperMessage(c.conn, &msg)
+		if err != nil {
+			break
+		}
+		if msg.Response == nil {
+			err = fmt.Errorf("helper sent a message without a response")
+			break
+		}
+		c.lock.Lock()
+		ch, ok := c.pending[msg.ID]
+		delete(c.pending, msg.ID)
+		c.lock.Unlock()
+		// If !ok, the request was cancelled or timed out.
+		if ok {
+			ch <- msg.Response
+		}
+	}
+	c.close(err)
+}
+
+// Close the connection and fail all pending requests with err.
+func (c *helperMuxConn) close(err error) {
+	c.lock.Lock()
+	if c.err == nil {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("helper closed the connection")
+		}
+		c.err = err
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+	}
+	c.lock.Unlock()
+	c.conn.Close()
+}
+
+func (c *helperMuxConn) closed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err != nil
+}
+
+func (c *helperMuxConn) writeMessage(msg *helperMuxRequest) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	err := writeHelperMessage(c.conn, msg)
+	if err != nil {
+		// After a partial write, the connection is unusable.
+		c.close(err)
+	}
+	return err
+}
+
+// Send a request and wait for its response. If ctx is cancelled or no
+// response arrives within readTimeout, tell the helper to cancel the request.
+func (c *helperMuxConn) roundTrip(ctx context.Context, jsonReq *JSONRequest, readTimeout time.Duration) (*JSONResponse, error) {
+	// Buffered so that readLoop never blocks on a request that has
+	// stopped waiting.
+	ch := make(chan *JSONResponse, 1)
+	c.lock.Lock()
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return nil, err
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.lock.Unlock()
+
+	err := c.writeMessage(&helperMuxRequest{ID: id, Request: jsonReq})
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(readTimeout)
+	defer timeout.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			c.lock.Lock()
+			err = c.err
+			c.lock.Unlock()
+			return nil, err
+		}
+		return resp, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout.C:
+		err = fmt.Errorf("timed out waiting for the helper to respond")
+	}
+
+	c.lock.Lock()
+	_, ok := c.pending[id]
+	delete(c.pending, id)
+	c.lock.Unlock()
+	if ok {
+		// Errors are handled by writeMessage closing the connection.
+		c.writeMessage(&helperMuxRequest{ID: id, Cancel: true})
+	}
+	return nil, err
+}
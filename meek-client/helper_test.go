@@ -1,8 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMakeProxySpec(t *testing.T) {
@@ -61,3 +75,527 @@ func TestMakeProxySpec(t *testing.T) {
 		}
 	}
 }
+
+// Test that cancelling a request's context interrupts a HelperRoundTripper
+// that is waiting for the helper to respond.
+func TestHelperRoundTripperCancel(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// A helper that accepts connections but never responds. It closes the
+	// connections once the listener is closed.
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	rt := &HelperRoundTripper{
+		HelperAddr:   ln.Addr().(*net.TCPAddr),
+		ReadTimeout:  helperReadTimeout,
+		WriteTimeout: helperWriteTimeout,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://meek.example/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = rt.RoundTrip(req)
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if time.Since(start) > 1*time.Second {
+		t.Errorf("RoundTrip took too long to notice cancellation")
+	}
+}
+
+// A fake helper that answers each request by calling f. It speaks version 2
+// of the helper protocol if v2 is true, and otherwise only version 1.
+type fakeHelper struct {
+	ln net.Listener
+	v2 bool
+	f  func(*JSONRequest) *JSONResponse
+
+	lock    sync.Mutex
+	conns   int
+	cancels []uint64
+}
+
+func startFakeHelper(v2 bool, f func(*JSONRequest) *JSONResponse) (*fakeHelper, error) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	return serveFakeHelper(ln, v2, f), nil
+}
+
+func serveFakeHelper(ln net.Listener, v2 bool, f func(*JSONRequest) *JSONResponse) *fakeHelper {
+	h := &fakeHelper{ln: ln, v2: v2, f: f}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			h.lock.Lock()
+			h.conns++
+			h.lock.Unlock()
+			go h.handleConn(conn)
+		}
+	}()
+	return h
+}
+
+func (h *fakeHelper) Addr() net.Addr {
+	return h.ln.Addr()
+}
+
+func (h *fakeHelper) Close() error {
+	return h.ln.Close()
+}
+
+// Return the number of connections accepted and the IDs of cancelled
+// requests.
+func (h *fakeHelper) Stats() (int, []uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.conns, append([]uint64(nil), h.cancels...)
+}
+
+func (h *fakeHelper) handleConn(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	prefix, err := br.Peek(4)
+	if err != nil {
+		return
+	}
+	if h.v2 && string(prefix) == helperProtocolV2Magic[:4] {
+		magic := make([]byte, len(helperProtocolV2Magic))
+		_, err := io.ReadFull(br, magic)
+		if err != nil || string(magic) != helperProtocolV2Magic {
+			return
+		}
+		h.handleConnV2(conn, br)
+		return
+	}
+	// Like a version 1 helper, refuse a version 2 magic as too long.
+	var jsonReq JSONRequest
+	err = readHelperMessage(br, &jsonReq)
+	if err != nil {
+		return
+	}
+	writeHelperMessage(conn, h.f(&jsonReq))
+}
+
+func (h *fakeHelper) handleConnV2(conn net.Conn, r io.Reader) {
+	var writeLock sync.Mutex
+	_, err := io.WriteString(conn, helperProtocolV2Magic)
+	if err != nil {
+		return
+	}
+	for {
+		var msg helperMuxRequest
+		err := readHelperMessage(r, &msg)
+		if err != nil {
+			return
+		}
+		if msg.Cancel {
+			h.lock.Lock()
+			h.cancels = append(h.cancels, msg.ID)
+			h.lock.Unlock()
+			continue
+		}
+		go func() {
+			resp := h.f(msg.Request)
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			writeHelperMessage(conn, &helperMuxResponse{ID: msg.ID, Response: resp})
+		}()
+	}
+}
+
+// Test that HelperRoundTripper sends and receives multi-valued headers, and
+// sends its secret.
+func TestHelperRoundTripperHeader(t *testing.T) {
+	for _, v2 := range []bool{false, true} {
+		testHelperRoundTripperHeader(t, v2)
+	}
+}
+
+func testHelperRoundTripperHeader(t *testing.T, v2 bool) {
+	reqChan := make(chan *JSONRequest, 1)
+	h, err := startFakeHelper(v2, func(req *JSONRequest) *JSONResponse {
+		reqChan <- req
+		return &JSONResponse{
+			Status: http.StatusServiceUnavailable,
+			Header: http.Header{
+				"set-cookie":       {"a=1", "b=2"},
+				"Retry-After":      {"120"},
+				"Content-Encoding": {"gzip"},
+				"Content-Length":   {"1000"},
+			},
+			Body: []byte("body"),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	rt := &HelperRoundTripper{
+		HelperAddr:   h.Addr(),
+		ReadTimeout:  helperReadTimeout,
+		WriteTimeout: helperWriteTimeout,
+		Secret:       "0123456789abcdef",
+	}
+	req, err := http.NewRequest("POST", "https://front.example/", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "meek.example"
+	req.Header["x-session-id"] = []string{"abc"}
+	req.Header.Add("Accept-Encoding", "gzip")
+	req.Header.Add("Accept-Encoding", "br")
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	jsonReq := <-reqChan
+	expectedHeader := http.Header{
+		"Host":            {"meek.example"},
+		"X-Session-Id":    {"abc"},
+		"Accept-Encoding": {"gzip", "br"},
+	}
+	if !reflect.DeepEqual(jsonReq.Header, expectedHeader) {
+		t.Errorf("v2=%v: helper got header %v, expected %v", v2, jsonReq.Header, expectedHeader)
+	}
+	if string(jsonReq.Body) != "data" {
+		t.Errorf("v2=%v: helper got body %q", v2, jsonReq.Body)
+	}
+	if jsonReq.Secret != rt.Secret {
+		t.Errorf("v2=%v: helper got secret %q", v2, jsonReq.Secret)
+	}
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("v2=%v: got status %d", v2, resp.StatusCode)
+	}
+	// Header fields are canonicalized, and those that describe the
+	// encoding of the body are removed.
+	expectedHeader = http.Header{
+		"Set-Cookie":  {"a=1", "b=2"},
+		"Retry-After": {"120"},
+	}
+	if !reflect.DeepEqual(resp.Header, expectedHeader) {
+		t.Errorf("v2=%v: got response header %v, expected %v", v2, resp.Header, expectedHeader)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "body" || resp.ContentLength != 4 {
+		t.Errorf("v2=%v: got body %q, %d, %v", v2, body, resp.ContentLength, err)
+	}
+}
+
+// Do a POST through rt with the given body, and return the response body.
+func helperPost(rt http.RoundTripper, ctx context.Context, body string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://front.example/", strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	p, err := ioutil.ReadAll(resp.Body)
+	return string(p), err
+}
+
+// Test that concurrent requests share one connection to a version 2 helper,
+// even when the responses come back out of order, and that requests use
+// separate connections to a version 1 helper.
+func TestHelperRoundTripperMux(t *testing.T) {
+	for _, v2 := range []bool{false, true} {
+		// Each request waits until all have arrived, so the helper
+		// must have them all at once, and the responses come in
+		// random order.
+		const numRequests = 10
+		var wg sync.WaitGroup
+		wg.Add(numRequests)
+		h, err := startFakeHelper(v2, func(req *JSONRequest) *JSONResponse {
+			wg.Done()
+			wg.Wait()
+			return &JSONResponse{Status: http.StatusOK, Body: req.Body}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt := &HelperRoundTripper{
+			HelperAddr:   h.Addr(),
+			ReadTimeout:  helperReadTimeout,
+			WriteTimeout: helperWriteTimeout,
+		}
+
+		errs := make(chan error, numRequests)
+		for i := 0; i < numRequests; i++ {
+			go func(body string) {
+				result, err := helperPost(rt, context.Background(), body)
+				if err == nil && result != body {
+					err = fmt.Errorf("expected %q, got %q", body, result)
+				}
+				errs <- err
+			}(strconv.Itoa(i))
+		}
+		for i := 0; i < numRequests; i++ {
+			err := <-errs
+			if err != nil {
+				t.Errorf("v2=%v: %v", v2, err)
+			}
+		}
+
+		conns, _ := h.Stats()
+		// A version 1 helper also gets the attempt to negotiate
+		// version 2.
+		expected := numRequests + 1
+		if v2 {
+			expected = 1
+		}
+		if conns != expected {
+			t.Errorf("v2=%v: expected %d connections, got %d", v2, expected, conns)
+		}
+		h.Close()
+	}
+}
+
+// Test that cancelling a request over a version 2 connection tells the helper
+// to cancel it, and leaves the connection usable for other requests.
+func TestHelperRoundTripperMuxCancel(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	h, err := startFakeHelper(true, func(req *JSONRequest) *JSONResponse {
+		if string(req.Body) == "block" {
+			<-block
+		}
+		return &JSONResponse{Status: http.StatusOK, Body: req.Body}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	rt := &HelperRoundTripper{
+		HelperAddr:   h.Addr(),
+		ReadTimeout:  helperReadTimeout,
+		WriteTimeout: helperWriteTimeout,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = helperPost(rt, ctx, "block")
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	result, err := helperPost(rt, context.Background(), "after")
+	if err != nil || result != "after" {
+		t.Errorf("expected %q, got %q, %v", "after", result, err)
+	}
+
+	// A request that gets no response in time is also cancelled.
+	rt.ReadTimeout = 50 * time.Millisecond
+	_, err = helperPost(rt, context.Background(), "block")
+	if err == nil {
+		t.Errorf("expected timeout error")
+	}
+
+	conns, cancels := h.Stats()
+	if conns != 1 {
+		t.Errorf("expected 1 connection, got %d", conns)
+	}
+	// Cancel messages may still be on their way.
+	for i := 0; i < 100 && len(cancels) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, cancels = h.Stats()
+	}
+	if !reflect.DeepEqual(cancels, []uint64{0, 2}) {
+		t.Errorf("expected cancels of %v, got %v", []uint64{0, 2}, cancels)
+	}
+}
+
+// Test that pending requests fail when the helper closes a version 2
+// connection, and that the next request reconnects.
+func TestHelperRoundTripperMuxReconnect(t *testing.T) {
+	var conns []net.Conn
+	var lock sync.Mutex
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	h := &fakeHelper{ln: ln, v2: true, f: func(req *JSONRequest) *JSONResponse {
+		if string(req.Body) == "close" {
+			lock.Lock()
+			for _, conn := range conns {
+				conn.Close()
+			}
+			lock.Unlock()
+		}
+		return &JSONResponse{Status: http.StatusOK, Body: req.Body}
+	}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+			go h.handleConn(conn)
+		}
+	}()
+	rt := &HelperRoundTripper{
+		HelperAddr:   h.Addr(),
+		ReadTimeout:  helperReadTimeout,
+		WriteTimeout: helperWriteTimeout,
+	}
+
+	_, err = helperPost(rt, context.Background(), "close")
+	if err == nil {
+		t.Errorf("expected error after the helper closed the connection")
+	}
+	result, err := helperPost(rt, context.Background(), "after")
+	if err != nil || result != "after" {
+		t.Errorf("expected %q, got %q, %v", "after", result, err)
+	}
+	lock.Lock()
+	n := len(conns)
+	lock.Unlock()
+	if n != 2 {
+		t.Errorf("expected 2 connections, got %d", n)
+	}
+}
+
+// Test that a failure to negotiate version 2 other than the helper closing the
+// connection is an error, and does not make later requests use version 1.
+func TestHelperRoundTripperMuxNegotiationError(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	h := &fakeHelper{ln: ln, v2: true, f: func(req *JSONRequest) *JSONResponse {
+		return &JSONResponse{Status: http.StatusOK, Body: req.Body}
+	}}
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				// A reply of the right length, but not the
+				// magic.
+				go func() {
+					defer conn.Close()
+					io.ReadFull(conn, make([]byte, len(helperProtocolV2Magic)))
+					io.WriteString(conn, strings.Repeat("?", len(helperProtocolV2Magic)))
+				}()
+				continue
+			}
+			go h.handleConn(conn)
+		}
+	}()
+	rt := &HelperRoundTripper{
+		HelperAddr:   h.Addr(),
+		ReadTimeout:  helperReadTimeout,
+		WriteTimeout: helperWriteTimeout,
+	}
+
+	_, err = helperPost(rt, context.Background(), "first")
+	if err == nil {
+		t.Errorf("expected error from a bad version 2 reply")
+	}
+	result, err := helperPost(rt, context.Background(), "second")
+	if err != nil || result != "second" {
+		t.Errorf("expected %q, got %q, %v", "second", result, err)
+	}
+	rt.lock.Lock()
+	v1Only, muxConn := rt.v1Only, rt.muxConn
+	rt.lock.Unlock()
+	if v1Only || muxConn == nil {
+		t.Errorf("did not use version 2 after a negotiation error")
+	}
+}
+
+func TestResolveHelperAddr(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected net.Addr
+	}{
+		{"127.0.0.1:7000", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7000}},
+		{"unix:/run/meek/helper.sock", &net.UnixAddr{Net: "unix", Name: "/run/meek/helper.sock"}},
+		{"unix:helper.sock", &net.UnixAddr{Net: "unix", Name: "helper.sock"}},
+	} {
+		addr, err := resolveHelperAddr(test.input)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.input, err)
+		} else if addr.Network() != test.expected.Network() || addr.String() != test.expected.String() {
+			t.Errorf("%q: expected %v, got %v", test.input, test.expected, addr)
+		}
+	}
+	for _, input := range []string{
+		"127.0.0.1",
+		"unix:",
+	} {
+		_, err := resolveHelperAddr(input)
+		if err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+// Test a helper that listens on a Unix domain socket.
+func TestHelperRoundTripperUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meek-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, v2 := range []bool{false, true} {
+		addr, err := resolveHelperAddr("unix:" + filepath.Join(dir, fmt.Sprintf("helper-%v.sock", v2)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen(addr.Network(), addr.String())
+		if err != nil {
+			t.Skipf("cannot listen on a Unix socket: %v", err)
+		}
+		h := serveFakeHelper(ln, v2, func(req *JSONRequest) *JSONResponse {
+			return &JSONResponse{Status: http.StatusOK, Body: req.Body}
+		})
+		rt := &HelperRoundTripper{
+			HelperAddr:   addr,
+			ReadTimeout:  helperReadTimeout,
+			WriteTimeout: helperWriteTimeout,
+		}
+		result, err := helperPost(rt, context.Background(), "data")
+		if err != nil || result != "data" {
+			t.Errorf("v2=%v: expected %q, got %q, %v", v2, "data", result, err)
+		}
+		h.Close()
+	}
+}
@@ -29,6 +29,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"flag"
@@ -41,7 +42,11 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -59,6 +64,10 @@ const (
 	// port before forwarding it in a request, and the maximum size of a
 	// body we are willing to handle in a reply.
 	maxPayloadLength = 0x10000
+	// How many response bodies we are willing to hold in memory per
+	// session, waiting to be written to the SOCKS port. When this many are
+	// queued, we stop polling until the local reader catches up.
+	downstreamQueueLength = 16
 	// We must poll the server to see if it has anything to send; there is
 	// no way for the server to push data back to us until we send an HTTP
 	// request. When a timer expires, we send a request even if it has an
@@ -73,10 +82,21 @@ const (
 	maxTries = 10
 	// Wait this long between retries.
 	retryDelay = 30 * time.Second
+	// How long a shared uTLS RoundTripper stays alive after the last
+	// session using it ends. The same as http.DefaultTransport's
+	// IdleConnTimeout.
+	roundTripperPoolIdleTimeout = 90 * time.Second
 	// Safety limits on interaction with the HTTP helper.
 	maxHelperResponseLength = 10000000
 	helperReadTimeout       = 60 * time.Second
 	helperWriteTimeout      = 2 * time.Second
+	// The environment variable that holds the secret to send to the helper.
+	helperSecretEnvVar = "MEEK_HELPER_SECRET"
+	// After receiving a signal, wait at most this long for cancelled
+	// sessions to finish before exiting. This should be shorter than
+	// meek-client-torbrowser's terminateTimeout, so that we exit on our
+	// own before being killed.
+	drainTimeout = 1 * time.Second
 )
 
 // We use this RoundTripper to make all our requests when neither --helper nor
@@ -90,13 +110,37 @@ var helperRoundTripper = &HelperRoundTripper{
 	WriteTimeout: helperWriteTimeout,
 }
 
+// SOCKS connections with the same uTLS (or ECH, or front settings) configuration share
+// RoundTrippers (and therefore connections) from this pool.
+var utlsRoundTripperPool = newRoundTripperPool(roundTripperPoolIdleTimeout)
+
 // Store for command line options.
 var options struct {
-	URL       string
-	Front     string
-	ProxyURL  *url.URL
-	UseHelper bool
-	UTLSName  string
+	URL          string
+	Front        string
+	Proxies      proxyChain
+	PAC          *pacScript
+	UseHelper    bool
+	UTLSName     string
+	ECH          string
+	Pins         string
+	CAFile       string
+	FrontIPs     string
+	DoH          string
+	DoHBootstrap string
+	// Extra header fields for CONNECT requests to an HTTP or HTTPS proxy.
+	ProxyHeader   http.Header
+	CoalesceDelay time.Duration
+	CoalesceMin   int
+	// Timeouts for connections that we make ourselves (i.e., without
+	// --helper). The first three are applied to httpRoundTripper, from
+	// which the uTLS transports copy them, whether they speak HTTP/1.1 or
+	// HTTP/2. The H2 ones apply only to uTLS HTTP/2 connections.
+	IdleTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	H2ReadIdleTimeout     time.Duration
+	H2PingTimeout         time.Duration
 }
 
 // RequestInfo encapsulates all the configuration used for a request–response
@@ -113,11 +157,17 @@ type RequestInfo struct {
 	// The RoundTripper to use to send requests. This may vary depending on
 	// the value of global options like --helper.
 	RoundTripper http.RoundTripper
+	// After reading data from the SOCKS port, wait up to this long for
+	// more data before sending a request. Zero means send immediately.
+	CoalesceDelay time.Duration
+	// Stop waiting for more data once a request body has at least this
+	// many bytes. Zero means fill up to maxPayloadLength.
+	CoalesceMin int
 }
 
 // Make an http.Request from the payload data in buf and the request metadata in
-// info.
-func makeRequest(buf []byte, info *RequestInfo) (*http.Request, error) {
+// info. The request is bound to ctx, so cancelling ctx aborts the request.
+func makeRequest(ctx context.Context, buf []byte, info *RequestInfo) (*http.Request, error) {
 	var body io.Reader
 	if len(buf) > 0 {
 		// Leave body == nil when buf is empty. A nil body is an
@@ -131,12 +181,12 @@ func makeRequest(buf []byte, info *RequestInfo) (*http.Request, error) {
 		// https://bugs.torproject.org/22865.
 		body = bytes.NewReader(buf)
 	}
-	req, err := http.NewRequest("POST", info.URL.String(), body)
-	// Prevent Content-Type sniffing by net/http and middleboxes.
-	req.Header.Set("Content-Type", "application/octet-stream")
+	req, err := http.NewRequestWithContext(ctx, "POST", info.URL.String(), body)
 	if err != nil {
 		return nil, err
 	}
+	// Prevent Content-Type sniffing by net/http and middleboxes.
+	req.Header.Set("Content-Type", "application/octet-stream")
 	if info.Host != "" {
 		req.Host = info.Host
 	}
@@ -152,6 +202,8 @@ func makeRequest(buf []byte, info *RequestInfo) (*http.Request, error) {
 // which will cause the connection to die. The alternative, though, is to just
 // kill the connection immediately. A better solution would be a system of
 // acknowledgements so we know what to resend after an error.
+//
+// The wait between tries is cut short if the request's context is cancelled.
 func roundTripRetries(rt http.RoundTripper, req *http.Request, limit int) (*http.Response, error) {
 	var resp *http.Response
 	var err error
@@ -165,17 +217,89 @@ again:
 		err = fmt.Errorf("status code was %d, not %d", resp.StatusCode, http.StatusOK)
 		if limit > 0 {
 			log.Printf("%s; trying again after %.f seconds (%d)", err, retryDelay.Seconds(), limit)
-			time.Sleep(retryDelay)
+			resp.Body.Close()
+			select {
+			case <-time.After(retryDelay):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
 			goto again
 		}
 	}
 	return resp, err
 }
 
-// Send the data in buf to the remote URL, wait for a reply, and feed the reply
-// body back into conn.
-func sendRecv(buf []byte, conn net.Conn, info *RequestInfo) (int64, error) {
-	req, err := makeRequest(buf, info)
+// A downstreamWriter writes response bodies to the local connection in its own
+// goroutine, so that a slow local reader does not hold up sending and polling.
+// It holds at most downstreamQueueLength bodies; when the queue is full, Write
+// blocks, which is what pauses polling.
+type downstreamWriter struct {
+	ch        chan []byte
+	closeOnce sync.Once
+	// Closed when the writing goroutine exits. After that, err holds the
+	// reason, or nil if the queue was closed and fully flushed.
+	done chan struct{}
+	err  error
+}
+
+func newDownstreamWriter(conn net.Conn, queueLength int) *downstreamWriter {
+	w := &downstreamWriter{
+		ch:   make(chan []byte, queueLength),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		for p := range w.ch {
+			_, err := conn.Write(p)
+			if err != nil {
+				w.err = err
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// Queue p to be written to the local connection. Blocks while the queue is
+// full. Returns an error if a previous write failed or ctx is cancelled. The
+// caller must not modify p afterward.
+func (w *downstreamWriter) Write(ctx context.Context, p []byte) error {
+	select {
+	case w.ch <- p:
+		return nil
+	case <-w.done:
+		return w.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop accepting writes. The writing goroutine exits after writing whatever is
+// still queued, or at the first write error. Safe to call more than once.
+func (w *downstreamWriter) stop() {
+	w.closeOnce.Do(func() {
+		close(w.ch)
+	})
+}
+
+// Flush whatever is still queued and stop the writing goroutine. Gives up and
+// returns ctx.Err() if ctx is cancelled first.
+func (w *downstreamWriter) Close(ctx context.Context) error {
+	w.stop()
+	select {
+	case <-w.done:
+		return w.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send the data in buf to the remote URL, wait for a reply, and queue the reply
+// body to be written to the local connection by w. The body is queued in chunks
+// of at most maxPayloadLength bytes, however long it is. Returns the length of
+// the body.
+func sendRecv(ctx context.Context, buf []byte, w *downstreamWriter, info *RequestInfo) (int, error) {
+	req, err := makeRequest(ctx, buf, info)
 	if err != nil {
 		return 0, err
 	}
@@ -184,18 +308,114 @@ func sendRecv(buf []byte, conn net.Conn, info *RequestInfo) (int64, error) {
 		return 0, err
 	}
 	defer resp.Body.Close()
-	return io.Copy(conn, io.LimitReader(resp.Body, maxPayloadLength))
+	n := 0
+	for {
+		chunk, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPayloadLength))
+		if err != nil {
+			return n, err
+		}
+		if len(chunk) == 0 {
+			return n, nil
+		}
+		n += len(chunk)
+		err = w.Write(ctx, chunk)
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Counts of what was read from the SOCKS port and what was sent upstream, for
+// judging the effect of coalescing. Empty polls are not counted.
+type uploadStats struct {
+	reads        int
+	readBytes    int
+	requests     int
+	requestBytes int
+}
+
+func (stats *uploadStats) addRead(n int) {
+	if n > 0 {
+		stats.reads++
+		stats.readBytes += n
+	}
+}
+
+func (stats *uploadStats) addRequest(n int) {
+	if n > 0 {
+		stats.requests++
+		stats.requestBytes += n
+	}
+}
+
+func (stats *uploadStats) String() string {
+	average := func(total, count int) float64 {
+		if count == 0 {
+			return 0
+		}
+		return float64(total) / float64(count)
+	}
+	return fmt.Sprintf("%d reads averaging %.f bytes; %d requests averaging %.f bytes",
+		stats.reads, average(stats.readBytes, stats.reads),
+		stats.requests, average(stats.requestBytes, stats.requests))
+}
+
+// Append further chunks received on ch to buf, for at most delay, until buf
+// holds at least min bytes. buf never grows beyond maxPayloadLength; a chunk
+// that does not fit is returned as leftover, to start the next request. Also
+// stops early if ch is closed or ctx is cancelled.
+func coalesce(ctx context.Context, ch <-chan []byte, buf []byte, delay time.Duration, min int, stats *uploadStats) (coalesced, leftover []byte) {
+	if min <= 0 || min > maxPayloadLength {
+		min = maxPayloadLength
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for len(buf) < min {
+		select {
+		case b, ok := <-ch:
+			if !ok {
+				return buf, nil
+			}
+			stats.addRead(len(b))
+			if len(buf)+len(b) > maxPayloadLength {
+				return buf, b
+			}
+			buf = append(buf, b...)
+		case <-timer.C:
+			return buf, nil
+		case <-ctx.Done():
+			return buf, nil
+		}
+	}
+	return buf, nil
 }
 
 // Repeatedly read from conn, issue HTTP requests, and write the responses back
-// to conn.
-func copyLoop(conn net.Conn, info *RequestInfo) error {
+// to conn. If info.CoalesceDelay is set, data read from conn is held briefly
+// to be sent together with whatever follows it. Returns ctx.Err() if ctx is
+// cancelled before conn reaches EOF; any request in progress at that time is
+// aborted.
+//
+// The caller is responsible for closing conn after copyLoop returns, which is
+// what finally unblocks the goroutine reading from conn.
+func copyLoop(ctx context.Context, conn net.Conn, info *RequestInfo) error {
 	var interval time.Duration
 
+	// Cancelled when we return for any reason, so the reading goroutine
+	// does not block forever trying to send on ch.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Response bodies are written to conn through w. On error returns,
+	// stopping w lets its goroutine exit once the caller closes conn.
+	w := newDownstreamWriter(conn, downstreamQueueLength)
+	defer w.stop()
+
 	ch := make(chan []byte)
 
 	// Read from the Conn and send byte slices on the channel.
 	go func() {
+		defer close(ch)
 		var buf [maxPayloadLength]byte
 		r := bufio.NewReader(conn)
 		for {
@@ -203,17 +423,32 @@ func copyLoop(conn net.Conn, info *RequestInfo) error {
 			b := make([]byte, n)
 			copy(b, buf[:n])
 			// log.Printf("read from local: %q", b)
-			ch <- b
+			select {
+			case ch <- b:
+			case <-ctx.Done():
+				return
+			}
 			if err != nil {
-				if err != io.EOF {
+				if err != io.EOF && ctx.Err() == nil {
 					log.Printf("error reading from local: %s", err)
 				}
-				break
+				return
 			}
 		}
-		close(ch)
 	}()
 
+	// The stats are only interesting when coalescing.
+	var stats uploadStats
+	if info.CoalesceDelay > 0 {
+		defer func() {
+			log.Printf("session upload stats: %s", &stats)
+		}()
+	}
+
+	// A chunk that was read during coalescing but did not fit in the
+	// previous request.
+	var leftover []byte
+
 	interval = initPollInterval
 loop:
 	for {
@@ -222,19 +457,35 @@ loop:
 
 		// log.Printf("waiting up to %.2f s", interval.Seconds())
 		// start := time.Now()
-		select {
-		case buf, ok = <-ch:
-			if !ok {
-				break loop
+		if leftover != nil {
+			buf, leftover = leftover, nil
+		} else {
+			select {
+			case buf, ok = <-ch:
+				if !ok {
+					break loop
+				}
+				stats.addRead(len(buf))
+				// log.Printf("read %d bytes from local after %.2f s", len(buf), time.Since(start).Seconds())
+			case <-time.After(interval):
+				// log.Printf("read nothing from local after %.2f s", time.Since(start).Seconds())
+				buf = nil
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-			// log.Printf("read %d bytes from local after %.2f s", len(buf), time.Since(start).Seconds())
-		case <-time.After(interval):
-			// log.Printf("read nothing from local after %.2f s", time.Since(start).Seconds())
-			buf = nil
+		}
+		if len(buf) > 0 && info.CoalesceDelay > 0 {
+			buf, leftover = coalesce(ctx, ch, buf, info.CoalesceDelay, info.CoalesceMin, &stats)
 		}
 
-		nw, err := sendRecv(buf, conn, info)
+		stats.addRequest(len(buf))
+		nw, err := sendRecv(ctx, buf, w, info)
 		if err != nil {
+			// Report cancellation as such, rather than as whatever
+			// error the aborted request happened to produce.
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return err
 		}
 		/*
@@ -262,7 +513,9 @@ loop:
 		}
 	}
 
-	return nil
+	// The local side is done sending; write out whatever we have already
+	// received for it before returning.
+	return w.Close(ctx)
 }
 
 func genSessionID() string {
@@ -274,8 +527,8 @@ func genSessionID() string {
 	return strings.TrimRight(base64.StdEncoding.EncodeToString(buf), "=")
 }
 
-// Callback for new SOCKS requests.
-func handleSOCKS(conn *pt.SocksConn) error {
+// Callback for new SOCKS requests. Cancelling ctx closes the session.
+func handleSOCKS(ctx context.Context, conn *pt.SocksConn) error {
 	defer conn.Close()
 	err := conn.Grant(&net.TCPAddr{IP: net.IPv4zero, Port: 0})
 	if err != nil {
@@ -310,6 +563,30 @@ func handleSOCKS(conn *pt.SocksConn) error {
 		info.URL.Host = front
 	}
 
+	// First check coalesce-delay= SOCKS arg, then --coalesce-delay option.
+	info.CoalesceDelay = options.CoalesceDelay
+	if arg, ok := conn.Req.Args.Get("coalesce-delay"); ok {
+		info.CoalesceDelay, err = time.ParseDuration(arg)
+		if err != nil {
+			return fmt.Errorf("cannot parse coalesce-delay: %s", err)
+		}
+	}
+	if info.CoalesceDelay < 0 {
+		return fmt.Errorf("coalesce-delay must not be negative")
+	}
+
+	// First check coalesce-min= SOCKS arg, then --coalesce-min option.
+	info.CoalesceMin = options.CoalesceMin
+	if arg, ok := conn.Req.Args.Get("coalesce-min"); ok {
+		info.CoalesceMin, err = strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("cannot parse coalesce-min: %s", err)
+		}
+	}
+	if info.CoalesceMin < 0 || info.CoalesceMin > maxPayloadLength {
+		return fmt.Errorf("coalesce-min must be between 0 and %d", maxPayloadLength)
+	}
+
 	// First check utls= SOCKS arg, then --utls option.
 	utlsName, utlsOK := conn.Req.Args.Get("utls")
 	if utlsOK {
@@ -318,63 +595,185 @@ func handleSOCKS(conn *pt.SocksConn) error {
 		utlsOK = true
 	}
 
+	// First check ech= SOCKS arg, then --ech option.
+	echArg, echOK := conn.Req.Args.Get("ech")
+	if echOK {
+	} else if options.ECH != "" {
+		echArg = options.ECH
+		echOK = true
+	}
+
+	// ca-file=, pin=, front-ip=, and doh= SOCKS args, or their options.
+	settings, err := getFrontSettings(conn.Req.Args)
+	if err != nil {
+		return err
+	}
+
+	// The proxies for this session, from a PAC file or the proxy options.
+	proxies, err := proxiesForURL(info.URL, settings.Resolver)
+	if err != nil {
+		return err
+	}
+	// The proxy part of RoundTripper pool keys.
+	proxyKey := proxies.key()
+
 	// First we check --helper: if it was specified, then we always use the
-	// helper, and utls is disallowed. Otherwise, we use utls if requested;
-	// or else fall back to native net/http.
+	// helper, and utls, ech, and the front settings are disallowed.
+	// Otherwise, we use ech or utls if requested; or else fall back to
+	// native net/http.
 	if options.UseHelper {
 		if utlsOK {
 			return fmt.Errorf("cannot use utls with --helper")
 		}
+		if echOK {
+			return fmt.Errorf("cannot use ech with --helper")
+		}
+		if !settings.isDefault() {
+			return fmt.Errorf("cannot use %s with --helper", strings.Join(settings.names, " or "))
+		}
 		info.RoundTripper = helperRoundTripper
+	} else if echOK {
+		// ECH uses uTLS if utls is given, and native TLS otherwise.
+		echConfigList, err := loadECHConfigList(echArg)
+		if err != nil {
+			return err
+		}
+		if utlsOK {
+			chosen, err := chooseUTLSName(utlsName)
+			if err != nil {
+				return err
+			}
+			if chosen != utlsName {
+				log.Printf("using uTLS fingerprint %q", chosen)
+				utlsName = chosen
+			}
+		}
+		key := roundTripperPoolKey{
+			Front:    info.URL.Host,
+			UTLSName: canonicalUTLSName(utlsName),
+			ECH:      string(echConfigList),
+			Settings: settings.key,
+			Proxy:    proxyKey,
+		}
+		info.RoundTripper, err = utlsRoundTripperPool.Get(key, func() (http.RoundTripper, error) {
+			rt, err := newECHRoundTripper(echConfigList, utlsName, proxies, settings)
+			if err != nil {
+				return nil, err
+			}
+			return rt, nil
+		})
+		if err != nil {
+			return err
+		}
+		defer utlsRoundTripperPool.Put(key)
 	} else if utlsOK {
-		info.RoundTripper, err = NewUTLSRoundTripper(utlsName, nil, options.ProxyURL)
+		// With a rotation list, the fingerprint is chosen once per
+		// session and used for all the session's requests.
+		chosen, err := chooseUTLSName(utlsName)
+		if err != nil {
+			return err
+		}
+		if chosen != utlsName {
+			log.Printf("using uTLS fingerprint %q", chosen)
+			utlsName = chosen
+		}
+		key := roundTripperPoolKey{
+			Front:    info.URL.Host,
+			UTLSName: canonicalUTLSName(utlsName),
+			Settings: settings.key,
+			Proxy:    proxyKey,
+		}
+		info.RoundTripper, err = utlsRoundTripperPool.Get(key, func() (http.RoundTripper, error) {
+			return NewUTLSRoundTripper(utlsName, nil, proxies, settings)
+		})
+		if err != nil {
+			return err
+		}
+		defer utlsRoundTripperPool.Put(key)
+	} else if !settings.isDefault() || options.PAC != nil {
+		// httpRoundTripper has the proxy options' proxies, not the
+		// ones the PAC file chose.
+		key := roundTripperPoolKey{
+			Front:    info.URL.Host,
+			Settings: settings.key,
+			Proxy:    proxyKey,
+		}
+		info.RoundTripper, err = utlsRoundTripperPool.Get(key, func() (http.RoundTripper, error) {
+			return newNativeRoundTripper(proxies, settings)
+		})
 		if err != nil {
 			return err
 		}
+		defer utlsRoundTripperPool.Put(key)
 	} else {
 		info.RoundTripper = httpRoundTripper
 	}
 
-	return copyLoop(conn, &info)
+	return copyLoop(ctx, conn, &info)
 }
 
-func acceptSOCKS(ln *pt.SocksListener) error {
+// Accept SOCKS connections and dispatch them to handleSOCKS, passing along ctx.
+// Each handleSOCKS goroutine is tracked in wg, so that the caller can wait for
+// sessions to finish after cancelling ctx. The caller must have counted this
+// call in wg already, and acceptSOCKS calls wg.Done when it returns; that way,
+// wg's counter is never zero when a session is added to it, as WaitGroup
+// requires when Wait may be running at the same time.
+func acceptSOCKS(ctx context.Context, ln *pt.SocksListener, wg *sync.WaitGroup) error {
+	defer wg.Done()
 	defer ln.Close()
 	for {
 		conn, err := ln.AcceptSocks()
 		if err != nil {
+			if ctx.Err() != nil {
+				// The listener was closed because we are
+				// shutting down.
+				return nil
+			}
 			log.Printf("error in AcceptSocks: %s", err)
 			if e, ok := err.(net.Error); ok && e.Temporary() {
 				continue
 			}
 			return err
 		}
+		if ctx.Err() != nil {
+			// Don't start a session after shutdown has begun.
+			conn.Close()
+			return nil
+		}
+		wg.Add(1)
 		go func() {
-			err := handleSOCKS(conn)
-			if err != nil {
+			defer wg.Done()
+			err := handleSOCKS(ctx, conn)
+			if err != nil && err != context.Canceled {
 				log.Printf("error in handling request: %s", err)
 			}
 		}()
 	}
-	return nil
 }
 
 // Return an error if this proxy URL doesn't work with the rest of the
 // configuration.
 func checkProxyURL(u *url.URL) error {
 	if !options.UseHelper {
-		// Without the helper, we use net/http's built-in proxy support,
-		// which allows "http", "https", and "socks5".
+		// Without the helper, we use net/http's built-in proxy support
+		// for "http", "https", and "socks5", and our own dialers for
+		// "socks5h" and "socks4a" (see makeNativeProxyDialer). uTLS
+		// uses our own dialers for all of them (see makeProxyDialer).
 		// socks5 requires go1.9: https://golang.org/doc/go1.9#net/http
 		// https requires go1.10: https://golang.org/doc/go1.10#net/http
 		// If using an older version of Go, the proxy won't be bypassed;
 		// you'll just get an error at connection time rather than
 		// TOR_PT_PROXY time.
 		switch u.Scheme {
-		case "http", "https", "socks5":
+		case "http", "https", "socks5", "socks5h", "socks4a":
 		default:
 			return fmt.Errorf("don't understand proxy URL scheme %q", u.Scheme)
 		}
+		if u.Scheme == "socks4a" {
+			if _, ok := u.User.Password(); ok {
+				return fmt.Errorf("a socks4a proxy URL can't have a password")
+			}
+		}
 	} else {
 		// With the helper we can use HTTP and SOCKS (because it is the
 		// browser that does the proxying, not us).
@@ -399,16 +798,61 @@ func checkProxyURL(u *url.URL) error {
 	return nil
 }
 
+// A flag.Value for a repeatable "Name: value" header field option.
+type headerFlag http.Header
+
+func (f headerFlag) String() string {
+	var fields []string
+	for key, values := range f {
+		for _, value := range values {
+			fields = append(fields, key+": "+value)
+		}
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ", ")
+}
+
+func (f headerFlag) Set(s string) error {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return fmt.Errorf("header field %q is not in \"Name: value\" form", s)
+	}
+	key := strings.TrimSpace(s[:i])
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return fmt.Errorf("bad header field name %q", key)
+	}
+	http.Header(f).Add(key, strings.TrimSpace(s[i+1:]))
+	return nil
+}
+
 func main() {
 	var helperAddr string
 	var logFilename string
-	var proxy string
+	var pacLocation string
+	var persistTLSSessions bool
 	var err error
 
+	flag.StringVar(&options.CAFile, "ca-file", "", "file of PEM CA certificates to trust instead of the system roots, if no ca-file= SOCKS arg")
+	flag.DurationVar(&options.CoalesceDelay, "coalesce-delay", 0, "how long to wait for more upstream data before sending, if no coalesce-delay= SOCKS arg")
+	flag.IntVar(&options.CoalesceMin, "coalesce-min", 0, "send without waiting once this many bytes are ready, if no coalesce-min= SOCKS arg")
+	flag.StringVar(&options.DoH, "doh", "", "DNS over HTTPS URL for looking up the front, if no doh= SOCKS arg")
+	flag.StringVar(&options.DoHBootstrap, "doh-bootstrap", "", "IP address of the --doh server")
+	flag.StringVar(&options.ECH, "ech", "", "ECH config list if no ech= SOCKS arg")
 	flag.StringVar(&options.Front, "front", "", "front domain name if no front= SOCKS arg")
-	flag.StringVar(&helperAddr, "helper", "", "address of HTTP helper (browser extension)")
+	flag.StringVar(&options.FrontIPs, "front-ip", "", "comma-separated IP addresses of the front, if no front-ip= SOCKS arg")
+	flag.DurationVar(&options.H2PingTimeout, "h2-ping-timeout", 5*time.Second, "close an HTTP/2 connection if a health check PING is not answered within this long")
+	flag.DurationVar(&options.H2ReadIdleTimeout, "h2-read-idle-timeout", 10*time.Second, "send a health check PING after receiving nothing on an HTTP/2 connection for this long (0 to disable)")
+	flag.StringVar(&helperAddr, "helper", "", "address of HTTP helper (browser extension), host:port or unix:/path")
+	flag.DurationVar(&options.IdleTimeout, "idle-timeout", httpRoundTripper.IdleConnTimeout, "close connections that have been idle for this long (0 for no limit)")
 	flag.StringVar(&logFilename, "log", "", "name of log file")
-	flag.StringVar(&proxy, "proxy", "", "proxy URL")
+	flag.StringVar(&pacLocation, "pac", "", "PAC file name or URL, or \"wpad\", for choosing a proxy for each session")
+	flag.BoolVar(&persistTLSSessions, "persist-tls-sessions", false, "save uTLS session tickets in the state directory")
+	flag.StringVar(&options.Pins, "pin", "", "comma-separated SPKI SHA-256 pins if no pin= SOCKS arg")
+	flag.Var(&options.Proxies, "proxy", "proxy URL (may be repeated to make a chain of proxies, the first being the nearest)")
+	options.ProxyHeader = make(http.Header)
+	flag.Var(headerFlag(options.ProxyHeader), "proxy-header", "extra \"Name: value\" header field for proxy CONNECT requests (may be repeated)")
+	flag.DurationVar(&options.ResponseHeaderTimeout, "response-header-timeout", httpRoundTripper.ResponseHeaderTimeout, "abort a request if the response headers do not arrive within this long (0 for no limit)")
+	flag.DurationVar(&options.TLSHandshakeTimeout, "tls-handshake-timeout", httpRoundTripper.TLSHandshakeTimeout, "abort a TLS handshake that takes longer than this (0 for no limit)")
 	flag.StringVar(&options.URL, "url", "", "URL to request if no url= SOCKS arg")
 	flag.StringVar(&options.UTLSName, "utls", "", "uTLS Client Hello ID")
 	flag.Parse()
@@ -433,40 +877,71 @@ func main() {
 
 	if helperAddr != "" {
 		options.UseHelper = true
-		helperRoundTripper.HelperAddr, err = net.ResolveTCPAddr("tcp", helperAddr)
+		helperRoundTripper.HelperAddr, err = resolveHelperAddr(helperAddr)
 		if err != nil {
 			log.Fatalf("can't resolve helper address: %s", err)
 		}
 		log.Printf("using helper on %s", helperRoundTripper.HelperAddr)
-	}
-
-	if proxy != "" {
-		options.ProxyURL, err = url.Parse(proxy)
-		if err != nil {
-			log.Fatalf("can't parse proxy URL: %s", err)
+		// The secret comes from the environment and not the command
+		// line, where other local users could see it.
+		helperRoundTripper.Secret = os.Getenv(helperSecretEnvVar)
+		if helperRoundTripper.Secret == "" {
+			log.Printf("no helper secret in %s; the helper may refuse requests", helperSecretEnvVar)
 		}
 	}
 
+	httpRoundTripper.IdleConnTimeout = options.IdleTimeout
+	httpRoundTripper.TLSHandshakeTimeout = options.TLSHandshakeTimeout
+	httpRoundTripper.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+
+	// With a PAC file, proxies are chosen for each session, but they get
+	// the same header fields.
+	httpRoundTripper.ProxyConnectHeader = options.ProxyHeader
+
 	// Disable the default ProxyFromEnvironment setting.
-	// httpRoundTripper.Proxy is overridden below if options.ProxyURL is
+	// httpRoundTripper.Proxy is overridden below if options.Proxies is
 	// set.
 	httpRoundTripper.Proxy = nil
 
-	// Command-line proxy overrides managed configuration.
-	if options.ProxyURL == nil {
-		options.ProxyURL = ptInfo.ProxyURL
+	if pacLocation != "" && len(options.Proxies) > 0 {
+		log.Fatal("cannot use --pac with --proxy")
+	}
+	// Command-line proxy overrides managed configuration. A PAC file
+	// cannot: tor expects its proxy to be used for every connection, and
+	// must be told with PROXY-ERROR if it will not be.
+	if len(options.Proxies) == 0 && ptInfo.ProxyURL != nil {
+		if pacLocation != "" {
+			err = fmt.Errorf("cannot use --pac with a proxy configured in tor")
+			pt.ProxyError(err.Error())
+			log.Fatal(fmt.Sprintf("proxy error: %s", err))
+		}
+		options.Proxies = proxyChain{ptInfo.ProxyURL}
 	}
 	// Check whether we support this kind of proxy.
-	if options.ProxyURL != nil {
-		err = checkProxyURL(options.ProxyURL)
+	if len(options.Proxies) > 0 {
+		for _, proxyURL := range options.Proxies {
+			err = checkProxyURL(proxyURL)
+			if err != nil {
+				pt.ProxyError(err.Error())
+				log.Fatal(fmt.Sprintf("proxy error: %s", err))
+			}
+		}
+		if options.UseHelper && len(options.Proxies) > 1 {
+			err = fmt.Errorf("a chain of proxies can't be used with --helper")
+			pt.ProxyError(err.Error())
+			log.Fatal(fmt.Sprintf("proxy error: %s", err))
+		}
+		log.Printf("using proxy %s", options.Proxies.String())
+		err = setTransportProxy(httpRoundTripper, options.Proxies)
 		if err != nil {
 			pt.ProxyError(err.Error())
 			log.Fatal(fmt.Sprintf("proxy error: %s", err))
 		}
-		log.Printf("using proxy %s", options.ProxyURL.String())
-		httpRoundTripper.Proxy = http.ProxyURL(options.ProxyURL)
+		if options.UseHelper && len(options.ProxyHeader) > 0 {
+			log.Fatal("cannot use --proxy-header with --helper")
+		}
 		if options.UseHelper {
-			err = helperRoundTripper.SetProxy(options.ProxyURL)
+			err = helperRoundTripper.SetProxy(options.Proxies[0])
 			if err != nil {
 				pt.ProxyError(err.Error())
 				log.Fatal(fmt.Sprintf("proxy error: %s", err))
@@ -477,6 +952,91 @@ func main() {
 		}
 	}
 
+	if pacLocation != "" {
+		if options.UseHelper {
+			log.Fatal("cannot use --pac with --helper")
+		}
+		options.PAC, err = loadPACScript(pacLocation)
+		if err != nil {
+			pt.CmethodError(ptMethodName, fmt.Sprintf("pac error: %s", err))
+			log.Fatalf("pac error: %s", err)
+		}
+		log.Printf("using PAC file %s", options.PAC.location)
+	}
+
+	// Check the --utls option now, so that a bad name or an invalid spec
+	// file is reported at startup rather than on the first connection.
+	// utls= SOCKS args are checked when they are first used.
+	if options.UTLSName != "" {
+		err = checkUTLSName(options.UTLSName)
+		if err != nil {
+			pt.CmethodError(ptMethodName, fmt.Sprintf("utls error: %s", err))
+			log.Fatalf("utls error: %s", err)
+		}
+	}
+
+	if options.ECH != "" {
+		_, err = loadECHConfigList(options.ECH)
+		if err != nil {
+			pt.CmethodError(ptMethodName, fmt.Sprintf("ech error: %s", err))
+			log.Fatalf("ech error: %s", err)
+		}
+	}
+
+	if options.CAFile != "" {
+		_, err = loadCAFile(options.CAFile)
+		if err != nil {
+			pt.CmethodError(ptMethodName, fmt.Sprintf("ca-file error: %s", err))
+			log.Fatalf("ca-file error: %s", err)
+		}
+	}
+
+	if persistTLSSessions {
+		// Failure to load or save sessions is not fatal; it only
+		// means full handshakes.
+		stateDir, err := pt.MakeStateDir()
+		if err == nil {
+			err = utlsSessionCache.persist(filepath.Join(stateDir, sessionCacheFilename))
+		}
+		if err != nil {
+			log.Printf("error loading saved TLS sessions: %s", err)
+		}
+	}
+
+	if options.FrontIPs != "" {
+		_, err = parseFrontIPs(options.FrontIPs)
+		if err != nil {
+			pt.CmethodError(ptMethodName, fmt.Sprintf("front-ip error: %s", err))
+			log.Fatalf("front-ip error: %s", err)
+		}
+	}
+
+	if options.DoH != "" {
+		var proxies proxyChain
+		proxies, err = dohProxies(options.DoH)
+		if err == nil {
+			_, err = getDoHResolver(options.DoH, options.DoHBootstrap, proxies)
+		}
+		if err != nil {
+			pt.CmethodError(ptMethodName, fmt.Sprintf("doh error: %s", err))
+			log.Fatalf("doh error: %s", err)
+		}
+	}
+
+	if options.Pins != "" {
+		_, err = parsePins(options.Pins)
+		if err != nil {
+			pt.CmethodError(ptMethodName, fmt.Sprintf("pin error: %s", err))
+			log.Fatalf("pin error: %s", err)
+		}
+	}
+
+	// Cancelled when it is time to shut down; all sessions derive from it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Tracks running sessions.
+	var wg sync.WaitGroup
+
 	listeners := make([]net.Listener, 0)
 	for _, methodName := range ptInfo.MethodNames {
 		switch methodName {
@@ -486,7 +1046,8 @@ func main() {
 				pt.CmethodError(methodName, err.Error())
 				break
 			}
-			go acceptSOCKS(ln)
+			wg.Add(1)
+			go acceptSOCKS(ctx, ln, &wg)
 			pt.Cmethod(methodName, ln.Version(), ln.Addr())
 			log.Printf("listening on %s", ln.Addr())
 			listeners = append(listeners, ln)
@@ -513,9 +1074,27 @@ func main() {
 	sig := <-sigChan
 	log.Printf("got signal %s", sig)
 
+	// Stop accepting new sessions, then cancel the existing ones, aborting
+	// any outstanding requests. Give the sessions a bounded amount of time
+	// to close their connections and exit.
+	cancel()
 	for _, ln := range listeners {
 		ln.Close()
 	}
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		log.Printf("sessions did not finish within %.f seconds", drainTimeout.Seconds())
+	}
+	err = utlsSessionCache.flush()
+	if err != nil {
+		log.Printf("error saving TLS sessions: %v", err)
+	}
 
 	log.Printf("done")
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+// A RoundTripper that never returns a response, only waiting for the request to
+// be cancelled.
+type blockingRoundTripper struct{}
+
+func (rt blockingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+// Test that cancelling the context passed to copyLoop aborts an outstanding
+// request and makes copyLoop return.
+func TestCopyLoopCancel(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	info := &RequestInfo{
+		SessionID:    genSessionID(),
+		URL:          &url.URL{Scheme: "http", Host: "meek.example"},
+		RoundTripper: blockingRoundTripper{},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- copyLoop(ctx, local, info)
+	}()
+
+	// Give copyLoop something to send, so that it is blocked in a
+	// RoundTrip when we cancel.
+	_, err := remote.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Errorf("expected %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("copyLoop did not return after cancellation")
+	}
+}
+
+// Test that acceptSOCKS releases its count in the WaitGroup once shutdown
+// begins, so that waiting for sessions to finish does not hang.
+func TestAcceptSOCKSShutdown(t *testing.T) {
+	ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go acceptSOCKS(ctx, ln, &wg)
+
+	cancel()
+	ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("acceptSOCKS did not finish after shutdown")
+	}
+}
+
+// A net.Conn whose Write blocks until unblock is closed.
+type slowConn struct {
+	net.Conn
+	unblock chan struct{}
+}
+
+func (c *slowConn) Write(p []byte) (int, error) {
+	<-c.unblock
+	return len(p), nil
+}
+
+// Test that downstreamWriter accepts writes without waiting for the local
+// connection until its queue is full, and then applies backpressure.
+func TestDownstreamWriterBackpressure(t *testing.T) {
+	const queueLength = 4
+	conn := &slowConn{unblock: make(chan struct{})}
+	w := newDownstreamWriter(conn, queueLength)
+
+	// The writing goroutine takes one item off the queue and blocks in
+	// Write, so one more than queueLength fits before blocking.
+	for i := 0; i < queueLength+1; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		err := w.Write(ctx, []byte("data"))
+		cancel()
+		if err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	// Now the queue is full, and Write must block until the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err := w.Write(ctx, []byte("data"))
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v with a full queue, got %v", context.DeadlineExceeded, err)
+	}
+
+	// Once the connection unblocks, everything should flush.
+	close(conn.unblock)
+	ctx, cancel = context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	err = w.Close(ctx)
+	if err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+// Test that sendRecv passes on the whole of a response body longer than
+// maxPayloadLength.
+func TestSendRecvLongBody(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 3*maxPayloadLength/10+7)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &RequestInfo{
+		SessionID:    genSessionID(),
+		URL:          u,
+		RoundTripper: http.DefaultTransport,
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	received := make(chan []byte)
+	go func() {
+		p, _ := ioutil.ReadAll(remote)
+		received <- p
+	}()
+
+	w := newDownstreamWriter(local, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := sendRecv(ctx, []byte("hello"), w, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(body) {
+		t.Errorf("sendRecv returned %d, expected %d", n, len(body))
+	}
+	err = w.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Close()
+	if p := <-received; !bytes.Equal(p, body) {
+		t.Errorf("received %d bytes, expected %d", len(p), len(body))
+	}
+}
+
+// Test that coalesce combines chunks up to the minimum, holds back a chunk that
+// would overflow maxPayloadLength, and gives up after the delay.
+func TestCoalesce(t *testing.T) {
+	ctx := context.Background()
+	const delay = 50 * time.Millisecond
+
+	// Enough queued chunks to reach min.
+	ch := make(chan []byte, 10)
+	for i := 0; i < 4; i++ {
+		ch <- []byte("abcd")
+	}
+	var stats uploadStats
+	buf, leftover := coalesce(ctx, ch, []byte("abcd"), delay, 12, &stats)
+	if string(buf) != "abcdabcdabcd" || leftover != nil {
+		t.Errorf("min: got (%q, %q)", buf, leftover)
+	}
+	if stats.reads != 2 {
+		t.Errorf("min: expected 2 reads counted, got %d", stats.reads)
+	}
+
+	// A chunk that doesn't fit is returned as leftover.
+	ch = make(chan []byte, 10)
+	ch <- make([]byte, maxPayloadLength)
+	buf, leftover = coalesce(ctx, ch, []byte("abcd"), delay, 0, &stats)
+	if string(buf) != "abcd" || len(leftover) != maxPayloadLength {
+		t.Errorf("overflow: got (%d bytes, %d bytes)", len(buf), len(leftover))
+	}
+
+	// With nothing more to read, wait for the delay and return what we
+	// have.
+	ch = make(chan []byte)
+	start := time.Now()
+	buf, leftover = coalesce(ctx, ch, []byte("abcd"), delay, 0, &stats)
+	if string(buf) != "abcd" || leftover != nil {
+		t.Errorf("timeout: got (%q, %q)", buf, leftover)
+	}
+	if time.Since(start) < delay {
+		t.Errorf("timeout: returned after %v, before delay %v", time.Since(start), delay)
+	}
+
+	// A closed channel ends coalescing immediately.
+	ch = make(chan []byte, 1)
+	ch <- []byte("efgh")
+	close(ch)
+	buf, leftover = coalesce(ctx, ch, []byte("abcd"), 10*time.Second, 0, &stats)
+	if string(buf) != "abcdefgh" || leftover != nil {
+		t.Errorf("closed: got (%q, %q)", buf, leftover)
+	}
+}
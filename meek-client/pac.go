@@ -0,0 +1,575 @@
+// Proxy auto-config (PAC) files and WPAD.
+//
+// With --pac, meek-client chooses a proxy (or none) for each session by
+// calling the FindProxyForURL function of a PAC file with the front's URL, the
+// way a browser would. The PAC file is a local path, a URL that is fetched
+// directly (not through a proxy), or "wpad", which looks for the file at
+// http://wpad.DOMAIN/wpad.dat for the domains that contain this host's name,
+// up to its registrable domain (the DNS form of Web Proxy Auto-Discovery).
+// The file is loaded once, at startup.
+//
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file
+// https://datatracker.ietf.org/doc/html/draft-ietf-wrec-wpad-01
+//
+// The PAC file is run by the otto JavaScript interpreter. Each call to
+// FindProxyForURL gets a new runtime, in which the file's top-level code has
+// been run, so that calls do not wait for each other (otto runtimes are not
+// safe for concurrent use) and do not see each other's changes to global
+// variables. The helper functions that look up names (dnsResolve, isInNet,
+// isResolvable) use the system resolver, with a timeout, unless doh is in use.
+// Then they use the DoH resolver, so that a PAC file does not send the names
+// it is asked about to the system resolver; and while choosing the proxy for
+// the DoH server itself, for which there is no resolver yet, they look up
+// nothing and treat every name as unresolvable.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/robertkrimen/otto"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// The largest PAC file we will load.
+	maxPACFileLength = 1024 * 1024
+	// How long a name lookup by a PAC helper function may take.
+	pacLookupTimeout = 5 * time.Second
+)
+
+// How long the PAC file's top-level code and a call to FindProxyForURL may
+// run. A variable so that tests can shorten it.
+var pacRunTimeout = 30 * time.Second
+
+type pacScript struct {
+	// Where the file came from, for messages.
+	location string
+	src      string
+}
+
+// Looks up the IP addresses of a name for the PAC helper functions.
+type pacLookupFunc func(ctx context.Context, host string) ([]net.IP, error)
+
+// Look up names with the system resolver.
+func pacSystemLookup(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// Look up nothing, for when names must not go to the system resolver and
+// there is no other resolver to use.
+func pacNoLookup(ctx context.Context, host string) ([]net.IP, error) {
+	return nil, fmt.Errorf("not looking up %q", host)
+}
+
+// Return the lookup function for the PAC helper functions: resolver's, or the
+// system resolver's if resolver is nil (doh is not in use).
+func pacLookupFor(resolver *dohResolver) pacLookupFunc {
+	if resolver == nil {
+		return pacSystemLookup
+	}
+	return resolver.lookup
+}
+
+// Panicked with by an interrupted runtime.
+type pacInterrupt struct {
+	err error
+}
+
+// Parse a PAC file and check that its top-level code runs and defines
+// FindProxyForURL.
+func newPACScript(location, src string) (*pacScript, error) {
+	pac := &pacScript{location: location, src: src}
+	_, err := pac.run(pacNoLookup, func(vm *otto.Otto, f otto.Value) (otto.Value, error) {
+		return otto.UndefinedValue(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pac, nil
+}
+
+// Make a runtime with the PAC helper functions, whose lookups use lookup, run
+// the file's top-level code in it, and call fn with the runtime and its
+// FindProxyForURL function. The runtime is interrupted if it runs for longer
+// than pacRunTimeout.
+func (pac *pacScript) run(lookup pacLookupFunc, fn func(*otto.Otto, otto.Value) (otto.Value, error)) (result otto.Value, err error) {
+	vm := otto.New()
+	vm.Interrupt = make(chan func(), 1)
+	var interrupt func()
+	interrupt = func() {
+		// A try statement in the file would catch the panic, so
+		// interrupt the runtime again at the next statement.
+		vm.Interrupt <- interrupt
+		panic(pacInterrupt{fmt.Errorf("timed out after %v", pacRunTimeout)})
+	}
+	timer := time.AfterFunc(pacRunTimeout, func() {
+		vm.Interrupt <- interrupt
+	})
+	defer timer.Stop()
+	defer func() {
+		if caught := recover(); caught != nil {
+			i, ok := caught.(pacInterrupt)
+			if !ok {
+				panic(caught)
+			}
+			err = i.err
+		}
+	}()
+
+	for name, builtin := range pacBuiltins {
+		builtin := builtin
+		err := vm.Set(name, func(call otto.FunctionCall) otto.Value {
+			v, err := builtin(lookup, call.ArgumentList)
+			if err != nil {
+				panic(vm.MakeCustomError("Error", err.Error()))
+			}
+			if v == nil {
+				return otto.NullValue()
+			}
+			value, err := vm.ToValue(v)
+			if err != nil {
+				panic(vm.MakeCustomError("Error", err.Error()))
+			}
+			return value
+		})
+		if err != nil {
+			return otto.Value{}, err
+		}
+	}
+	_, err = vm.Run(pac.src)
+	if err != nil {
+		return otto.Value{}, err
+	}
+	f, err := vm.Get("FindProxyForURL")
+	if err != nil {
+		return otto.Value{}, err
+	}
+	if !f.IsFunction() {
+		return otto.Value{}, fmt.Errorf("no FindProxyForURL function")
+	}
+	return fn(vm, f)
+}
+
+// Call FindProxyForURL and return its result. The helper functions look up
+// names with lookup.
+func (pac *pacScript) findProxyForURL(u *url.URL, lookup pacLookupFunc) (string, error) {
+	// Like browsers, do not show the path and query of https URLs to the
+	// PAC file.
+	if u.Scheme == "https" {
+		u = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+	}
+	result, err := pac.run(lookup, func(vm *otto.Otto, f otto.Value) (otto.Value, error) {
+		return f.Call(otto.UndefinedValue(), u.String(), u.Hostname())
+	})
+	if err != nil {
+		return "", err
+	}
+	if !result.IsString() {
+		return "", fmt.Errorf("FindProxyForURL returned %s, not a string", result)
+	}
+	return result.String(), nil
+}
+
+// Return the proxies for u: an empty chain for DIRECT, or a chain of one
+// proxy. When FindProxyForURL returns several alternatives, the first is used.
+func (pac *pacScript) proxiesForURL(u *url.URL, lookup pacLookupFunc) (proxyChain, error) {
+	result, err := pac.findProxyForURL(u, lookup)
+	if err != nil {
+		return nil, fmt.Errorf("PAC file %s: %v", pac.location, err)
+	}
+	proxyURL, err := parsePACResult(result)
+	if err != nil {
+		return nil, fmt.Errorf("PAC file %s: %v", pac.location, err)
+	}
+	if proxyURL == nil {
+		return nil, nil
+	}
+	return proxyChain{proxyURL}, nil
+}
+
+// Return the proxies for connections to u: the ones the PAC file chooses, if
+// there is a PAC file, or else the ones from --proxy or TOR_PT_PROXY. resolver
+// is the doh resolver for the connections, or nil if doh is not in use.
+func proxiesForURL(u *url.URL, resolver *dohResolver) (proxyChain, error) {
+	if options.PAC == nil {
+		return options.Proxies, nil
+	}
+	return options.PAC.proxiesForURL(u, pacLookupFor(resolver))
+}
+
+// Return the proxies for queries to the DoH server at endpointArg. A bad URL
+// is not an error here; getDoHResolver reports it.
+func dohProxies(endpointArg string) (proxyChain, error) {
+	endpoint, err := url.Parse(endpointArg)
+	if err != nil {
+		return options.Proxies, nil
+	}
+	if options.PAC == nil {
+		return options.Proxies, nil
+	}
+	// The DoH server's own name must not go to the system resolver, and
+	// there is no DoH resolver until we know its proxies.
+	return options.PAC.proxiesForURL(endpoint, pacNoLookup)
+}
+
+// The proxy URL schemes for the proxy types in PAC results.
+var pacProxySchemes = map[string]string{
+	"PROXY":  "http",
+	"HTTP":   "http",
+	"HTTPS":  "https",
+	"SOCKS":  "socks5",
+	"SOCKS5": "socks5",
+	"SOCKS4": "socks4a",
+}
+
+// Parse the first of the semicolon-separated alternatives of a
+// FindProxyForURL result, such as "PROXY proxy.example:8080; DIRECT". Returns
+// nil for DIRECT.
+func parsePACResult(result string) (*url.URL, error) {
+	first := strings.TrimSpace(strings.SplitN(result, ";", 2)[0])
+	fields := strings.Fields(first)
+	switch {
+	case len(fields) == 1 && strings.ToUpper(fields[0]) == "DIRECT":
+		return nil, nil
+	case len(fields) == 2:
+		scheme, ok := pacProxySchemes[strings.ToUpper(fields[0])]
+		if !ok {
+			break
+		}
+		host, port, err := net.SplitHostPort(fields[1])
+		if err != nil || host == "" || port == "" {
+			break
+		}
+		return &url.URL{Scheme: scheme, Host: fields[1]}, nil
+	}
+	return nil, fmt.Errorf("cannot parse FindProxyForURL result %q", result)
+}
+
+// Load a PAC file from location: a file name, an http, https, or file URL, or
+// "wpad".
+func loadPACScript(location string) (*pacScript, error) {
+	if location == "wpad" {
+		return discoverWPAD()
+	}
+	var src []byte
+	u, err := url.Parse(location)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		src, err = fetchPACFile(u)
+	} else if err == nil && u.Scheme == "file" {
+		src, err = readPACFile(u.Path)
+	} else {
+		src, err = readPACFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pac, err := newPACScript(location, string(src))
+	if err != nil {
+		return nil, fmt.Errorf("PAC file %s: %v", location, err)
+	}
+	return pac, nil
+}
+
+func readPACFile(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readPACFileBody(f)
+}
+
+func readPACFileBody(r io.Reader) ([]byte, error) {
+	src, err := ioutil.ReadAll(io.LimitReader(r, maxPACFileLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(src) > maxPACFileLength {
+		return nil, fmt.Errorf("PAC file is longer than %d bytes", maxPACFileLength)
+	}
+	return src, nil
+}
+
+// Fetch a PAC file directly, without a proxy.
+func fetchPACFile(u *url.URL) ([]byte, error) {
+	tr := httpRoundTripper.Clone()
+	tr.Proxy = nil
+	client := &http.Client{Transport: tr, Timeout: 30 * time.Second}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: status %q", u, resp.Status)
+	}
+	return readPACFileBody(resp.Body)
+}
+
+// Return the WPAD URLs to try for a host name, most specific first. For
+// "host.dept.example.com", they are http://wpad.dept.example.com/wpad.dat and
+// http://wpad.example.com/wpad.dat. Domains above the registrable domain, such
+// as "com" and "co.uk", are never tried, because anyone can register
+// wpad.co.uk and serve a PAC file from it.
+func wpadURLs(hostname string) []string {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(hostname)
+	if err != nil {
+		return nil
+	}
+	labels := strings.Split(hostname, ".")
+	var urls []string
+	for i := 1; i < len(labels); i++ {
+		domain := strings.Join(labels[i:], ".")
+		if domain != registrable && !strings.HasSuffix(domain, "."+registrable) {
+			break
+		}
+		urls = append(urls, "http://wpad."+domain+"/wpad.dat")
+	}
+	return urls
+}
+
+// Find and load a PAC file using DNS WPAD.
+func discoverWPAD() (*pacScript, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	// os.Hostname may not include the domain; ask the resolver for the
+	// canonical name.
+	if !strings.Contains(hostname, ".") {
+		if cname, err := net.LookupCNAME(hostname); err == nil {
+			hostname = cname
+		}
+	}
+	urls := wpadURLs(hostname)
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("WPAD: host name %q has no domain; use --pac with a URL", hostname)
+	}
+	for _, location := range urls {
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+		src, err := fetchPACFile(u)
+		if err != nil {
+			log.Printf("WPAD: %v", err)
+			continue
+		}
+		pac, err := newPACScript(location, string(src))
+		if err != nil {
+			return nil, fmt.Errorf("PAC file %s: %v", location, err)
+		}
+		return pac, nil
+	}
+	return nil, fmt.Errorf("WPAD: no PAC file found at %s", strings.Join(urls, " or "))
+}
+
+// Return argument i, or undefined if there are not that many.
+func pacArg(args []otto.Value, i int) otto.Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return otto.UndefinedValue()
+}
+
+// The PAC helper functions. They return Go values, which are converted to
+// JavaScript values, or errors, which are thrown as exceptions.
+var pacBuiltins = map[string]func(lookup pacLookupFunc, args []otto.Value) (interface{}, error){
+	"isPlainHostName": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		return !strings.Contains(pacArg(args, 0).String(), "."), nil
+	},
+	"dnsDomainIs": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		host, domain := pacArg(args, 0).String(), pacArg(args, 1).String()
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain)), nil
+	},
+	"localHostOrDomainIs": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		host, hostdom := strings.ToLower(pacArg(args, 0).String()), strings.ToLower(pacArg(args, 1).String())
+		if host == hostdom {
+			return true, nil
+		}
+		return !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."), nil
+	},
+	"isResolvable": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		return pacResolve(lookup, pacArg(args, 0).String()) != nil, nil
+	},
+	"dnsResolve": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		ip := pacResolve(lookup, pacArg(args, 0).String())
+		if ip == nil {
+			return nil, nil
+		}
+		return ip.String(), nil
+	},
+	"isInNet": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		ip := pacResolve(lookup, pacArg(args, 0).String())
+		pattern := net.ParseIP(pacArg(args, 1).String()).To4()
+		mask := net.ParseIP(pacArg(args, 2).String()).To4()
+		if ip == nil || pattern == nil || mask == nil {
+			return false, nil
+		}
+		m := net.IPMask(mask)
+		return ip.Mask(m).Equal(pattern.Mask(m)), nil
+	},
+	"convert_addr": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		ip := net.ParseIP(pacArg(args, 0).String()).To4()
+		if ip == nil {
+			return float64(0), nil
+		}
+		return float64(uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])), nil
+	},
+	"myIpAddress": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		return pacMyIPAddress(), nil
+	},
+	"dnsDomainLevels": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		return float64(strings.Count(pacArg(args, 0).String(), ".")), nil
+	},
+	"shExpMatch": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		return shExpMatch(pacArg(args, 0).String(), pacArg(args, 1).String()), nil
+	},
+	"weekdayRange": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		return pacWeekdayRange(args, time.Now())
+	},
+	"timeRange": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		return pacTimeRange(args, time.Now())
+	},
+	"dateRange": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		return nil, fmt.Errorf("dateRange is not supported")
+	},
+	"alert": func(lookup pacLookupFunc, args []otto.Value) (interface{}, error) {
+		log.Printf("PAC alert: %s", pacArg(args, 0).String())
+		return nil, nil
+	},
+}
+
+// Return the IPv4 address of host (which may be an address already), or nil.
+// A lookup that takes longer than pacLookupTimeout fails.
+func pacResolve(lookup pacLookupFunc, host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pacLookupTimeout)
+	defer cancel()
+	ips, err := lookup(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return nil
+}
+
+// Return the address of the interface that would be used to reach the
+// internet. Connecting a UDP socket sends no packets.
+func pacMyIPAddress() string {
+	conn, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// Match s against a shell expression, in which "*" matches any string
+// (including "/"), and "?" matches any character.
+func shExpMatch(s, shexp string) bool {
+	var re strings.Builder
+	re.WriteString("^")
+	for _, r := range shexp {
+		switch r {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteString("$")
+	matched, err := regexp.MatchString(re.String(), s)
+	return err == nil && matched
+}
+
+// Remove a final "GMT" argument, and return the time in UTC if it was there.
+func pacTimeArgs(args []otto.Value, now time.Time) ([]otto.Value, time.Time) {
+	if n := len(args); n > 0 && args[n-1].String() == "GMT" {
+		return args[:n-1], now.UTC()
+	}
+	return args, now
+}
+
+var pacWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+func pacWeekday(v otto.Value) (int, error) {
+	for i, day := range pacWeekdays {
+		if v.String() == day {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("bad weekday %s", v)
+}
+
+// weekdayRange(wd1[, wd2][, "GMT"]).
+func pacWeekdayRange(args []otto.Value, now time.Time) (interface{}, error) {
+	args, now = pacTimeArgs(args, now)
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("weekdayRange needs 1 or 2 weekdays")
+	}
+	wd1, err := pacWeekday(args[0])
+	if err != nil {
+		return nil, err
+	}
+	wd2 := wd1
+	if len(args) == 2 {
+		wd2, err = pacWeekday(args[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	today := int(now.Weekday())
+	if wd1 <= wd2 {
+		return wd1 <= today && today <= wd2, nil
+	}
+	// The range wraps around the end of the week.
+	return today >= wd1 || today <= wd2, nil
+}
+
+// timeRange(hour1[, hour2][, "GMT"]). The forms with minutes and seconds are
+// not supported.
+func pacTimeRange(args []otto.Value, now time.Time) (interface{}, error) {
+	args, now = pacTimeArgs(args, now)
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("timeRange is supported only with 1 or 2 hours")
+	}
+	hour := int64(now.Hour())
+	hour1, err := args[0].ToInteger()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 1 {
+		return hour == hour1, nil
+	}
+	// The end of the range is exclusive: timeRange(12, 13) is from noon to
+	// 1 pm.
+	hour2, err := args[1].ToInteger()
+	if err != nil {
+		return nil, err
+	}
+	if hour1 <= hour2 {
+		return hour1 <= hour && hour < hour2, nil
+	}
+	return hour >= hour1 || hour < hour2, nil
+}
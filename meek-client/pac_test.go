@@ -0,0 +1,480 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+// A PAC file of the kind that IT departments hand out.
+const testPACFile = `
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (isPlainHostName(host) ||
+	    dnsDomainIs(host, ".intranet.example") ||
+	    isInNet(host, "10.0.0.0", "255.0.0.0"))
+		return "DIRECT";
+	if (shExpMatch(url, "http://*.socks.example/*"))
+		return "SOCKS socks.example:1080";
+	if (url.substring(0, 6) == "https:")
+		return "PROXY proxy.example:8080; DIRECT";
+	return "HTTPS secure-proxy.example:443";
+}
+`
+
+func TestPACScript(t *testing.T) {
+	pac, err := newPACScript("test", testPACFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		url      string
+		expected string
+	}{
+		{"https://front.example/path?query", "http://proxy.example:8080"},
+		{"http://front.example/", "https://secure-proxy.example:443"},
+		{"http://www.socks.example/", "socks5://socks.example:1080"},
+		{"https://host/", ""},
+		{"https://HOST.intranet.example/", ""},
+		{"https://10.1.2.3/", ""},
+		{"https://11.1.2.3/", "http://proxy.example:8080"},
+	} {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxies, err := pac.proxiesForURL(u, pacSystemLookup)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.url, err)
+		} else if proxies.String() != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.url, test.expected, proxies.String())
+		}
+	}
+
+	for _, src := range []string{
+		// No FindProxyForURL.
+		`function findProxyForURL(url, host) { return "DIRECT"; }`,
+		// Not a function.
+		`var FindProxyForURL = "DIRECT";`,
+		// Syntax error.
+		`function FindProxyForURL(url, host) {`,
+		// Run-time error in top-level code.
+		`var x = y; function FindProxyForURL(url, host) { return "DIRECT"; }`,
+	} {
+		_, err := newPACScript("test", src)
+		if err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+
+	// Bad results.
+	for _, src := range []string{
+		`function FindProxyForURL(url, host) { return 1; }`,
+		`function FindProxyForURL(url, host) { return "PROXY"; }`,
+		`function FindProxyForURL(url, host) { return dateRange("JAN"); }`,
+	} {
+		pac, err := newPACScript("test", src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = pac.proxiesForURL(&url.URL{Scheme: "https", Host: "front.example"}, pacSystemLookup)
+		if err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+// Test that PAC files can use all of JavaScript, not only the PAC functions.
+func TestPACScriptJavaScript(t *testing.T) {
+	pac, err := newPACScript("test", `
+var proxies = {"a.example": "PROXY a:1", "b.example": "PROXY b:2"};
+var direct = [/^10\./, /\.internal$/];
+function FindProxyForURL(url, host) {
+	for (var i = 0; i < direct.length; i++) {
+		if (direct[i].test(host))
+			return "DIRECT";
+	}
+	switch (host.split(".").length) {
+	case 1:
+		return "DIRECT";
+	default:
+		return proxies[host] || "SOCKS5 default:3";
+	}
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		host     string
+		expected string
+	}{
+		{"10.1.2.3", "DIRECT"},
+		{"host.internal", "DIRECT"},
+		{"host", "DIRECT"},
+		{"b.example", "PROXY b:2"},
+		{"c.example", "SOCKS5 default:3"},
+	} {
+		result, err := pac.findProxyForURL(&url.URL{Scheme: "https", Host: test.host}, pacSystemLookup)
+		if err != nil || result != test.expected {
+			t.Errorf("%s: expected %q, got %q, %v", test.host, test.expected, result, err)
+		}
+	}
+}
+
+// Test that a PAC file that runs too long is stopped.
+func TestPACScriptTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		pacRunTimeout = timeout
+	}(pacRunTimeout)
+	pacRunTimeout = 10 * time.Millisecond
+
+	_, err := newPACScript("test", `for (;;) {} function FindProxyForURL(url, host) { return "DIRECT"; }`)
+	if err == nil {
+		t.Errorf("top-level code: expected error")
+	}
+	pac, err := newPACScript("test", `function FindProxyForURL(url, host) { for (;;) {} }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pac.findProxyForURL(&url.URL{Scheme: "https", Host: "front.example"}, pacSystemLookup)
+	if err == nil {
+		t.Errorf("FindProxyForURL: expected error")
+	}
+}
+
+// Test that https URLs are given to FindProxyForURL without their path.
+func TestPACScriptURL(t *testing.T) {
+	pac, err := newPACScript("test", `function FindProxyForURL(url, host) { return url + " " + host; }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		url      string
+		expected string
+	}{
+		{"https://front.example:8443/path?query", "https://front.example:8443/ front.example"},
+		{"http://front.example/path?query", "http://front.example/path?query front.example"},
+	} {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := pac.findProxyForURL(u, pacSystemLookup)
+		if err != nil || result != test.expected {
+			t.Errorf("%s: expected %q, got %q, %v", test.url, test.expected, result, err)
+		}
+	}
+}
+
+func TestParsePACResult(t *testing.T) {
+	for _, test := range []struct {
+		result   string
+		expected string
+		ok       bool
+	}{
+		{"DIRECT", "", true},
+		{" direct ", "", true},
+		{"DIRECT; PROXY proxy.example:8080", "", true},
+		{"PROXY proxy.example:8080", "http://proxy.example:8080", true},
+		{"PROXY proxy.example:8080;DIRECT", "http://proxy.example:8080", true},
+		{"HTTP proxy.example:8080", "http://proxy.example:8080", true},
+		{"HTTPS [2001:db8::1]:443", "https://[2001:db8::1]:443", true},
+		{"SOCKS socks.example:1080", "socks5://socks.example:1080", true},
+		{"SOCKS5 socks.example:1080", "socks5://socks.example:1080", true},
+		{"SOCKS4 socks.example:1080", "socks4a://socks.example:1080", true},
+		{"", "", false},
+		{"PROXY", "", false},
+		{"PROXY proxy.example", "", false},
+		{"QUIC proxy.example:443", "", false},
+		{"PROXY a:1 b:2", "", false},
+	} {
+		u, err := parsePACResult(test.result)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%q: expected error", test.result)
+			}
+			continue
+		}
+		var s string
+		if u != nil {
+			s = u.String()
+		}
+		if err != nil || s != test.expected {
+			t.Errorf("%q: expected %q, got %q, %v", test.result, test.expected, s, err)
+		}
+	}
+}
+
+// Convert Go values to JavaScript values, for calling PAC functions.
+func pacValues(args ...interface{}) []otto.Value {
+	values := make([]otto.Value, 0, len(args))
+	for _, arg := range args {
+		v, err := otto.ToValue(arg)
+		if err != nil {
+			panic(err)
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func TestPACBuiltins(t *testing.T) {
+	call := func(name string, args ...interface{}) interface{} {
+		v, err := pacBuiltins[name](pacNoLookup, pacValues(args...))
+		if err != nil {
+			t.Errorf("%s%q: unexpected error %v", name, args, err)
+		}
+		return v
+	}
+	for _, test := range []struct {
+		v, expected interface{}
+	}{
+		{call("isPlainHostName", "www"), true},
+		{call("isPlainHostName", "www.example"), false},
+		{call("dnsDomainIs", "www.example.com", ".example.com"), true},
+		{call("dnsDomainIs", "www.example.org", ".example.com"), false},
+		{call("localHostOrDomainIs", "www.example.com", "www.example.com"), true},
+		{call("localHostOrDomainIs", "www", "www.example.com"), true},
+		{call("localHostOrDomainIs", "www.example.org", "www.example.com"), false},
+		{call("localHostOrDomainIs", "home", "www.example.com"), false},
+		{call("isResolvable", "127.0.0.1"), true},
+		{call("dnsResolve", "127.0.0.1"), "127.0.0.1"},
+		{call("isInNet", "198.51.100.7", "198.51.100.0", "255.255.255.0"), true},
+		{call("isInNet", "198.51.101.7", "198.51.100.0", "255.255.255.0"), false},
+		{call("isInNet", "198.51.100.7", "bad", "255.255.255.0"), false},
+		{call("convert_addr", "104.16.41.2"), float64(1745889538)},
+		{call("dnsDomainLevels", "www"), float64(0)},
+		{call("dnsDomainLevels", "www.example.com"), float64(2)},
+		{call("shExpMatch", "http://home.example/a/b", "*/a/*"), true},
+		{call("shExpMatch", "www.example.com", "*.example.com"), true},
+		{call("shExpMatch", "www.example.com", "?ww.example.*"), true},
+		{call("shExpMatch", "www.example.com", "*.example.org"), false},
+		{call("shExpMatch", "wwwxexample.com", "www.example.com"), false},
+	} {
+		if test.v != test.expected {
+			t.Errorf("expected %#v, got %#v", test.expected, test.v)
+		}
+	}
+	if ip, ok := call("myIpAddress").(string); !ok || ip == "" {
+		t.Errorf("myIpAddress returned %#v", ip)
+	}
+}
+
+func TestPACTimeFunctions(t *testing.T) {
+	// A Wednesday, at 13:30 in UTC and 08:30 in local time.
+	local := time.FixedZone("UTC-5", -5*60*60)
+	now := time.Date(2020, time.January, 1, 8, 30, 0, 0, local)
+	for _, test := range []struct {
+		f        func([]otto.Value, time.Time) (interface{}, error)
+		args     []interface{}
+		expected bool
+	}{
+		{pacWeekdayRange, []interface{}{"WED"}, true},
+		{pacWeekdayRange, []interface{}{"MON", "FRI"}, true},
+		{pacWeekdayRange, []interface{}{"THU", "FRI"}, false},
+		{pacWeekdayRange, []interface{}{"FRI", "MON"}, false},
+		{pacWeekdayRange, []interface{}{"SAT", "WED"}, true},
+		{pacWeekdayRange, []interface{}{"WED", "GMT"}, true},
+		{pacTimeRange, []interface{}{8}, true},
+		{pacTimeRange, []interface{}{13, "GMT"}, true},
+		{pacTimeRange, []interface{}{8, 9}, true},
+		{pacTimeRange, []interface{}{7, 8}, false},
+		{pacTimeRange, []interface{}{22, 9}, true},
+		{pacTimeRange, []interface{}{9, 17}, false},
+		{pacTimeRange, []interface{}{9, 17, "GMT"}, true},
+	} {
+		v, err := test.f(pacValues(test.args...), now)
+		if err != nil || v != test.expected {
+			t.Errorf("%v: expected %v, got %#v, %v", test.args, test.expected, v, err)
+		}
+	}
+	for _, args := range [][]interface{}{
+		{},
+		{"XYZ"},
+		{"MON", "TUE", "WED"},
+	} {
+		_, err := pacWeekdayRange(pacValues(args...), now)
+		if err == nil {
+			t.Errorf("weekdayRange%q: expected error", args)
+		}
+	}
+}
+
+func TestWPADURLs(t *testing.T) {
+	for _, test := range []struct {
+		hostname string
+		expected []string
+	}{
+		{"host", nil},
+		{"host.example", nil},
+		{"host.dept.example.com.", []string{
+			"http://wpad.dept.example.com/wpad.dat",
+			"http://wpad.example.com/wpad.dat",
+		}},
+		// Not wpad.co.uk, which anyone could register.
+		{"Host.Example.co.uk", []string{
+			"http://wpad.example.co.uk/wpad.dat",
+		}},
+		{"example.co.uk", nil},
+	} {
+		urls := wpadURLs(test.hostname)
+		if !reflect.DeepEqual(urls, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.hostname, test.expected, urls)
+		}
+	}
+}
+
+func TestLoadPACScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meek-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "proxy.pac")
+	err = ioutil.WriteFile(filename, []byte(testPACFile), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/proxy.pac" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Write([]byte(testPACFile))
+	}))
+	defer server.Close()
+
+	for _, location := range []string{
+		filename,
+		(&url.URL{Scheme: "file", Path: filename}).String(),
+		server.URL + "/proxy.pac",
+	} {
+		pac, err := loadPACScript(location)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", location, err)
+			continue
+		}
+		proxies, err := pac.proxiesForURL(&url.URL{Scheme: "https", Host: "front.example"}, pacSystemLookup)
+		if err != nil || proxies.String() != "http://proxy.example:8080" {
+			t.Errorf("%s: got %q, %v", location, proxies, err)
+		}
+	}
+	for _, location := range []string{
+		filepath.Join(dir, "nonexistent.pac"),
+		server.URL + "/nonexistent.pac",
+	} {
+		_, err := loadPACScript(location)
+		if err == nil {
+			t.Errorf("%s: expected error", location)
+		}
+	}
+}
+
+func TestProxiesForURL(t *testing.T) {
+	defer func(proxies proxyChain, pac *pacScript) {
+		options.Proxies = proxies
+		options.PAC = pac
+	}(options.Proxies, options.PAC)
+
+	proxyURL := &url.URL{Scheme: "socks5", Host: "127.0.0.1:1080"}
+	options.Proxies = proxyChain{proxyURL}
+	options.PAC = nil
+	u := &url.URL{Scheme: "https", Host: "front.example", Path: "/"}
+	proxies, err := proxiesForURL(u, nil)
+	if err != nil || len(proxies) != 1 || proxies[0] != proxyURL {
+		t.Errorf("without PAC: got %v, %v", proxies, err)
+	}
+
+	options.Proxies = nil
+	options.PAC, err = newPACScript("test", testPACFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, err = proxiesForURL(u, nil)
+	if err != nil || proxies.String() != "http://proxy.example:8080" {
+		t.Errorf("with PAC: got %v, %v", proxies, err)
+	}
+	proxies, err = dohProxies("https://doh.intranet.example/dns-query")
+	if err != nil || len(proxies) != 0 {
+		t.Errorf("with PAC: got %v, %v for DoH", proxies, err)
+	}
+}
+
+// Test that the PAC helper functions look up names with the doh resolver when
+// there is one, and look up nothing when choosing the DoH server's proxy.
+func TestPACLookup(t *testing.T) {
+	defer func(proxies proxyChain, pac *pacScript) {
+		options.Proxies = proxies
+		options.PAC = pac
+	}(options.Proxies, options.PAC)
+
+	s := newDoHTestServer(map[string][]net.IP{
+		"front.example.": {net.ParseIP("10.1.2.3")},
+	})
+	defer s.Close()
+	resolver := newTestDoHResolver(t, s)
+
+	options.Proxies = nil
+	var err error
+	options.PAC, err = newPACScript("test", `
+function FindProxyForURL(url, host) {
+	if (isInNet(host, "10.0.0.0", "255.0.0.0"))
+		return "DIRECT";
+	if (isResolvable(host))
+		return "PROXY resolvable.example:8080";
+	return "PROXY proxy.example:8080";
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, err := proxiesForURL(&url.URL{Scheme: "https", Host: "front.example", Path: "/"}, resolver)
+	if err != nil || len(proxies) != 0 {
+		t.Errorf("with doh: got %v, %v", proxies, err)
+	}
+	if s.numQueries == 0 {
+		t.Errorf("with doh: DoH server got no queries")
+	}
+
+	// localhost would be resolvable by the system resolver.
+	proxies, err = dohProxies("https://localhost/dns-query")
+	if err != nil || proxies.String() != "http://proxy.example:8080" {
+		t.Errorf("for DoH: got %v, %v", proxies, err)
+	}
+}
+
+// Test that a PAC file cannot catch the interruption when it runs too long.
+func TestPACScriptTimeoutCatch(t *testing.T) {
+	defer func(timeout time.Duration) {
+		pacRunTimeout = timeout
+	}(pacRunTimeout)
+	pacRunTimeout = 10 * time.Millisecond
+
+	pac, err := newPACScript("test", `
+function FindProxyForURL(url, host) {
+	for (;;) {
+		try {
+			for (;;) {}
+		} catch (e) {}
+	}
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pac.findProxyForURL(&url.URL{Scheme: "https", Host: "front.example"}, pacSystemLookup)
+	if err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -0,0 +1,90 @@
+// Certificate pinning.
+//
+// A "pin=" bridge line argument or --pin option gives a comma-separated list of
+// SHA-256 hashes of SubjectPublicKeyInfo structures, each in base64, as in the
+// pin-sha256 directive of HTTP Public Key Pinning (RFC 7469). A connection to
+// the front succeeds only if the public key of one of the certificates in the
+// verified chain matches one of the pins. This is in addition to the usual
+// certificate verification, and protects against interception by a CA that is
+// trusted by the system but should not be trusted for the front. Pin the front's
+// own key, or that of an intermediate or root CA; include a backup pin to
+// survive a key change.
+//
+// The hash of a certificate's key can be computed with:
+//
+//	openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A set of SHA-256 SPKI hashes. A nil pinSet means no pinning.
+type pinSet map[[sha256.Size]byte]struct{}
+
+// Parse a comma-separated list of base64-encoded SHA-256 hashes.
+func parsePins(arg string) (pinSet, error) {
+	pins := make(pinSet)
+	for _, s := range strings.Split(arg, ",") {
+		h, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode pin %q: %v", s, err)
+		}
+		if len(h) != sha256.Size {
+			return nil, fmt.Errorf("pin %q is not a SHA-256 hash", s)
+		}
+		var key [sha256.Size]byte
+		copy(key[:], h)
+		pins[key] = struct{}{}
+	}
+	return pins, nil
+}
+
+// Return the pins in a canonical order, in the syntax accepted by parsePins.
+func (pins pinSet) String() string {
+	var encoded []string
+	for h := range pins {
+		encoded = append(encoded, base64.StdEncoding.EncodeToString(h[:]))
+	}
+	sort.Strings(encoded)
+	return strings.Join(encoded, ",")
+}
+
+func spkiHash(cert *x509.Certificate) [sha256.Size]byte {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// Check that one of the certificates in a verified chain matches a pin. Only
+// verified chains count: the server may send any extra certificates it likes,
+// including the front's real ones, without their being checked. (Chains may
+// also end in root certificates that the server did not send.)
+func (pins pinSet) check(serverName string, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if _, ok := pins[spkiHash(cert)]; ok {
+				return nil
+			}
+		}
+	}
+	// Name the keys in the server's chains, to help in updating pins or
+	// in noticing interception.
+	seen := make(map[[sha256.Size]byte]bool)
+	var got []string
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			h := spkiHash(cert)
+			if seen[h] {
+				continue
+			}
+			seen[h] = true
+			got = append(got, base64.StdEncoding.EncodeToString(h[:]))
+		}
+	}
+	return fmt.Errorf("certificate pin mismatch for %s: server's keys are %s; pins are %s",
+		serverName, strings.Join(got, ","), pins)
+}
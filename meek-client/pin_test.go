@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/proxy"
+)
+
+func TestParsePins(t *testing.T) {
+	a := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	b := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("\xff", sha256.Size)))
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{a, a},
+		{a + "," + b, b + "," + a},
+		{a + "," + a, a},
+		{"", ""},
+		{a + ",", ""},
+		{"!!!", ""},
+		{base64.StdEncoding.EncodeToString(make([]byte, 20)), ""},
+	} {
+		pins, err := parsePins(test.input)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%q: expected error", test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.input, err)
+		} else if pins.String() != test.expected {
+			t.Errorf("%q → %q, expected %q", test.input, pins.String(), test.expected)
+		}
+	}
+}
+
+// Return a pin for the server's certificate, and a pin that doesn't match it.
+func testPins(t *testing.T, server *httptest.Server) (pinSet, pinSet) {
+	h := spkiHash(server.Certificate())
+	good, err := parsePins(base64.StdEncoding.EncodeToString(h[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := parsePins(base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return good, bad
+}
+
+func TestPinnedRoundTripper(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	good, bad := testPins(t, server)
+	// The proxy's certificate is valid for the front's address too, so
+	// the pins must be checked on the front connection however much it
+	// looks like a proxy connection.
+	proxyServer := newConnectProxy()
+	defer proxyServer.Close()
+	proxyURL, err := url.Parse(proxyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, proxies := range []proxyChain{nil, {proxyURL}} {
+		for _, test := range []struct {
+			pins pinSet
+			ok   bool
+		}{
+			{good, true},
+			{bad, false},
+		} {
+			rt, err := newNativeRoundTripper(proxies, &frontSettings{RootCAs: roots, Pins: test.pins})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest("GET", server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := rt.RoundTrip(req)
+			if test.ok {
+				if err != nil {
+					t.Errorf("proxy %v: unexpected error %v", proxies, err)
+					continue
+				}
+				resp.Body.Close()
+			} else if err == nil || !strings.Contains(err.Error(), "certificate pin mismatch") {
+				t.Errorf("proxy %v: expected pin mismatch, got %v", proxies, err)
+			}
+			rt.CloseIdleConnections()
+		}
+	}
+}
+
+func TestUTLSPin(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	good, bad := testPins(t, server)
+
+	for _, test := range []struct {
+		pins pinSet
+		ok   bool
+	}{
+		{nil, true},
+		{good, true},
+		{bad, false},
+	} {
+		// The server's certificate is valid for example.com. Pins
+		// apply only to verified chains, so the certificate must
+		// verify.
+		cfg := &utls.Config{RootCAs: roots, ServerName: "example.com"}
+		uconn, err := dialUTLS(context.Background(), "tcp", server.Listener.Addr().String(), cfg, &utls.HelloChrome_Auto, proxy.Direct, test.pins)
+		if test.ok {
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+				continue
+			}
+			uconn.Close()
+		} else if err == nil || !strings.Contains(err.Error(), "certificate pin mismatch") {
+			t.Errorf("expected pin mismatch, got %v", err)
+		}
+	}
+}
+
+// Create a certificate for a key, signed by parent (or self-signed if parent is
+// nil).
+func createTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(1)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, priv
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &priv.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, priv
+}
+
+func createTestCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return createTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+}
+
+// Test that a certificate that the server sends but that is not part of the
+// verified chain does not satisfy a pin. An interceptor whose CA the client
+// trusts could otherwise pass the pin by sending the front's real certificate
+// alongside its own.
+func TestPinExtraCertificate(t *testing.T) {
+	frontCA, _ := createTestCA(t, "Front CA")
+	otherCA, otherKey := createTestCA(t, "Other CA")
+	leaf, leafKey := createTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "example.com"},
+		DNSNames:    []string{"example.com"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, otherCA, otherKey)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{
+			// The front's CA certificate comes along as an extra.
+			Certificate: [][]byte{leaf.Raw, frontCA.Raw},
+			PrivateKey:  leafKey,
+		}},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	pinFor := func(cert *x509.Certificate) pinSet {
+		h := spkiHash(cert)
+		pins, err := parsePins(base64.StdEncoding.EncodeToString(h[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pins
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(otherCA)
+	uroots := x509.NewCertPool()
+	uroots.AddCert(otherCA)
+
+	for _, test := range []struct {
+		pins pinSet
+		ok   bool
+	}{
+		{pinFor(frontCA), false},
+		{pinFor(otherCA), true},
+		{pinFor(leaf), true},
+	} {
+		rt, err := newNativeRoundTripper(nil, &frontSettings{RootCAs: roots, Pins: test.pins})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := rt.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		rt.CloseIdleConnections()
+		if test.ok && err != nil {
+			t.Errorf("native %v: unexpected error %v", test.pins, err)
+		} else if !test.ok && (err == nil || !strings.Contains(err.Error(), "certificate pin mismatch")) {
+			t.Errorf("native %v: expected pin mismatch, got %v", test.pins, err)
+		}
+
+		// Use a fresh session cache, so that every handshake is a
+		// full one.
+		cfg := &utls.Config{RootCAs: roots, ServerName: "example.com", ClientSessionCache: utls.NewLRUClientSessionCache(1)}
+		uconn, err := dialUTLS(context.Background(), "tcp", server.Listener.Addr().String(), cfg, &utls.HelloChrome_Auto, proxy.Direct, test.pins)
+		if err == nil {
+			uconn.Close()
+		}
+		if test.ok && err != nil {
+			t.Errorf("uTLS %v: unexpected error %v", test.pins, err)
+		} else if !test.ok && (err == nil || !strings.Contains(err.Error(), "certificate pin mismatch")) {
+			t.Errorf("uTLS %v: expected pin mismatch, got %v", test.pins, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Sharing of RoundTrippers among SOCKS connections.
+//
+// Each UTLSRoundTripper owns its own connections (and, with HTTP/2, usually
+// just one connection that all requests are multiplexed over). If every SOCKS
+// connection got its own UTLSRoundTripper, then every tor connection would cost
+// a new TCP and TLS handshake, and a tor bootstrap would cause a conspicuous
+// burst of handshakes to the front. Instead, SOCKS connections that would make
+// identical RoundTrippers share one from a roundTripperPool. A RoundTripper
+// stays in the pool as long as some session is using it, and for a while after
+// the last one stops, before it is evicted and its idle connections closed.
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Everything that distinguishes one pooled RoundTripper from another.
+type roundTripperPoolKey struct {
+	// The host:port that TLS connections are made to (i.e., the front).
+	Front string
+	// The name of the uTLS Client Hello ID, in canonical (lower) case.
+	UTLSName string
+	// The proxy chain (proxyChain.key), or "" for no proxy.
+	Proxy string
+	// The ECHConfigList, or "" for no ECH.
+	ECH string
+	// Identifies the frontSettings (frontSettings.key).
+	Settings string
+}
+
+type roundTripperPoolEntry struct {
+	rt http.RoundTripper
+	// How many sessions are currently using rt.
+	users int
+	// Set when users drops to 0; fires to evict the entry.
+	evictTimer *time.Timer
+}
+
+// A roundTripperPool hands out shared RoundTrippers, making new ones as needed
+// and evicting ones that have not been used for idleTimeout.
+type roundTripperPool struct {
+	lock        sync.Mutex
+	entries     map[roundTripperPoolKey]*roundTripperPoolEntry
+	idleTimeout time.Duration
+}
+
+func newRoundTripperPool(idleTimeout time.Duration) *roundTripperPool {
+	return &roundTripperPool{
+		entries:     make(map[roundTripperPoolKey]*roundTripperPoolEntry),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Get returns the pooled RoundTripper for key, calling makeRT to create one if
+// there is none already. Every successful call to Get must be matched by a
+// call to Put with the same key when the caller is done with the RoundTripper.
+//
+// makeRT may be slow (it may load files and set up resolvers and proxies), so
+// it runs without pool.lock held, and calls for other keys need not wait for
+// it. If concurrent calls for the same key each make a RoundTripper, the first
+// to be stored is used, and the others are discarded.
+func (pool *roundTripperPool) Get(key roundTripperPoolKey, makeRT func() (http.RoundTripper, error)) (http.RoundTripper, error) {
+	pool.lock.Lock()
+	entry, ok := pool.entries[key]
+	if ok {
+		defer pool.lock.Unlock()
+		return pool.use(entry), nil
+	}
+	pool.lock.Unlock()
+
+	rt, err := makeRT()
+	if err != nil {
+		return nil, err
+	}
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	entry, ok = pool.entries[key]
+	if ok {
+		closeIdleConnections(rt)
+	} else {
+		entry = &roundTripperPoolEntry{rt: rt}
+		pool.entries[key] = entry
+	}
+	return pool.use(entry), nil
+}
+
+// Count a new user of entry, cancelling any pending eviction. Must be called
+// with pool.lock held.
+func (pool *roundTripperPool) use(entry *roundTripperPoolEntry) http.RoundTripper {
+	if entry.evictTimer != nil {
+		entry.evictTimer.Stop()
+		entry.evictTimer = nil
+	}
+	entry.users++
+	return entry.rt
+}
+
+// Put releases a RoundTripper obtained from Get. When the last user of a
+// RoundTripper releases it, it is scheduled for eviction after idleTimeout.
+func (pool *roundTripperPool) Put(key roundTripperPoolKey) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	entry, ok := pool.entries[key]
+	if !ok {
+		panic("Put of a key not in the pool")
+	}
+	entry.users--
+	if entry.users > 0 {
+		return
+	}
+	entry.evictTimer = time.AfterFunc(pool.idleTimeout, func() {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		// Check that the entry was not reused (and possibly released
+		// again, with a new timer) while this function was waiting for
+		// the lock.
+		if pool.entries[key] != entry || entry.users > 0 {
+			return
+		}
+		delete(pool.entries, key)
+		closeIdleConnections(entry.rt)
+	})
+}
+
+// Close the idle connections of rt, if it is the kind of RoundTripper that has
+// them.
+func closeIdleConnections(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
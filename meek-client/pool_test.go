@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A RoundTripper that records whether CloseIdleConnections was called.
+type closeRecordingRoundTripper struct {
+	lock   sync.Mutex
+	closed bool
+}
+
+func (rt *closeRecordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	panic("not implemented")
+}
+
+func (rt *closeRecordingRoundTripper) CloseIdleConnections() {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	rt.closed = true
+}
+
+func (rt *closeRecordingRoundTripper) isClosed() bool {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	return rt.closed
+}
+
+func TestRoundTripperPoolSharing(t *testing.T) {
+	pool := newRoundTripperPool(time.Hour)
+	made := 0
+	makeRT := func() (http.RoundTripper, error) {
+		made++
+		return &closeRecordingRoundTripper{}, nil
+	}
+
+	keyA := roundTripperPoolKey{Front: "a.example:443", UTLSName: "hellofirefox_auto"}
+	keyB := roundTripperPoolKey{Front: "a.example:443", UTLSName: "hellochrome_auto"}
+	keyC := roundTripperPoolKey{Front: "a.example:443", UTLSName: "hellofirefox_auto", Proxy: "socks5://127.0.0.1:1080"}
+
+	a1, _ := pool.Get(keyA, makeRT)
+	a2, _ := pool.Get(keyA, makeRT)
+	b, _ := pool.Get(keyB, makeRT)
+	c, _ := pool.Get(keyC, makeRT)
+	if a1 != a2 {
+		t.Errorf("same key gave different RoundTrippers")
+	}
+	if a1 == b || a1 == c || b == c {
+		t.Errorf("different keys gave the same RoundTripper")
+	}
+	if made != 3 {
+		t.Errorf("expected 3 RoundTrippers to be made, got %d", made)
+	}
+}
+
+func TestRoundTripperPoolEviction(t *testing.T) {
+	const idleTimeout = 50 * time.Millisecond
+	pool := newRoundTripperPool(idleTimeout)
+	makeRT := func() (http.RoundTripper, error) {
+		return &closeRecordingRoundTripper{}, nil
+	}
+	key := roundTripperPoolKey{Front: "a.example:443", UTLSName: "hellofirefox_auto"}
+
+	// Released and re-acquired before the timeout: not evicted.
+	rt1, _ := pool.Get(key, makeRT)
+	pool.Put(key)
+	rt2, _ := pool.Get(key, makeRT)
+	time.Sleep(2 * idleTimeout)
+	if rt1 != rt2 {
+		t.Errorf("RoundTripper was replaced while in use")
+	}
+	if rt1.(*closeRecordingRoundTripper).isClosed() {
+		t.Errorf("RoundTripper was closed while in use")
+	}
+
+	// Released and left idle: evicted and closed.
+	pool.Put(key)
+	time.Sleep(2 * idleTimeout)
+	if !rt1.(*closeRecordingRoundTripper).isClosed() {
+		t.Errorf("idle RoundTripper was not closed")
+	}
+	rt3, _ := pool.Get(key, makeRT)
+	if rt3 == rt1 {
+		t.Errorf("evicted RoundTripper was reused")
+	}
+}
+
+// Test that a slow makeRT does not hold up Get for other keys, and that
+// concurrent Gets for the same key end up sharing one RoundTripper.
+func TestRoundTripperPoolConcurrentMake(t *testing.T) {
+	pool := newRoundTripperPool(time.Hour)
+	keyA := roundTripperPoolKey{Front: "a.example:443"}
+	keyB := roundTripperPoolKey{Front: "b.example:443"}
+
+	unblock := make(chan struct{})
+	started := make(chan struct{}, 2)
+	slowMakeRT := func() (http.RoundTripper, error) {
+		started <- struct{}{}
+		<-unblock
+		return &closeRecordingRoundTripper{}, nil
+	}
+	results := make(chan http.RoundTripper, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			rt, _ := pool.Get(keyA, slowMakeRT)
+			results <- rt
+		}()
+	}
+	<-started
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		pool.Get(keyB, func() (http.RoundTripper, error) {
+			return &closeRecordingRoundTripper{}, nil
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Get for another key waited for makeRT")
+	}
+
+	close(unblock)
+	rt1, rt2 := <-results, <-results
+	if rt1 != rt2 {
+		t.Errorf("concurrent Gets for the same key gave different RoundTrippers")
+	}
+	// Both are users of the shared RoundTripper.
+	pool.Put(keyA)
+	pool.Put(keyA)
+}
@@ -0,0 +1,67 @@
+// Chains of upstream proxies.
+//
+// A proxyChain is an ordered list of proxies. meek-client connects to the
+// first proxy, asks it for a tunnel to the second, and so on; the last proxy
+// makes the connection to the destination. Each hop is one of the dialers for
+// a single proxy (httpProxy, ProxyHTTPS, proxy.SOCKS5, or ProxySOCKS4a),
+// stacked on the dialer for the hop before it, and each hop uses the username
+// and password in its own URL.
+//
+// A chain of one proxy is the usual case of a single upstream proxy, and an
+// empty chain means no proxy.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+type proxyChain []*url.URL
+
+// String returns the URLs of the chain, separated by spaces.
+func (chain proxyChain) String() string {
+	s := make([]string, 0, len(chain))
+	for _, u := range chain {
+		s = append(s, u.String())
+	}
+	return strings.Join(s, " ")
+}
+
+// Return a string that identifies the chain, for map keys. Usernames and
+// passwords are replaced by a hash, so that keys do not hold credentials, but
+// chains that differ only in credentials still have different keys.
+func (chain proxyChain) key() string {
+	s := make([]string, 0, len(chain))
+	for _, u := range chain {
+		if u.User != nil {
+			h := sha256.Sum256([]byte(u.User.String()))
+			redacted := *u
+			redacted.User = url.User(hex.EncodeToString(h[:]))
+			u = &redacted
+		}
+		s = append(s, u.String())
+	}
+	return strings.Join(s, " ")
+}
+
+// Set parses a proxy URL and appends it to the chain, so that a proxyChain can
+// be a repeatable command-line flag.
+func (chain *proxyChain) Set(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	*chain = append(*chain, u)
+	return nil
+}
+
+// Return the only proxy of a chain of length 1, or nil for an empty chain or
+// one of more than one proxy.
+func (chain proxyChain) single() *url.URL {
+	if len(chain) != 1 {
+		return nil
+	}
+	return chain[0]
+}
@@ -0,0 +1,191 @@
+// HTTP Digest authentication with proxies (RFC 7616).
+//
+// httpProxy sends Basic credentials with its first CONNECT request, so that a
+// proxy that wants Basic costs no extra round trip. If the proxy responds 407 with a Digest challenge, httpProxy answers the
+// challenge in a second CONNECT request, and stops sending Basic credentials
+// before being asked; otherwise, if the proxy offers Basic, httpProxy tries
+// Basic once more. Only the "auth" quality of protection is supported (not
+// "auth-int"), and the username is never hashed ("userhash").
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// The hash functions of Digest algorithms, by name. Names are matched
+// case-insensitively.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"MD5":     md5.New,
+	"SHA-256": sha256.New,
+}
+
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	// Whether the algorithm is a "-sess" variant.
+	sess bool
+	// Whether the challenge has a qop parameter that includes "auth". If
+	// false, the RFC 2069 form of the response is used.
+	qopAuth bool
+}
+
+// Parse the comma-separated parameters of an authentication challenge, each
+// of which is name=token or name="quoted string". Parameter names are
+// lowercased.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			return params
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+		var value strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			s = s[1:]
+			for len(s) > 0 && s[0] != '"' {
+				if s[0] == '\\' && len(s) > 1 {
+					s = s[1:]
+				}
+				value.WriteByte(s[0])
+				s = s[1:]
+			}
+			if len(s) > 0 {
+				// Skip the closing quote.
+				s = s[1:]
+			}
+		} else {
+			j := strings.IndexAny(s, ", \t")
+			if j < 0 {
+				j = len(s)
+			}
+			value.WriteString(s[:j])
+			s = s[j:]
+		}
+		params[name] = value.String()
+	}
+}
+
+// Find the best Digest challenge among the Proxy-Authenticate header fields of
+// a response, preferring SHA-256 to MD5. Returns nil if there is no Digest
+// challenge with a supported algorithm.
+func getDigestChallenge(header http.Header) *digestChallenge {
+	var best *digestChallenge
+	for _, value := range header[http.CanonicalHeaderKey("Proxy-Authenticate")] {
+		value = strings.TrimSpace(value)
+		i := strings.IndexAny(value, " \t")
+		if i < 0 || !strings.EqualFold(value[:i], "Digest") {
+			continue
+		}
+		params := parseAuthParams(value[i+1:])
+		c := &digestChallenge{
+			realm:     params["realm"],
+			nonce:     params["nonce"],
+			opaque:    params["opaque"],
+			algorithm: strings.ToUpper(params["algorithm"]),
+		}
+		if c.algorithm == "" {
+			c.algorithm = "MD5"
+		}
+		if strings.HasSuffix(c.algorithm, "-SESS") {
+			c.algorithm = strings.TrimSuffix(c.algorithm, "-SESS")
+			c.sess = true
+		}
+		if _, ok := digestAlgorithms[c.algorithm]; !ok || c.nonce == "" {
+			continue
+		}
+		for _, qop := range strings.Split(params["qop"], ",") {
+			if strings.TrimSpace(qop) == "auth" {
+				c.qopAuth = true
+			}
+		}
+		if best == nil || (best.algorithm == "MD5" && c.algorithm != "MD5") {
+			best = c
+		}
+	}
+	return best
+}
+
+// Whether any of the Proxy-Authenticate header fields of a response is a Basic
+// challenge.
+func hasBasicChallenge(header http.Header) bool {
+	for _, value := range header[http.CanonicalHeaderKey("Proxy-Authenticate")] {
+		fields := strings.Fields(value)
+		if len(fields) > 0 && strings.EqualFold(fields[0], "Basic") {
+			return true
+		}
+	}
+	return false
+}
+
+// Quote a string for use as a quoted-string parameter value.
+func quoteAuthParam(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// Return a random client nonce.
+func newDigestCnonce() (string, error) {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
+
+// Return a Proxy-Authorization value answering the challenge for a request
+// with the given method and URI, using client nonce cnonce and nonce count 1.
+func (c *digestChallenge) authorization(username, password, method, uri, cnonce string) string {
+	h := func(s string) string {
+		hash := digestAlgorithms[c.algorithm]()
+		hash.Write([]byte(s))
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+	const nc = "00000001"
+
+	ha1 := h(username + ":" + c.realm + ":" + password)
+	if c.sess {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	var response string
+	if c.qopAuth {
+		response = h(ha1 + ":" + c.nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+	} else {
+		response = h(ha1 + ":" + c.nonce + ":" + ha2)
+	}
+
+	algorithm := c.algorithm
+	if c.sess {
+		algorithm += "-sess"
+	}
+	params := []string{
+		"username=" + quoteAuthParam(username),
+		"realm=" + quoteAuthParam(c.realm),
+		"nonce=" + quoteAuthParam(c.nonce),
+		"uri=" + quoteAuthParam(uri),
+		"algorithm=" + algorithm,
+		"response=" + quoteAuthParam(response),
+	}
+	if c.qopAuth {
+		params = append(params, "qop=auth", "nc="+nc, "cnonce="+quoteAuthParam(cnonce))
+	}
+	if c.opaque != "" {
+		params = append(params, "opaque="+quoteAuthParam(c.opaque))
+	}
+	return fmt.Sprintf("Digest %s", strings.Join(params, ", "))
+}
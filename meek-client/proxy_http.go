@@ -2,69 +2,235 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"unicode"
 
 	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
 	"golang.org/x/net/proxy"
 )
 
 // https://tools.ietf.org/html/rfc7231#section-4.3.6
-// Conceivably we could also proxy over HTTP/2:
-// https://httpwg.org/specs/rfc7540.html#CONNECT
-// https://github.com/caddyserver/forwardproxy/blob/05b2092e07f9d10b3803d8fb9775d2f87dc58590/httpclient/httpclient.go
+// HTTPS proxies that negotiate h2 get HTTP/2 CONNECT instead; see
+// proxy_http2.go.
 
 type httpProxy struct {
 	network, addr string
 	auth          *proxy.Auth
 	forward       proxy.Dialer
+	// Extra header fields for CONNECT requests (--proxy-header).
+	header http.Header
+
+	// Protects skipBasic.
+	authLock sync.Mutex
+	// Whether the proxy has asked for Digest credentials, so that CONNECT
+	// requests should not send Basic credentials before being asked.
+	skipBasic bool
+
+	// For HTTPS proxies, the transport for HTTP/2 connections. nil for
+	// HTTP proxies.
+	h2Transport *http2.Transport
+	// Protects the fields below.
+	h2Lock sync.Mutex
+	// The HTTP/2 connection that tunnels share, if the proxy speaks
+	// HTTP/2.
+	h2Conn *http2.ClientConn
+	// Non-nil while a dial that may make a new h2Conn is in progress; it
+	// is closed when the dial finishes.
+	h2Dialing chan struct{}
+	// Set once the proxy has negotiated something other than h2, after
+	// which dials do not wait for each other.
+	noH2 bool
 }
 
 func (pr *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	return pr.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial, but aborts the connection to the proxy and the
+// CONNECT exchange if ctx is cancelled.
+func (pr *httpProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	header := pr.connectHeader()
+	conn, resp, err := pr.connect(ctx, addr, header)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the proxy asks for credentials, answer its challenge once:
+	// Digest if it offers Digest, otherwise Basic if it offers Basic. Basic
+	// is tried again even if it was just sent, in case the proxy refused
+	// it only for this connection.
+	if resp.StatusCode == http.StatusProxyAuthRequired && pr.auth != nil {
+		var authorization string
+		useBasic := false
+		if challenge := getDigestChallenge(resp.Header); challenge != nil {
+			cnonce, err := newDigestCnonce()
+			if err != nil {
+				return nil, err
+			}
+			authorization = challenge.authorization(pr.auth.User, pr.auth.Password, "CONNECT", addr, cnonce)
+			pr.setSkipBasic(true)
+		} else if hasBasicChallenge(resp.Header) {
+			authorization = pr.basicAuthorization()
+			useBasic = true
+		}
+		if authorization != "" {
+			header.Set("Proxy-Authorization", authorization)
+			conn, resp, err = pr.connect(ctx, addr, header)
+			if err != nil {
+				return nil, err
+			}
+			if resp.StatusCode == 200 && useBasic {
+				pr.setSkipBasic(false)
+			}
+		}
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, proxyError(resp)
+	}
+	return conn, nil
+}
+
+// Send a CONNECT request for addr, either on a new connection to the proxy or
+// as a new stream on a shared HTTP/2 connection. If the response status code
+// is 200, returns the tunnel. Otherwise, returns a nil net.Conn and a response
+// whose body contains at most the first maxProxyErrorBodyLength bytes of the
+// response body; the connection or stream has already been closed.
+func (pr *httpProxy) connect(ctx context.Context, addr string, header http.Header) (net.Conn, *http.Response, error) {
+	conn, cc, err := pr.proxyConn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cc != nil {
+		return pr.connectHTTP2(ctx, cc, addr, header)
+	}
+
 	connectReq := &http.Request{
 		Method: "CONNECT",
 		URL:    &url.URL{Opaque: addr},
 		Host:   addr,
-		Header: make(http.Header),
-	}
-	// http.Transport has a ProxyConnectHeader field that we are ignoring
-	// here.
-	if pr.auth != nil {
-		connectReq.Header.Set("Proxy-Authorization", "basic "+
-			base64.StdEncoding.EncodeToString([]byte(pr.auth.User+":"+pr.auth.Password)))
+		Header: header,
 	}
 
-	conn, err := pr.forward.Dial(pr.network, pr.addr)
-	if err != nil {
-		return nil, err
-	}
+	// Close the connection if ctx is cancelled during the CONNECT
+	// exchange.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
 
 	err = connectReq.Write(conn)
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	// The Go stdlib says: "Okay to use and discard buffered reader here,
-	// because TLS server will not speak until spoken to."
 	br := bufio.NewReader(conn)
 	resp, err := http.ReadResponse(br, connectReq)
-	if br.Buffered() != 0 {
-		panic(br.Buffered())
-	}
 	if err != nil {
 		conn.Close()
-		return nil, err
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, err
 	}
 	if resp.StatusCode != 200 {
+		readErrorBody(resp)
 		conn.Close()
-		return nil, fmt.Errorf("proxy server returned %q", resp.Status)
+		return nil, resp, nil
+	}
+	// A TLS server will not speak until spoken to, but the destination may
+	// send early data, or the proxy may send extra bytes after the
+	// response. br may already have read some of them from conn, so read
+	// them from br before reading from conn.
+	if br.Buffered() != 0 {
+		conn = &bufferedConn{Conn: conn, br: br}
 	}
 
-	return conn, nil
+	return conn, resp, nil
+}
+
+// A net.Conn whose reads come from a bufio.Reader that wraps the underlying
+// connection, so that bytes already buffered in the bufio.Reader are not lost.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// Return the header fields for a CONNECT request. Basic credentials are
+// included, if there are any, unless the proxy has asked for Digest.
+func (pr *httpProxy) connectHeader() http.Header {
+	header := make(http.Header)
+	for key, values := range pr.header {
+		header[key] = append([]string(nil), values...)
+	}
+	pr.authLock.Lock()
+	skipBasic := pr.skipBasic
+	pr.authLock.Unlock()
+	if pr.auth != nil && !skipBasic {
+		header.Set("Proxy-Authorization", pr.basicAuthorization())
+	}
+	return header
+}
+
+// Return a Proxy-Authorization value with Basic credentials.
+func (pr *httpProxy) basicAuthorization() string {
+	return "basic " + base64.StdEncoding.EncodeToString([]byte(pr.auth.User+":"+pr.auth.Password))
+}
+
+func (pr *httpProxy) setSkipBasic(skipBasic bool) {
+	pr.authLock.Lock()
+	pr.skipBasic = skipBasic
+	pr.authLock.Unlock()
+}
+
+// The most of an unsuccessful response's body that we will read, to show in
+// an error message.
+const maxProxyErrorBodyLength = 1024
+
+// Replace the body of an unsuccessful CONNECT response with the first
+// maxProxyErrorBodyLength bytes of it, and close the original body.
+func readErrorBody(resp *http.Response) {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxProxyErrorBodyLength))
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+}
+
+// Make an error for an unsuccessful CONNECT response (after readErrorBody),
+// including the start of the body, which often says what the problem is.
+func proxyError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	// Keep only printable characters, and collapse whitespace.
+	text := strings.Join(strings.Fields(strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return r
+		}
+		return -1
+	}, string(body))), " ")
+	if text == "" {
+		return fmt.Errorf("proxy server returned %q", resp.Status)
+	}
+	return fmt.Errorf("proxy server returned %q: %s", resp.Status, text)
 }
 
 func ProxyHTTP(network, addr string, auth *proxy.Auth, forward proxy.Dialer) (*httpProxy, error) {
@@ -83,7 +249,26 @@ type UTLSDialer struct {
 }
 
 func (dialer *UTLSDialer) Dial(network, addr string) (net.Conn, error) {
-	return dialUTLS(network, addr, dialer.config, dialer.clientHelloID, dialer.forward)
+	return dialer.DialContext(context.Background(), network, addr)
+}
+
+func (dialer *UTLSDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	cfg := dialer.config
+	if cfg == nil || cfg.ServerName == "" {
+		// dialUTLS leaves no ServerName for a proxy whose address is an
+		// IP address, and then there would be nothing to verify the
+		// certificate against. Verify it against the address.
+		if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host) != nil {
+			if cfg == nil {
+				cfg = &utls.Config{}
+			} else {
+				cfg = cfg.Clone()
+			}
+			cfg.ServerName = host
+		}
+	}
+	// Pins apply only to the front, not to the proxy.
+	return dialUTLS(ctx, network, addr, cfg, dialer.clientHelloID, dialer.forward, nil)
 }
 
 func ProxyHTTPS(network, addr string, auth *proxy.Auth, forward proxy.Dialer, cfg *utls.Config, clientHelloID *utls.ClientHelloID) (*httpProxy, error) {
@@ -99,5 +284,6 @@ func ProxyHTTPS(network, addr string, auth *proxy.Auth, forward proxy.Dialer, cf
 			clientHelloID: clientHelloID,
 			forward:       forward,
 		},
+		h2Transport: newProxyHTTP2Transport(clientHelloID),
 	}, nil
 }
@@ -0,0 +1,190 @@
+// Tunnels through an HTTPS proxy using HTTP/2 CONNECT.
+//
+// https://httpwg.org/specs/rfc7540.html#CONNECT
+//
+// When the TLS connection to an HTTPS proxy negotiates h2 (as it will with
+// most uTLS fingerprints, which offer h2 the way browsers do), httpProxy
+// sends CONNECT requests as HTTP/2 streams instead of HTTP/1.1 requests. All
+// tunnels through the proxy are then multiplexed over one TLS connection, as
+// a browser's would be. The HTTP/2 connection imitates the fingerprint's
+// HTTP/2 profile, if it has one (see h2fingerprint.go).
+//
+// HTTP/3 proxies (RFC 9298 and RFC 9114 CONNECT) are not supported.
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// Make the http2.Transport that manages HTTP/2 connections to an HTTPS proxy.
+// The transport does not dial; httpProxy makes connections and passes them to
+// NewClientConn.
+func newProxyHTTP2Transport(clientHelloID *utls.ClientHelloID) *http2.Transport {
+	tr := &http2.Transport{
+		IdleConnTimeout: httpRoundTripper.IdleConnTimeout,
+		ReadIdleTimeout: options.H2ReadIdleTimeout,
+		PingTimeout:     options.H2PingTimeout,
+	}
+	if fp := http2FingerprintForID(clientHelloID); fp != nil {
+		fp.configureTransport(tr)
+	}
+	return tr
+}
+
+// Return a connection to the proxy, or an HTTP/2 connection to the proxy that
+// can take another CONNECT request. Exactly one of the return values other
+// than the error is non-nil.
+//
+// Only one dial at a time may make a new HTTP/2 connection, so that concurrent
+// tunnels share one connection rather than each making their own. The others
+// wait for it without holding h2Lock, and give up if their ctx is cancelled.
+func (pr *httpProxy) proxyConn(ctx context.Context) (net.Conn, *http2.ClientConn, error) {
+	for {
+		pr.h2Lock.Lock()
+		if pr.h2Conn != nil && pr.h2Conn.CanTakeNewRequest() {
+			cc := pr.h2Conn
+			pr.h2Lock.Unlock()
+			return nil, cc, nil
+		}
+		pr.h2Conn = nil
+		if pr.h2Dialing == nil || pr.noH2 {
+			break
+		}
+		dialing := pr.h2Dialing
+		pr.h2Lock.Unlock()
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+	// We are the one to dial; h2Lock is still held.
+	dialing := make(chan struct{})
+	noH2 := pr.noH2
+	if !noH2 {
+		pr.h2Dialing = dialing
+	}
+	pr.h2Lock.Unlock()
+
+	conn, cc, err := pr.dialProxyConn(ctx)
+
+	if !noH2 {
+		pr.h2Lock.Lock()
+		if cc != nil {
+			pr.h2Conn = cc
+		} else if conn != nil {
+			// The proxy does not speak HTTP/2, so there is no
+			// connection to share, and no reason for later dials
+			// to wait for each other.
+			pr.noH2 = true
+		}
+		pr.h2Dialing = nil
+		pr.h2Lock.Unlock()
+		close(dialing)
+	}
+	return conn, cc, err
+}
+
+// Dial the proxy, and if it negotiates h2, start an HTTP/2 connection on it.
+func (pr *httpProxy) dialProxyConn(ctx context.Context) (net.Conn, *http2.ClientConn, error) {
+	conn, err := dialContext(ctx, pr.forward, pr.network, pr.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	uconn, ok := conn.(*utls.UConn)
+	if !ok || pr.h2Transport == nil || uconn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		return conn, nil, nil
+	}
+	if fp := http2FingerprintForID(&uconn.ClientHelloID); fp != nil {
+		conn = newHTTP2FingerprintConn(conn, fp)
+	}
+	cc, err := pr.h2Transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return nil, cc, nil
+}
+
+// Send a CONNECT request for addr on cc, as for httpProxy.connect.
+func (pr *httpProxy) connectHTTP2(ctx context.Context, cc *http2.ClientConn, addr string, header http.Header) (net.Conn, *http.Response, error) {
+	pipeReader, pipeWriter := io.Pipe()
+	connectReq := &http.Request{
+		Method:        "CONNECT",
+		URL:           &url.URL{Host: addr},
+		Host:          addr,
+		Header:        header,
+		Body:          pipeReader,
+		ContentLength: -1,
+	}
+
+	// The request's context governs the whole stream, not only the
+	// CONNECT exchange, so we do not give it ctx. Instead, we abandon the
+	// request if ctx is cancelled before the response arrives.
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := cc.RoundTrip(connectReq)
+		ch <- result{resp, err}
+	}()
+	var resp *http.Response
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			pipeWriter.Close()
+			return nil, nil, r.err
+		}
+		resp = r.resp
+	case <-ctx.Done():
+		// Closing the request body resets the stream.
+		pipeWriter.CloseWithError(ctx.Err())
+		go func() {
+			if r := <-ch; r.err == nil {
+				r.resp.Body.Close()
+			}
+		}()
+		return nil, nil, ctx.Err()
+	}
+
+	if resp.StatusCode != 200 {
+		// Do not wait forever for the body if ctx is cancelled.
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				resp.Body.Close()
+			case <-done:
+			}
+		}()
+		readErrorBody(resp)
+		close(done)
+		pipeWriter.Close()
+		return nil, resp, nil
+	}
+	// Connect the stream to one end of a net.Pipe, and return the other
+	// end, which (unlike the request and response bodies) supports
+	// deadlines.
+	local, remote := net.Pipe()
+	go func() {
+		io.Copy(pipeWriter, remote)
+		// local was closed. Closing the request body ends our side
+		// of the stream, and closing the response body resets it.
+		pipeWriter.Close()
+		resp.Body.Close()
+	}()
+	go func() {
+		io.Copy(remote, resp.Body)
+		remote.Close()
+	}()
+	return local, resp, nil
+}
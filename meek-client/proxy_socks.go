@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/proxy"
+)
+
+// SOCKS4a client.
+// https://www.openssh.com/txt/socks4.protocol
+// https://www.openssh.com/txt/socks4a.protocol
+//
+// SOCKS4a has no authentication other than a user ID, which is taken from the
+// username of the proxy URL.
+
+type socks4aProxy struct {
+	network, addr string
+	userID        string
+	forward       proxy.Dialer
+}
+
+// SOCKS4 reply codes.
+var socks4Replies = map[byte]string{
+	90: "request granted",
+	91: "request rejected or failed",
+	92: "request rejected because SOCKS server cannot connect to identd on the client",
+	93: "request rejected because the client program and identd report different user-ids",
+}
+
+func (pr *socks4aProxy) Dial(network, addr string) (net.Conn, error) {
+	return pr.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial, but aborts the connection to the proxy and the
+// SOCKS exchange if ctx is cancelled.
+func (pr *socks4aProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port %q", portStr)
+	}
+
+	req := []byte{4, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[2:4], uint16(port))
+	if ip := net.ParseIP(host); ip != nil {
+		// An IPv4 address goes in the request as in SOCKS4.
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil, fmt.Errorf("SOCKS4a cannot connect to IPv6 address %s", host)
+		}
+		req = append(req, ip4...)
+		req = append(req, pr.userID...)
+		req = append(req, 0)
+	} else {
+		// A name goes after the user ID, and the address is 0.0.0.x
+		// for nonzero x, which asks the proxy to resolve the name.
+		if host == "" || strings.IndexByte(host, 0) >= 0 {
+			return nil, fmt.Errorf("bad host name %q", host)
+		}
+		req = append(req, 0, 0, 0, 1)
+		req = append(req, pr.userID...)
+		req = append(req, 0)
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+
+	conn, err := dialContext(ctx, pr.forward, pr.network, pr.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Close the connection if ctx is cancelled during the SOCKS exchange.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	_, err = conn.Write(req)
+	if err == nil {
+		var resp [8]byte
+		_, err = io.ReadFull(conn, resp[:])
+		if err == nil && resp[0] != 0 {
+			err = fmt.Errorf("SOCKS4a reply has version %d", resp[0])
+		} else if err == nil && resp[1] != 90 {
+			msg, ok := socks4Replies[resp[1]]
+			if !ok {
+				msg = fmt.Sprintf("unknown reply code %d", resp[1])
+			}
+			err = errors.New("SOCKS4a proxy: " + msg)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func ProxySOCKS4a(network, addr string, auth *proxy.Auth, forward proxy.Dialer) (*socks4aProxy, error) {
+	pr := &socks4aProxy{
+		network: network,
+		addr:    addr,
+		forward: forward,
+	}
+	if auth != nil {
+		if auth.Password != "" {
+			return nil, errors.New("SOCKS4a proxies do not support passwords")
+		}
+		if strings.IndexByte(auth.User, 0) >= 0 {
+			return nil, errors.New("bad SOCKS4a user ID")
+		}
+		pr.userID = auth.User
+	}
+	return pr, nil
+}
+
+// Return the username and password of a proxy URL, or nil if it has none.
+func proxyAuth(proxyURL *url.URL) *proxy.Auth {
+	userpass := proxyURL.User
+	if userpass == nil {
+		return nil
+	}
+	auth := &proxy.Auth{
+		User: userpass.Username(),
+	}
+	if password, ok := userpass.Password(); ok {
+		auth.Password = password
+	}
+	return auth
+}
+
+// The dialer that http.DefaultTransport uses.
+func newNetDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// net/http handles a single http, https, or socks5 proxy itself. It does not
+// support socks4a at all, supports socks5h only in recent versions of Go, and
+// does not support chains of proxies, so in those cases we dial through the
+// proxies ourselves, using the dialers that uTLS uses, with Go's own TLS
+// fingerprint for any https proxies. Either way, names are resolved by the
+// (last) proxy: socks5 and socks5h differ only in the scheme.
+//
+// Return a dialer that connects through proxies, if net/http cannot handle
+// them itself; otherwise return nil. cfg configures TLS with https proxies,
+// and may be nil.
+func makeNativeProxyDialer(proxies proxyChain, forward proxy.Dialer, cfg *utls.Config) (proxy.Dialer, error) {
+	if len(proxies) == 0 {
+		return nil, nil
+	}
+	if len(proxies) == 1 {
+		switch proxies[0].Scheme {
+		case "socks4a", "socks5h":
+		default:
+			return nil, nil
+		}
+	}
+	return makeProxyDialer(proxies, forward, cfg, &utls.HelloGolang)
+}
+
+// Configure tr to use proxies, which may be empty.
+func setTransportProxy(tr *http.Transport, proxies proxyChain) error {
+	dialer, err := makeNativeProxyDialer(proxies, newNetDialer(), nil)
+	if err != nil {
+		return err
+	}
+	if dialer == nil {
+		tr.Proxy = http.ProxyURL(proxies.single())
+		return nil
+	}
+	tr.Proxy = nil
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialContext(ctx, dialer, network, addr)
+	}
+	return nil
+}
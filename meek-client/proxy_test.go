@@ -2,21 +2,29 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
 	"golang.org/x/net/proxy"
 )
 
@@ -140,39 +148,89 @@ func TestProxyHTTPCONNECT(t *testing.T) {
 	}
 }
 
-// Test that the HTTP proxy client sends authorization credentials.
-func TestProxyHTTPProxyAuthorization(t *testing.T) {
-	auth := &proxy.Auth{
-		User:     testUsername,
-		Password: testPassword,
-	}
-	req, err := requestResultingFromDialHTTP(t, func(addr net.Addr) (*httpProxy, error) {
-		return ProxyHTTP("tcp", addr.String(), auth, proxy.Direct)
-	}, "tcp", testAddr)
-	if err != nil {
-		panic(err)
-	}
-	pa := req.Header.Get("Proxy-Authorization")
-	if pa == "" {
-		t.Fatalf("didn't get a Proxy-Authorization header")
+// A proxy handler that requires Basic authentication, and records the
+// requests it gets. It does not actually connect anywhere.
+type basicProxy struct {
+	lock     sync.Mutex
+	requests []*http.Request
+	// Refuse this many more requests even with the right credentials.
+	refuse int
+}
+
+func (p *basicProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.lock.Lock()
+	p.requests = append(p.requests, req)
+	refuse := p.refuse > 0
+	if refuse {
+		p.refuse--
 	}
+	p.lock.Unlock()
+
 	// The standard library Request.BasicAuth does parsing of basic
 	// authentication, but only in the Authorization header, not
 	// Proxy-Authorization.
-	newReq := &http.Request{
+	authReq := &http.Request{
 		Header: http.Header{
-			"Authorization": []string{pa},
+			"Authorization": req.Header["Proxy-Authorization"],
 		},
 	}
-	username, password, ok := newReq.BasicAuth()
-	if !ok {
-		panic("shouldn't fail")
+	username, password, ok := authReq.BasicAuth()
+	if refuse || !ok || username != testUsername || password != testPassword {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	conn, bufrw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	bufrw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	bufrw.Flush()
+}
+
+// Test that the HTTP proxy client sends Basic credentials with its first
+// CONNECT request, and tries them once more if the proxy refuses them.
+func TestProxyHTTPProxyAuthorization(t *testing.T) {
+	p := &basicProxy{}
+	server := httptest.NewServer(p)
+	defer server.Close()
+	auth := &proxy.Auth{
+		User:     testUsername,
+		Password: testPassword,
 	}
-	if username != testUsername {
-		t.Errorf("expected username %q, got %q", testUsername, username)
+	pr, err := ProxyHTTP("tcp", server.Listener.Addr().String(), auth, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if password != testPassword {
-		t.Errorf("expected password %q, got %q", testPassword, password)
+	for i, refuse := range []int{0, 1, 2, 0} {
+		p.lock.Lock()
+		p.refuse = refuse
+		p.lock.Unlock()
+		conn, err := pr.Dial("tcp", testAddr)
+		if refuse > 1 {
+			// Refused again after the retry.
+			if err == nil {
+				conn.Close()
+				t.Errorf("dial %d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		conn.Close()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.requests) != 1+2+2+1 {
+		t.Fatalf("%d requests, expected %d", len(p.requests), 1+2+2+1)
+	}
+	for i, req := range p.requests {
+		if pa := req.Header.Get("Proxy-Authorization"); !strings.HasPrefix(pa, "basic ") {
+			t.Errorf("request %d: Proxy-Authorization %q", i, pa)
+		}
 	}
 }
 
@@ -241,3 +299,475 @@ func TestProxyHTTPSCONNECT(t *testing.T) {
 		t.Errorf("expected %q, got %q", "Host: "+req.Host, "Host: "+testAddr)
 	}
 }
+
+// An HTTPS proxy that handles HTTP/2 CONNECT requests, and counts the
+// connections made to it.
+type http2ConnectProxy struct {
+	*httptest.Server
+	lock     sync.Mutex
+	numConns int
+}
+
+func newHTTP2ConnectProxy() *http2ConnectProxy {
+	p := &http2ConnectProxy{}
+	p.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" || req.ProtoMajor != 2 {
+			http.Error(w, "HTTP/2 CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		conn, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer conn.Close()
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		go io.Copy(conn, req.Body)
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	p.Server.EnableHTTP2 = true
+	p.Server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			p.lock.Lock()
+			p.numConns++
+			p.lock.Unlock()
+		}
+	}
+	p.Server.StartTLS()
+	return p
+}
+
+// Test that tunnels through an HTTPS proxy that negotiates h2 use HTTP/2
+// CONNECT, and share one connection.
+func TestProxyHTTPSHTTP2CONNECT(t *testing.T) {
+	p := newHTTP2ConnectProxy()
+	defer p.Close()
+
+	// An echo server to tunnel to.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// The proxy's certificate is valid for example.com.
+	pr, err := ProxyHTTPS("tcp", p.Listener.Addr().String(), nil, proxy.Direct, &utls.Config{InsecureSkipVerify: true, ServerName: "example.com"}, &utls.HelloChrome_Auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const numTunnels = 3
+	var wg sync.WaitGroup
+	for i := 0; i < numTunnels; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := pr.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			msg := fmt.Sprintf("tunnel %d", i)
+			_, err = conn.Write([]byte(msg))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(conn, buf)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(buf) != msg {
+				t.Errorf("expected %q, got %q", msg, buf)
+			}
+
+			// Deadlines work.
+			conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			_, err = conn.Read(buf)
+			if err, ok := err.(net.Error); !ok || !err.Timeout() {
+				t.Errorf("expected timeout, got %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	p.lock.Lock()
+	numConns := p.numConns
+	p.lock.Unlock()
+	if numConns != 1 {
+		t.Errorf("%d connections to the proxy, expected 1", numConns)
+	}
+
+	// A CONNECT that the proxy refuses.
+	_, err = pr.Dial("tcp", "127.0.0.1:0")
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("expected status 502, got %v", err)
+	}
+}
+
+// A proxy.Dialer whose dials wait until release is closed.
+type blockingDialer struct {
+	release chan struct{}
+}
+
+func (d *blockingDialer) Dial(network, addr string) (net.Conn, error) {
+	<-d.release
+	return net.Dial(network, addr)
+}
+
+// Test that a dial to an HTTP/2 proxy does not hold up others while it is in
+// progress: they wait for it without the lock, and can be cancelled.
+func TestProxyHTTPSHTTP2DialWait(t *testing.T) {
+	p := newHTTP2ConnectProxy()
+	defer p.Close()
+
+	forward := &blockingDialer{release: make(chan struct{})}
+	pr, err := ProxyHTTPS("tcp", p.Listener.Addr().String(), nil, forward, &utls.Config{InsecureSkipVerify: true, ServerName: "example.com"}, &utls.HelloChrome_Auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		cc  *http2.ClientConn
+		err error
+	}
+	ch := make(chan result)
+	go func() {
+		_, cc, err := pr.proxyConn(context.Background())
+		ch <- result{cc, err}
+	}()
+	for {
+		pr.h2Lock.Lock()
+		dialing := pr.h2Dialing != nil
+		pr.h2Lock.Unlock()
+		if dialing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = pr.proxyConn(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if !pr.h2Lock.TryLock() {
+		t.Fatalf("lock is held during dial")
+	}
+	pr.h2Lock.Unlock()
+
+	close(forward.release)
+	r := <-ch
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	_, cc, err := pr.proxyConn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc != r.cc {
+		t.Errorf("second dial did not share the HTTP/2 connection")
+	}
+	cc.Close()
+}
+
+// Test Digest responses against the examples in RFC 7616 section 3.9.1.
+func TestDigestAuthorization(t *testing.T) {
+	for _, test := range []struct {
+		algorithm string
+		response  string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	} {
+		header := make(http.Header)
+		header.Add("Proxy-Authenticate", `Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=`+test.algorithm+`, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`)
+		c := getDigestChallenge(header)
+		if c == nil {
+			t.Fatalf("%s: no challenge", test.algorithm)
+		}
+		auth := c.authorization("Mufasa", "Circle of Life", "GET", "/dir/index.html", "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ")
+		if !strings.HasPrefix(auth, "Digest ") {
+			t.Fatalf("%s: bad authorization %q", test.algorithm, auth)
+		}
+		params := parseAuthParams(strings.TrimPrefix(auth, "Digest "))
+		for name, expected := range map[string]string{
+			"username":  "Mufasa",
+			"realm":     "http-auth@example.org",
+			"uri":       "/dir/index.html",
+			"algorithm": test.algorithm,
+			"qop":       "auth",
+			"nc":        "00000001",
+			"cnonce":    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+			"opaque":    "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+			"response":  test.response,
+		} {
+			if params[name] != expected {
+				t.Errorf("%s: %s=%q, expected %q", test.algorithm, name, params[name], expected)
+			}
+		}
+	}
+}
+
+func TestGetDigestChallenge(t *testing.T) {
+	for _, test := range []struct {
+		values    []string
+		algorithm string
+	}{
+		{[]string{`Basic realm="proxy"`}, ""},
+		{[]string{`Digest realm="proxy", algorithm=UNKNOWN, nonce="n"`}, ""},
+		// No nonce.
+		{[]string{`Digest realm="proxy"`}, ""},
+		{[]string{`Basic realm="proxy"`, `digest realm="proxy", nonce="n"`}, "MD5"},
+		{[]string{`Digest realm="proxy", nonce="n", algorithm=MD5`, `Digest realm="proxy", nonce="n", algorithm=SHA-256`}, "SHA-256"},
+		{[]string{`Digest realm="proxy", nonce="n", algorithm=SHA-256`, `Digest realm="proxy", nonce="n", algorithm=MD5`}, "SHA-256"},
+	} {
+		header := http.Header{"Proxy-Authenticate": test.values}
+		c := getDigestChallenge(header)
+		var algorithm string
+		if c != nil {
+			algorithm = c.algorithm
+		}
+		if algorithm != test.algorithm {
+			t.Errorf("%q: got algorithm %q, expected %q", test.values, algorithm, test.algorithm)
+		}
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	params := parseAuthParams(`realm="a \"quoted\" realm",nonce=abc ,  qop="auth,auth-int", Stale=FALSE`)
+	for name, expected := range map[string]string{
+		"realm": `a "quoted" realm`,
+		"nonce": "abc",
+		"qop":   "auth,auth-int",
+		"stale": "FALSE",
+	} {
+		if params[name] != expected {
+			t.Errorf("%s=%q, expected %q", name, params[name], expected)
+		}
+	}
+}
+
+// A proxy handler that requires Digest authentication, and records the
+// requests it gets. It does not actually connect anywhere.
+type digestProxy struct {
+	lock     sync.Mutex
+	requests []*http.Request
+}
+
+func (p *digestProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.lock.Lock()
+	p.requests = append(p.requests, req)
+	p.lock.Unlock()
+
+	const nonce = "testnonce"
+	pa := req.Header.Get("Proxy-Authorization")
+	ok := false
+	if strings.HasPrefix(pa, "Digest ") {
+		params := parseAuthParams(strings.TrimPrefix(pa, "Digest "))
+		h := func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}
+		ha1 := h(testUsername + ":proxy:" + testPassword)
+		ha2 := h("CONNECT:" + params["uri"])
+		expected := h(ha1 + ":" + nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+		ok = params["response"] == expected && params["uri"] == req.Host && params["nonce"] == nonce
+	}
+	if !ok {
+		w.Header().Add("Proxy-Authenticate", `Basic realm="proxy"`)
+		w.Header().Add("Proxy-Authenticate", `Digest realm="proxy", qop="auth", algorithm=SHA-256, nonce="`+nonce+`"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		w.Write([]byte("<html><body>\nAuthentication required\n</body></html>\n"))
+		return
+	}
+	if req.ProtoMajor == 2 {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		return
+	}
+	conn, bufrw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	bufrw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	bufrw.Flush()
+}
+
+// Test Digest authentication and extra header fields, with HTTP/1.1 and
+// HTTP/2 proxies.
+func TestProxyHTTPDigest(t *testing.T) {
+	auth := &proxy.Auth{User: testUsername, Password: testPassword}
+	header := http.Header{"User-Agent": []string{"test-agent"}}
+
+	for _, test := range []struct {
+		name      string
+		makeProxy func(addr string) (*httpProxy, error)
+		tls       bool
+	}{
+		{"HTTP/1.1", func(addr string) (*httpProxy, error) {
+			return ProxyHTTP("tcp", addr, auth, proxy.Direct)
+		}, false},
+		{"HTTP/2", func(addr string) (*httpProxy, error) {
+			return ProxyHTTPS("tcp", addr, auth, proxy.Direct, &utls.Config{InsecureSkipVerify: true, ServerName: "example.com"}, &utls.HelloChrome_Auto)
+		}, true},
+	} {
+		p := &digestProxy{}
+		server := httptest.NewUnstartedServer(p)
+		if test.tls {
+			server.EnableHTTP2 = true
+			server.StartTLS()
+		} else {
+			server.Start()
+		}
+		pr, err := test.makeProxy(server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pr.header = header
+		for i := 0; i < 2; i++ {
+			conn, err := pr.Dial("tcp", testAddr)
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			} else {
+				conn.Close()
+			}
+		}
+		server.Close()
+
+		if len(p.requests) != 4 {
+			t.Errorf("%s: %d requests, expected 4", test.name, len(p.requests))
+			continue
+		}
+		// Basic credentials go with the first request, before the
+		// proxy has said what it wants.
+		if pa := p.requests[0].Header.Get("Proxy-Authorization"); !strings.HasPrefix(pa, "basic ") {
+			t.Errorf("%s: first request had Proxy-Authorization %q", test.name, pa)
+		}
+		// Digest is preferred to Basic.
+		if pa := p.requests[1].Header.Get("Proxy-Authorization"); !strings.HasPrefix(pa, "Digest ") {
+			t.Errorf("%s: second request had Proxy-Authorization %q", test.name, pa)
+		}
+		// Once the proxy has asked for Digest, Basic credentials are
+		// no longer sent unasked.
+		if pa := p.requests[2].Header.Get("Proxy-Authorization"); pa != "" {
+			t.Errorf("%s: third request had Proxy-Authorization %q", test.name, pa)
+		}
+		if pa := p.requests[3].Header.Get("Proxy-Authorization"); !strings.HasPrefix(pa, "Digest ") {
+			t.Errorf("%s: fourth request had Proxy-Authorization %q", test.name, pa)
+		}
+		for _, req := range p.requests {
+			if ua := req.Header.Get("User-Agent"); ua != "test-agent" {
+				t.Errorf("%s: User-Agent %q", test.name, ua)
+			}
+		}
+	}
+}
+
+// Test that the error for a refused CONNECT includes the response body.
+func TestProxyHTTPErrorBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "Access denied\tby \x00policy", http.StatusForbidden)
+	}))
+	defer server.Close()
+	pr, err := ProxyHTTP("tcp", server.Listener.Addr().String(), nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pr.Dial("tcp", testAddr)
+	expected := `proxy server returned "403 Forbidden": Access denied by policy`
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+// Test that data that the proxy sends right after the CONNECT response (here,
+// in the same write) reaches the caller, rather than being lost in a buffer or
+// crashing meek-client.
+func TestProxyHTTPEarlyData(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				_, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n" +
+					"Connection: keep-alive\r\n" +
+					"Proxy-Connection: keep-alive\r\n" +
+					"Content-Length: 0\r\n" +
+					"\r\n" +
+					"early"))
+				if err != nil {
+					return
+				}
+				// Echo the rest.
+				io.Copy(conn, br)
+			}()
+		}
+	}()
+
+	pr, err := ProxyHTTP("tcp", ln.Addr().String(), nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := pr.Dial("tcp", testAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf [5]byte
+		_, err = io.ReadFull(conn, buf[:])
+		if err != nil || string(buf[:]) != "early" {
+			t.Errorf("expected %q, got %q, %v", "early", buf[:], err)
+		}
+		_, err = conn.Write([]byte("hello"))
+		if err == nil {
+			_, err = io.ReadFull(conn, buf[:])
+		}
+		if err != nil || string(buf[:]) != "hello" {
+			t.Errorf("expected %q, got %q, %v", "hello", buf[:], err)
+		}
+		conn.Close()
+	}
+}
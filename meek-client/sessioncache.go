@@ -0,0 +1,356 @@
+// A TLS session cache for uTLS connections.
+//
+// Browsers resume TLS sessions when they reconnect to a server they have
+// recently talked to, which saves a round trip and makes a reconnection look
+// different from a first connection. uTLS connections (including those to an
+// HTTPS proxy) use utlsSessionCache to do the same. Sessions are indexed by
+// server name, which with domain fronting is the front domain, and by the trust
+// settings (ca-file= and pin=) of the connection. A resumed session skips
+// certificate verification, so a session must be resumed only by connections
+// that would have accepted the certificates of the handshake that created it.
+//
+// Only TLS 1.2 sessions, which are resumed through the session_ticket
+// extension, are cached. uTLS resumes TLS 1.3 sessions only with the few
+// fingerprints that have a pre_shared_key extension, and the saved form of a
+// session (savedSession) holds only what TLS 1.2 resumption needs.
+//
+// The cache may optionally be saved to a file (in the pluggable transport
+// state directory), so that sessions survive a restart. Changes are saved in
+// the background, at most once per sessionCacheSaveDelay, so that a handshake
+// never waits for a file write. Saved server certificates are verified again,
+// against the roots of the connection that first asks for them, and sessions
+// that no longer verify are discarded.
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+const (
+	// Maximum number of sessions to remember.
+	sessionCacheCapacity = 64
+	// Sessions older than this are not resumed. Servers commonly rotate
+	// their ticket keys at least daily.
+	sessionCacheMaxAge = 24 * time.Hour
+	// Name of the file in the state directory that holds saved sessions.
+	sessionCacheFilename = "meek-client-tls-sessions.json"
+	// How long after a change to wait before saving the cache, so that a
+	// burst of new sessions causes only one write.
+	sessionCacheSaveDelay = 5 * time.Second
+	// Separates the trust scope from the server name in cache keys.
+	sessionScopeSeparator = "|"
+)
+
+// The cache used by all uTLS connections.
+var utlsSessionCache = newSessionCache(sessionCacheCapacity)
+
+type sessionCacheEntry struct {
+	// nil for a session loaded from a file and not yet verified.
+	state *utls.ClientSessionState
+	// The saved form of a session whose state is nil.
+	saved *savedSession
+	added time.Time
+}
+
+// sessionCache implements utls.ClientSessionCache.
+type sessionCache struct {
+	lock     sync.Mutex
+	entries  map[string]sessionCacheEntry
+	capacity int
+	// If not empty, the cache is saved to this file after changes.
+	filename string
+	// Non-nil while a save is scheduled.
+	saveTimer *time.Timer
+
+	// saveLock serializes writes to filename. It is acquired before lock,
+	// never while holding it.
+	saveLock sync.Mutex
+}
+
+func newSessionCache(capacity int) *sessionCache {
+	return &sessionCache{
+		entries:  make(map[string]sessionCacheEntry),
+		capacity: capacity,
+	}
+}
+
+// A view of a sessionCache for connections with the same trust settings. It
+// prefixes session keys with a scope that identifies the settings, and
+// verifies sessions loaded from a file against the settings' roots.
+type scopedSessionCache struct {
+	cache *sessionCache
+	scope string
+	roots *x509.CertPool
+}
+
+// Return a view of c for connections whose trust settings are identified by
+// trustKey, and that verify certificates against roots (nil means the system
+// roots).
+func (c *sessionCache) scoped(trustKey string, roots *x509.CertPool) *scopedSessionCache {
+	// Hash the settings, so that file names in them are not saved.
+	h := sha256.Sum256([]byte(trustKey))
+	return &scopedSessionCache{
+		cache: c,
+		scope: hex.EncodeToString(h[:16]),
+		roots: roots,
+	}
+}
+
+// Get is part of the utls.ClientSessionCache interface.
+func (sc *scopedSessionCache) Get(sessionKey string) (*utls.ClientSessionState, bool) {
+	return sc.cache.get(sc.scope+sessionScopeSeparator+sessionKey, sc.roots)
+}
+
+// Put is part of the utls.ClientSessionCache interface.
+func (sc *scopedSessionCache) Put(sessionKey string, cs *utls.ClientSessionState) {
+	sc.cache.Put(sc.scope+sessionScopeSeparator+sessionKey, cs)
+}
+
+// Get is part of the utls.ClientSessionCache interface. Sessions loaded from a
+// file are verified against the system roots.
+func (c *sessionCache) Get(sessionKey string) (*utls.ClientSessionState, bool) {
+	return c.get(sessionKey, nil)
+}
+
+// Look up a session. If it was loaded from a file and has not been used since,
+// verify its certificates against roots first, and discard it if they do not
+// verify.
+func (c *sessionCache) get(sessionKey string, roots *x509.CertPool) (*utls.ClientSessionState, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[sessionKey]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(entry.added) > sessionCacheMaxAge {
+		delete(c.entries, sessionKey)
+		return nil, false
+	}
+	if entry.state == nil {
+		state, err := loadSavedSession(serverNameFromSessionKey(sessionKey), entry.saved, roots)
+		if err != nil {
+			log.Printf("discarding saved TLS session for %q: %v", serverNameFromSessionKey(sessionKey), err)
+			delete(c.entries, sessionKey)
+			return nil, false
+		}
+		entry.state = state
+		entry.saved = nil
+		c.entries[sessionKey] = entry
+	}
+	return entry.state, true
+}
+
+// The session key without its scope, which is the server name.
+func serverNameFromSessionKey(sessionKey string) string {
+	return sessionKey[strings.LastIndex(sessionKey, sessionScopeSeparator)+1:]
+}
+
+// Put is part of the utls.ClientSessionCache interface. A nil cs removes the
+// entry for sessionKey.
+func (c *sessionCache) Put(sessionKey string, cs *utls.ClientSessionState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cs == nil {
+		if _, ok := c.entries[sessionKey]; !ok {
+			return
+		}
+		delete(c.entries, sessionKey)
+	} else {
+		if cs.Vers() >= utls.VersionTLS13 {
+			// Not cached; see the comment at the top of the file.
+			return
+		}
+		c.entries[sessionKey] = sessionCacheEntry{state: cs, added: time.Now()}
+		c.evict()
+	}
+	if c.filename != "" && c.saveTimer == nil {
+		c.saveTimer = time.AfterFunc(sessionCacheSaveDelay, func() {
+			err := c.save()
+			if err != nil {
+				log.Printf("error saving TLS sessions: %v", err)
+			}
+		})
+	}
+}
+
+// Remove the oldest entries until the cache is within its capacity.
+func (c *sessionCache) evict() {
+	for len(c.entries) > c.capacity {
+		var oldestKey string
+		var oldest time.Time
+		for key, entry := range c.entries {
+			if oldestKey == "" || entry.added.Before(oldest) {
+				oldestKey = key
+				oldest = entry.added
+			}
+		}
+		delete(c.entries, oldestKey)
+	}
+}
+
+// The JSON representation of a session in a saved file.
+type savedSession struct {
+	SessionTicket []byte    `json:"ticket"`
+	Vers          uint16    `json:"version"`
+	CipherSuite   uint16    `json:"cipher_suite"`
+	MasterSecret  []byte    `json:"master_secret"`
+	Certificates  [][]byte  `json:"certificates"`
+	Added         time.Time `json:"added"`
+	// Whether the session used the extended master secret. A server
+	// refuses to resume a session if this is wrong, so sessions saved
+	// without it (by older versions) are not loaded.
+	EMS *bool `json:"ems"`
+}
+
+// Write the cache to c.filename now, if there are changes not yet saved.
+func (c *sessionCache) flush() error {
+	c.lock.Lock()
+	pending := c.saveTimer != nil && c.saveTimer.Stop()
+	c.lock.Unlock()
+	if !pending {
+		// Nothing to save, or the timer has already fired and its
+		// save is in progress.
+		return nil
+	}
+	return c.save()
+}
+
+// Write the cache to c.filename. The entries are copied under c.lock, and the
+// file is written without holding it.
+func (c *sessionCache) save() error {
+	c.saveLock.Lock()
+	defer c.saveLock.Unlock()
+
+	c.lock.Lock()
+	c.saveTimer = nil
+	filename := c.filename
+	saved := c.savedSessions()
+	c.lock.Unlock()
+
+	return writeSessionFile(filename, saved)
+}
+
+// Convert the entries to their saved form. Must be called with c.lock held.
+func (c *sessionCache) savedSessions() map[string]savedSession {
+	saved := make(map[string]savedSession)
+	for key, entry := range c.entries {
+		if entry.state == nil {
+			// Loaded and not yet used; save it as it was.
+			saved[key] = *entry.saved
+			continue
+		}
+		s := savedSession{
+			SessionTicket: entry.state.SessionTicket(),
+			Vers:          entry.state.Vers(),
+			CipherSuite:   entry.state.CipherSuite(),
+			MasterSecret:  entry.state.MasterSecret(),
+			EMS:           new(bool),
+			Added:         entry.added,
+		}
+		*s.EMS = entry.state.EMS()
+		for _, cert := range entry.state.ServerCertificates() {
+			s.Certificates = append(s.Certificates, cert.Raw)
+		}
+		saved[key] = s
+	}
+	return saved
+}
+
+// Write saved sessions to filename. The file is written to a temporary name
+// and then renamed, so that it is never seen half written.
+func writeSessionFile(filename string, saved map[string]savedSession) error {
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	// The file contains secrets, so it is readable only by its owner.
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Start saving the cache to filename, first loading any sessions already
+// saved there. A missing file is not an error. Loaded sessions are verified
+// when they are first looked up, because only then are the roots to verify
+// them against known.
+func (c *sessionCache) persist(filename string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.filename = filename
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved map[string]savedSession
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return err
+	}
+	for key, s := range saved {
+		if time.Since(s.Added) > sessionCacheMaxAge || len(s.Certificates) == 0 || s.EMS == nil {
+			continue
+		}
+		s := s
+		c.entries[key] = sessionCacheEntry{saved: &s, added: s.Added}
+	}
+	c.evict()
+	return nil
+}
+
+// Make a session state from a saved session, verifying its certificate chain
+// for serverName the way the TLS handshake that produced it did.
+func loadSavedSession(serverName string, s *savedSession, roots *x509.CertPool) (*utls.ClientSessionState, error) {
+	certs := make([]*x509.Certificate, 0, len(s.Certificates))
+	for _, der := range s.Certificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return nil, err
+	}
+	state := utls.MakeClientSessionState(s.SessionTicket, s.Vers, s.CipherSuite, s.MasterSecret, certs, chains)
+	state.SetEMS(*s.EMS)
+	return state, nil
+}
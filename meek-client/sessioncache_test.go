@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/proxy"
+)
+
+func TestSessionCacheResumption(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	// Only TLS 1.2 sessions are cached.
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	cache := newSessionCache(sessionCacheCapacity)
+	// The server's certificate is valid for example.com.
+	cfg := &utls.Config{InsecureSkipVerify: true, ServerName: "example.com", ClientSessionCache: cache}
+	for i, expected := range []bool{false, true, true} {
+		uconn, err := dialUTLS(context.Background(), "tcp", server.Listener.Addr().String(), cfg, &utls.HelloChrome_Auto, proxy.Direct, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		didResume := uconn.ConnectionState().DidResume
+		uconn.Close()
+		if didResume != expected {
+			t.Errorf("connection %d: DidResume %v, expected %v", i, didResume, expected)
+		}
+	}
+}
+
+func TestSessionCache(t *testing.T) {
+	cache := newSessionCache(2)
+
+	// TLS 1.3 sessions are not stored.
+	cache.Put("tls13", utls.MakeClientSessionState(nil, utls.VersionTLS13, tls.TLS_AES_128_GCM_SHA256, nil, nil, nil))
+	if _, ok := cache.Get("tls13"); ok {
+		t.Errorf("TLS 1.3 session was stored")
+	}
+
+	for i := 0; i < 3; i++ {
+		cache.Put(fmt.Sprintf("%d", i), utls.MakeClientSessionState(nil, utls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, nil, nil, nil))
+	}
+	// The oldest was evicted.
+	for i, expected := range []bool{false, true, true} {
+		if _, ok := cache.Get(fmt.Sprintf("%d", i)); ok != expected {
+			t.Errorf("session %d present: %v, expected %v", i, ok, expected)
+		}
+	}
+
+	cache.Put("1", nil)
+	if _, ok := cache.Get("1"); ok {
+		t.Errorf("session was not removed")
+	}
+}
+
+// Test that a session is resumed only by connections with the same trust
+// settings as the connection that created it.
+func TestSessionCacheScope(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	cache := newSessionCache(sessionCacheCapacity)
+	dial := func(cfg *utls.Config) (*utls.UConn, error) {
+		return dialUTLS(context.Background(), "tcp", server.Listener.Addr().String(), cfg, &utls.HelloChrome_Auto, proxy.Direct, nil)
+	}
+	trusting := &utls.Config{RootCAs: roots, ServerName: "example.com", ClientSessionCache: cache.scoped("ca-file=test.pem", roots)}
+	for i, expected := range []bool{false, true} {
+		uconn, err := dial(trusting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		didResume := uconn.ConnectionState().DidResume
+		uconn.Close()
+		if didResume != expected {
+			t.Errorf("connection %d: DidResume %v, expected %v", i, didResume, expected)
+		}
+	}
+
+	// With the system roots, the server's certificate does not verify,
+	// and the session must not be resumed to skip verification.
+	untrusting := &utls.Config{ServerName: "example.com", ClientSessionCache: cache.scoped("", nil)}
+	uconn, err := dial(untrusting)
+	if err == nil {
+		uconn.Close()
+		t.Fatalf("connection with other trust settings succeeded, DidResume %v", uconn.ConnectionState().DidResume)
+	}
+}
+
+func TestSessionCachePersist(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	dir, err := ioutil.TempDir("", "meek-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, sessionCacheFilename)
+
+	cache := newSessionCache(sessionCacheCapacity)
+	err = cache.persist(filename)
+	if err != nil {
+		t.Fatalf("missing file caused an error: %v", err)
+	}
+	view := cache.scoped("ca-file=test.pem", roots)
+	certs := []*x509.Certificate{server.Certificate()}
+	view.Put("example.com", utls.MakeClientSessionState([]byte("ticket"), utls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, []byte("secret"), certs, [][]*x509.Certificate{certs}))
+	// A session whose certificate does not match its server name.
+	view.Put("example.net", utls.MakeClientSessionState([]byte("ticket"), utls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, []byte("secret"), certs, [][]*x509.Certificate{certs}))
+	// Saving happens later, in the background.
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("file was saved synchronously: %v", err)
+	}
+	err = cache.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("file mode is %v", fi.Mode())
+	}
+
+	// Load and look up with the same trust settings, whose roots trust
+	// the server's certificate.
+	cache2 := newSessionCache(sessionCacheCapacity)
+	err = cache2.persist(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	view2 := cache2.scoped("ca-file=test.pem", roots)
+	cs, ok := view2.Get("example.com")
+	if !ok {
+		t.Fatalf("saved session was not loaded")
+	}
+	if string(cs.SessionTicket()) != "ticket" || string(cs.MasterSecret()) != "secret" ||
+		cs.Vers() != utls.VersionTLS12 || cs.CipherSuite() != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 ||
+		len(cs.VerifiedChains()) == 0 {
+		t.Errorf("loaded session differs: %+v", cs)
+	}
+	if _, ok := view2.Get("example.net"); ok {
+		t.Errorf("session with wrong server name was loaded")
+	}
+	// Other trust settings do not see the session.
+	if _, ok := cache2.scoped("", nil).Get("example.com"); ok {
+		t.Errorf("session was found with other trust settings")
+	}
+
+	// Load with the same trust key but roots that no longer trust the
+	// certificate, as when a CA file has changed.
+	cache3 := newSessionCache(sessionCacheCapacity)
+	err = cache3.persist(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache3.scoped("ca-file=test.pem", nil).Get("example.com"); ok {
+		t.Errorf("session with untrusted certificate was loaded")
+	}
+
+	// Sessions saved by versions that did not record whether the extended
+	// master secret was used are not loaded.
+	saved := cache2.savedSessions()
+	for key, s := range saved {
+		s.EMS = nil
+		saved[key] = s
+	}
+	err = writeSessionFile(filename, saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache4 := newSessionCache(sessionCacheCapacity)
+	err = cache4.persist(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache4.entries) != 0 {
+		t.Errorf("%d sessions without ems were loaded", len(cache4.entries))
+	}
+}
+
+// Test that a session saved to a file and loaded again can be resumed.
+func TestSessionCachePersistResumption(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	dir, err := ioutil.TempDir("", "meek-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, sessionCacheFilename)
+
+	for i, expected := range []bool{false, true} {
+		cache := newSessionCache(sessionCacheCapacity)
+		err = cache.persist(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := &utls.Config{RootCAs: roots, ServerName: "example.com", ClientSessionCache: cache.scoped("ca-file=test.pem", roots)}
+		uconn, err := dialUTLS(context.Background(), "tcp", server.Listener.Addr().String(), cfg, &utls.HelloChrome_Auto, proxy.Direct, nil)
+		if err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+		didResume := uconn.ConnectionState().DidResume
+		uconn.Close()
+		if didResume != expected {
+			t.Errorf("run %d: DidResume %v, expected %v", i, didResume, expected)
+		}
+		err = cache.flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
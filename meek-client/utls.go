@@ -23,24 +23,32 @@
 // one made to peek at the ALPN), rather than make a new connection.
 //
 // Subsequent calls to RoundTripper on the wrapper just pass the requests though
-// the previously created http.Transport or http2.Transport. We assume that in
-// future RoundTrips, the ALPN-negotiated protocol will remain the same as it
-// was in the initial RoundTrip. At this point it is the http.Transport or
-// http2.Transport calling DialTLS, not us, so we can't dynamically swap the
-// underlying transport based on the ALPN.
+// the previously created http.Transport or http2.Transport. Usually, the
+// ALPN-negotiated protocol remains the same as it was in the initial RoundTrip.
+// But it can change, for example when a CDN changes its configuration, or when
+// a later connection reaches a different edge node. At that point it is the
+// http.Transport or http2.Transport calling DialTLS, not us, so we can't hand
+// the connection to a different transport there. Instead, DialTLS fails the
+// dial, but first passes the new connection back to the wrapper. When the
+// wrapper sees its RoundTrip fail, it builds a new internal transport
+// appropriate to the new protocol, using the new connection as its
+// bootstrapConn, and retries the request once with it.
 //
 // https://bugs.torproject.org/29077
 // https://github.com/refraction-networking/utls/issues/16
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"sync"
+	"time"
 
 	utls "github.com/refraction-networking/utls"
 	"golang.org/x/net/http2"
@@ -67,40 +75,113 @@ func addrForDial(url *url.URL) (string, error) {
 	return net.JoinHostPort(host, port), nil
 }
 
+// Dial addr using forward, passing ctx along if forward is a
+// proxy.ContextDialer. Dialers that do not support contexts are used as-is.
+func dialContext(ctx context.Context, forward proxy.Dialer, network, addr string) (net.Conn, error) {
+	if d, ok := forward.(proxy.ContextDialer); ok {
+		return d.DialContext(ctx, network, addr)
+	}
+	return forward.Dial(network, addr)
+}
+
+// Do a uTLS handshake on uconn, closing uconn and returning ctx.Err() if ctx is
+// cancelled before the handshake finishes.
+func handshakeContext(ctx context.Context, uconn *utls.UConn) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- uconn.Handshake()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		uconn.Close()
+		<-errCh
+		return ctx.Err()
+	}
+}
+
 // Analogous to tls.Dial. Connect to the given address and initiate a TLS
 // handshake using the given ClientHelloID, returning the resulting connection.
-func dialUTLS(network, addr string, cfg *utls.Config, clientHelloID *utls.ClientHelloID, forward proxy.Dialer) (*utls.UConn, error) {
-	conn, err := forward.Dial(network, addr)
+// Cancelling ctx aborts the dial and the handshake, but does not affect the
+// connection once it has been returned.
+func dialUTLS(ctx context.Context, network, addr string, cfg *utls.Config, clientHelloID *utls.ClientHelloID, forward proxy.Dialer, pins pinSet) (*utls.UConn, error) {
+	conn, err := dialContext(ctx, forward, network, addr)
 	if err != nil {
 		return nil, err
 	}
-	uconn := utls.UClient(conn, cfg, *clientHelloID)
-	if cfg == nil || cfg.ServerName == "" {
+	// UClient does not copy cfg, so copy it here before modifying it with
+	// ServerName or adding the session cache.
+	if cfg == nil {
+		cfg = &utls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if cfg.ServerName == "" {
+		// Like tls.Dial, verify against the host part of addr. uTLS
+		// leaves an IP address out of the server_name extension. This
+		// must be set before ApplyPreset, which checks it.
 		serverName, _, err := net.SplitHostPort(addr)
 		if err != nil {
+			conn.Close()
 			return nil, err
 		}
-		uconn.SetSNI(serverName)
+		cfg.ServerName = serverName
+	}
+	if cfg.ClientSessionCache == nil && cfg.RootCAs == nil && !cfg.InsecureSkipVerify {
+		// Without a cache from the caller, share sessions only among
+		// connections with the default trust settings.
+		cfg.ClientSessionCache = utlsSessionCache.scoped("", nil)
 	}
-	err = uconn.Handshake()
+	uconn := utls.UClient(conn, cfg, *clientHelloID)
+	if clientHelloID.Client == utls.HelloCustom.Client {
+		// A spec loaded by loadClientHelloSpecFile.
+		spec, err := clientHelloSpecForID(clientHelloID)
+		if err == nil {
+			err = uconn.ApplyPreset(spec)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	err = handshakeContext(ctx, uconn)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	if pins != nil {
+		state := uconn.ConnectionState()
+		err = pins.check(addr, state.VerifiedChains)
+		if err != nil {
+			uconn.Close()
+			return nil, err
+		}
+	}
 	return uconn, nil
 }
 
 // A http.RoundTripper that uses uTLS (with a specified Client Hello ID) to make
 // TLS connections.
 //
-// Can only be reused among servers which negotiate the same ALPN.
+// If a server starts negotiating a different ALPN, the internal transport is
+// replaced with one that matches.
 type UTLSRoundTripper struct {
 	sync.Mutex
 
 	clientHelloID *utls.ClientHelloID
 	config        *utls.Config
 	proxyDialer   proxy.Dialer
+	pins          pinSet
 	rt            http.RoundTripper
 
+	// Incremented every time rt is replaced, so that connections reported
+	// by the DialTLS of an outdated rt can be recognized.
+	generation int
+	// A connection that negotiated a different ALPN than rt expects, held
+	// to become the bootstrapConn of rt's replacement.
+	alpnChangedConn *utls.UConn
+
 	// Transport for HTTP requests, which don't use uTLS.
 	httpRT *http.Transport
 }
@@ -115,87 +196,262 @@ func (rt *UTLSRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 		return nil, fmt.Errorf("unsupported URL scheme %q", req.URL.Scheme)
 	}
 
+	// The lock only protects the creation of rt.rt. It is not held during
+	// the RoundTrip itself, so that concurrent requests (for example from
+	// different sessions sharing this UTLSRoundTripper) are not
+	// serialized.
 	rt.Lock()
-	defer rt.Unlock()
-
 	if rt.rt == nil {
 		// On the first call, make an http.Transport or http2.Transport
-		// as appropriate.
+		// as appropriate. The bootstrap connection is made under the
+		// context of this first request.
 		var err error
-		rt.rt, err = makeRoundTripper(req.URL, rt.clientHelloID, rt.config, rt.proxyDialer)
+		rt.rt, err = makeRoundTripper(req.Context(), req.URL, rt.clientHelloID, rt.config, rt.proxyDialer, rt.pins, rt.alpnChangeFunc(rt.generation))
 		if err != nil {
+			rt.Unlock()
 			return nil, err
 		}
 	}
+	inner := rt.rt
+	rt.Unlock()
+
 	// Forward the request to the internal http.Transport or http2.Transport.
-	return rt.rt.RoundTrip(req)
+	resp, err := innerRoundTrip(inner, req)
+	if err != nil {
+		// If the request failed because a new connection negotiated a
+		// different ALPN, switch to a matching transport and try once
+		// more. The dial failed before anything was sent, so the body
+		// can be reused if it can be rewound.
+		newInner := rt.replaceAfterALPNChange(inner)
+		if newInner != nil && rewindBody(req) {
+			return innerRoundTrip(newInner, req)
+		}
+	}
+	return resp, err
+}
+
+// Do a RoundTrip with an internal transport made by makeRoundTripperFromConn.
+// http.Transport enforces its own ResponseHeaderTimeout, but http2.Transport
+// has no such option, so we enforce httpRoundTripper's ResponseHeaderTimeout
+// for it here.
+func innerRoundTrip(inner http.RoundTripper, req *http.Request) (*http.Response, error) {
+	timeout := httpRoundTripper.ResponseHeaderTimeout
+	if _, ok := inner.(*http2.Transport); !ok || timeout == 0 {
+		return inner.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := inner.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		// The timer fired, whether or not RoundTrip managed to return
+		// before noticing.
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, fmt.Errorf("timeout awaiting response headers")
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// Keep the context alive while the body is being read.
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// An io.ReadCloser that cancels a context when closed.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnCloseBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// Return a callback for the DialTLS of the internal transport of the given
+// generation, which hands over a connection with an unexpected ALPN.
+func (rt *UTLSRoundTripper) alpnChangeFunc(generation int) func(*utls.UConn) {
+	return func(uconn *utls.UConn) {
+		rt.Lock()
+		defer rt.Unlock()
+		if generation != rt.generation || rt.alpnChangedConn != nil {
+			// Either the transport that dialed uconn has already
+			// been replaced, or another dial has already provided
+			// a connection for its replacement.
+			uconn.Close()
+			return
+		}
+		rt.alpnChangedConn = uconn
+	}
+}
+
+// If a connection with a changed ALPN has been handed over, replace the
+// internal transport old with one built around that connection. Returns the
+// transport that requests should now use, or nil if old is still current and
+// there is nothing to replace it with.
+func (rt *UTLSRoundTripper) replaceAfterALPNChange(old http.RoundTripper) http.RoundTripper {
+	rt.Lock()
+	defer rt.Unlock()
+
+	if rt.rt != old {
+		// Another request already replaced the transport.
+		return rt.rt
+	}
+	if rt.alpnChangedConn == nil {
+		return nil
+	}
+
+	uconn := rt.alpnChangedConn
+	rt.alpnChangedConn = nil
+	rt.generation++
+	log.Printf("ALPN changed from %q to %q; replacing transport",
+		negotiatedProtocol(old), uconn.ConnectionState().NegotiatedProtocol)
+	rt.rt = makeRoundTripperFromConn(uconn, rt.clientHelloID, rt.config, rt.proxyDialer, rt.pins, rt.alpnChangeFunc(rt.generation))
+	closeIdleConnections(old)
+	return rt.rt
+}
+
+// Return the ALPN protocol that an internal transport made by
+// makeRoundTripperFromConn is meant for.
+func negotiatedProtocol(rt http.RoundTripper) string {
+	if _, ok := rt.(*http2.Transport); ok {
+		return http2.NextProtoTLS
+	}
+	return "http/1.1"
+}
+
+// Prepare req to be sent again, if its body (if any) can be recreated. Returns
+// false if it cannot be.
+func rewindBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+	return true
+}
+
+// CloseIdleConnections closes connections that are not currently in use by a
+// request, in both the uTLS and the plain HTTP transports.
+func (rt *UTLSRoundTripper) CloseIdleConnections() {
+	rt.Lock()
+	inner := rt.rt
+	rt.Unlock()
+	if inner != nil {
+		closeIdleConnections(inner)
+	}
+	rt.httpRT.CloseIdleConnections()
 }
 
 // Unlike when using the native Go net/http (whose built-in proxy support we can
 // use by setting Proxy on an http.Transport), and unlike when using the browser
 // helper (the browser has its own proxy support), when using uTLS we have to
-// craft our own proxy connections.
-func makeProxyDialer(proxyURL *url.URL, cfg *utls.Config, clientHelloID *utls.ClientHelloID) (proxy.Dialer, error) {
-	var proxyDialer proxy.Dialer = proxy.Direct
-	if proxyURL == nil {
-		return proxyDialer, nil
+// craft our own proxy connections. Connections to the first proxy of the chain
+// go through forward.
+func makeProxyDialer(proxies proxyChain, forward proxy.Dialer, cfg *utls.Config, clientHelloID *utls.ClientHelloID) (proxy.Dialer, error) {
+	proxyDialer := forward
+	for _, proxyURL := range proxies {
+		var err error
+		proxyDialer, err = makeProxyHopDialer(proxyURL, proxyDialer, cfg, clientHelloID)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return proxyDialer, nil
+}
 
+// Make a dialer for one proxy of a chain, whose connections to the proxy go
+// through forward.
+func makeProxyHopDialer(proxyURL *url.URL, forward proxy.Dialer, cfg *utls.Config, clientHelloID *utls.ClientHelloID) (proxy.Dialer, error) {
 	proxyAddr, err := addrForDial(proxyURL)
 	if err != nil {
 		return nil, err
 	}
 
-	var auth *proxy.Auth
-	if userpass := proxyURL.User; userpass != nil {
-		auth = &proxy.Auth{
-			User: userpass.Username(),
-		}
-		if password, ok := userpass.Password(); ok {
-			auth.Password = password
-		}
-	}
+	auth := proxyAuth(proxyURL)
 
+	var proxyDialer proxy.Dialer
+	var pr *httpProxy
 	switch proxyURL.Scheme {
-	case "socks5":
-		proxyDialer, err = proxy.SOCKS5("tcp", proxyAddr, auth, proxyDialer)
+	case "socks5", "socks5h":
+		// proxy.SOCKS5 sends names to the proxy to resolve, so socks5
+		// is the same as socks5h.
+		proxyDialer, err = proxy.SOCKS5("tcp", proxyAddr, auth, forward)
+	case "socks4a":
+		proxyDialer, err = ProxySOCKS4a("tcp", proxyAddr, auth, forward)
 	case "http":
-		proxyDialer, err = ProxyHTTP("tcp", proxyAddr, auth, proxyDialer)
+		pr, err = ProxyHTTP("tcp", proxyAddr, auth, forward)
 	case "https":
 		// We use the same uTLS Config for TLS to the HTTPS proxy, as we
 		// use for HTTPS connections through the tunnel. We make a clone
 		// of the Config to avoid concurrent modification as the two
-		// layers set the ServerName value.
+		// layers set the ServerName value. ECH is for the front only.
 		var cfgClone *utls.Config
 		if cfg != nil {
 			cfgClone = cfg.Clone()
+			cfgClone.EncryptedClientHelloConfigList = nil
 		}
-		proxyDialer, err = ProxyHTTPS("tcp", proxyAddr, auth, proxyDialer, cfgClone, clientHelloID)
+		pr, err = ProxyHTTPS("tcp", proxyAddr, auth, forward, cfgClone, clientHelloID)
 	default:
-		return nil, fmt.Errorf("cannot use proxy scheme %q with uTLS", proxyURL.Scheme)
+		return nil, fmt.Errorf("cannot use proxy scheme %q", proxyURL.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pr != nil {
+		pr.header = options.ProxyHeader
+		proxyDialer = pr
 	}
 
-	return proxyDialer, err
+	return proxyDialer, nil
 }
 
-func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls.Config, proxyDialer proxy.Dialer) (http.RoundTripper, error) {
+// Make an internal http.Transport or http2.Transport for a UTLSRoundTripper,
+// according to the ALPN protocol negotiated by an initial connection to url.
+// onALPNChange is called with any later connection that negotiates a different
+// protocol; see makeRoundTripperFromConn.
+func makeRoundTripper(ctx context.Context, url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls.Config, proxyDialer proxy.Dialer, pins pinSet, onALPNChange func(*utls.UConn)) (http.RoundTripper, error) {
 	addr, err := addrForDial(url)
 	if err != nil {
 		return nil, err
 	}
 
-	// Connect to the given address, through a proxy if requested, and
-	// initiate a TLS handshake using the given ClientHelloID. Return the
-	// resulting connection.
-	dial := func(network, addr string) (*utls.UConn, error) {
-		return dialUTLS(network, addr, cfg, clientHelloID, proxyDialer)
+	if timeout := httpRoundTripper.TLSHandshakeTimeout; timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-
-	bootstrapConn, err := dial("tcp", addr)
+	bootstrapConn, err := dialUTLS(ctx, "tcp", addr, cfg, clientHelloID, proxyDialer, pins)
 	if err != nil {
 		return nil, err
 	}
 
+	return makeRoundTripperFromConn(bootstrapConn, clientHelloID, cfg, proxyDialer, pins, onALPNChange), nil
+}
+
+// Make an http.Transport or http2.Transport according to the ALPN protocol
+// negotiated by bootstrapConn, which will be the transport's first connection.
+// The transport makes further connections using uTLS. If one of them negotiates
+// a different protocol, the dial fails, and the connection is passed to
+// onALPNChange (which takes ownership of it) instead of being closed.
+func makeRoundTripperFromConn(bootstrapConn *utls.UConn, clientHelloID *utls.ClientHelloID, cfg *utls.Config, proxyDialer proxy.Dialer, pins pinSet, onALPNChange func(*utls.UConn)) http.RoundTripper {
+	// Connect to the given address, through a proxy if requested, and
+	// initiate a TLS handshake using the given ClientHelloID. Return the
+	// resulting connection.
+	dial := func(ctx context.Context, network, addr string) (*utls.UConn, error) {
+		return dialUTLS(ctx, network, addr, cfg, clientHelloID, proxyDialer, pins)
+	}
+
 	// Peek at what protocol we negotiated.
 	protocol := bootstrapConn.ConnectionState().NegotiatedProtocol
 
@@ -214,14 +470,31 @@ func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls
 			return uconn, nil
 		}
 
-		// Later dials make a new connection.
-		uconn, err := dial(network, addr)
+		// Later dials make a new connection. The internal transports
+		// do not give us a context here; they abort requests on
+		// their own when the request's context is cancelled. Because
+		// we do the TLS handshake ourselves, http.Transport's
+		// TLSHandshakeTimeout does not take effect, so we apply it
+		// here (to the TCP connection as well as the handshake).
+		ctx := context.Background()
+		if timeout := httpRoundTripper.TLSHandshakeTimeout; timeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		uconn, err := dial(ctx, network, addr)
 		if err != nil {
 			return nil, err
 		}
 		if uconn.ConnectionState().NegotiatedProtocol != protocol {
-			return nil, fmt.Errorf("unexpected switch from ALPN %q to %q",
+			err := fmt.Errorf("unexpected switch from ALPN %q to %q",
 				protocol, uconn.ConnectionState().NegotiatedProtocol)
+			if onALPNChange != nil {
+				onALPNChange(uconn)
+			} else {
+				uconn.Close()
+			}
+			return nil, err
 		}
 
 		return uconn, nil
@@ -230,31 +503,49 @@ func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls
 	// Construct an http.Transport or http2.Transport depending on ALPN.
 	switch protocol {
 	case http2.NextProtoTLS:
-		// Unfortunately http2.Transport does not expose the same
-		// configuration options as http.Transport with regard to
-		// timeouts, etc., so we are at the mercy of the defaults.
+		// http2.Transport does not expose all the same configuration
+		// options as http.Transport with regard to timeouts, etc.
 		// https://github.com/golang/go/issues/16581
-		return &http2.Transport{
+		// We copy IdleConnTimeout from httpRoundTripper, as the
+		// http.Transport case does. TLSHandshakeTimeout is handled in
+		// dialTLS, and ResponseHeaderTimeout in innerRoundTrip. PING
+		// health checks have no HTTP/1.1 equivalent and have their
+		// own options.
+		// If there is an HTTP/2 profile to go with the ClientHelloID,
+		// connections are wrapped to imitate it (see h2fingerprint.go).
+		fp := http2FingerprintForID(clientHelloID)
+		tr := &http2.Transport{
 			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
 				// Ignore the *tls.Config parameter; use our
 				// static cfg instead.
-				return dialTLS(network, addr)
+				conn, err := dialTLS(network, addr)
+				if err != nil || fp == nil {
+					return conn, err
+				}
+				return newHTTP2FingerprintConn(conn, fp), nil
 			},
-		}, nil
+			IdleConnTimeout: httpRoundTripper.IdleConnTimeout,
+			ReadIdleTimeout: options.H2ReadIdleTimeout,
+			PingTimeout:     options.H2PingTimeout,
+		}
+		if fp != nil {
+			fp.configureTransport(tr)
+		}
+		return tr
 	default:
 		// With http.Transport, copy important default fields from
 		// http.DefaultTransport, such as TLSHandshakeTimeout and
 		// IdleConnTimeout, before overriding DialTLS.
 		tr := httpRoundTripper.Clone()
 		tr.DialTLS = dialTLS
-		return tr, nil
+		return tr
 	}
 }
 
 // When you update this map, also update the man page in doc/meek-client.1.txt.
 // https://github.com/refraction-networking/utls/blob/master/u_common.go
 var clientHelloIDMap = map[string]*utls.ClientHelloID{
-	// No HelloCustom: not useful for external configuration.
+	// No HelloCustom: use a "file:" name instead (see clienthellospec.go).
 	// No HelloRandomized: doesn't negotiate consistent ALPN.
 	"none":                  nil, // special case: disable uTLS
 	"hellogolang":           nil, // special case: disable uTLS
@@ -265,42 +556,83 @@ var clientHelloIDMap = map[string]*utls.ClientHelloID{
 	"hellofirefox_56":       &utls.HelloFirefox_56,
 	"hellofirefox_63":       &utls.HelloFirefox_63,
 	"hellofirefox_65":       &utls.HelloFirefox_65,
+	"hellofirefox_120":      &utls.HelloFirefox_120,
 	"hellochrome_auto":      &utls.HelloChrome_Auto,
 	"hellochrome_58":        &utls.HelloChrome_58,
 	"hellochrome_62":        &utls.HelloChrome_62,
 	"hellochrome_70":        &utls.HelloChrome_70,
 	"hellochrome_72":        &utls.HelloChrome_72,
 	"hellochrome_83":        &utls.HelloChrome_83,
+	"hellochrome_120":       &utls.HelloChrome_120,
+	"hellochrome_133":       &utls.HelloChrome_133,
 	"helloios_auto":         &utls.HelloIOS_Auto,
 	"helloios_11_1":         &utls.HelloIOS_11_1,
 	"helloios_12_1":         &utls.HelloIOS_12_1,
+	"helloios_14":           &utls.HelloIOS_14,
 }
 
-func NewUTLSRoundTripper(name string, cfg *utls.Config, proxyURL *url.URL) (http.RoundTripper, error) {
-	// Lookup is case-insensitive.
-	clientHelloID, ok := clientHelloIDMap[strings.ToLower(name)]
-	if !ok {
-		return nil, fmt.Errorf("no uTLS Client Hello ID named %q", name)
+// Make an http.RoundTripper that uses uTLS with the named Client Hello ID (or
+// native TLS, for the names that mean that). settings may be nil for default
+// settings.
+func NewUTLSRoundTripper(name string, cfg *utls.Config, proxies proxyChain, settings *frontSettings) (http.RoundTripper, error) {
+	// A rotation list gets a fingerprint chosen for this RoundTripper.
+	name, err := chooseUTLSName(name)
+	if err != nil {
+		return nil, err
+	}
+	clientHelloID, err := lookupClientHelloID(name)
+	if err != nil {
+		return nil, err
 	}
 	if clientHelloID == nil {
 		// Special case for "none" and HelloGolang.
+		if !settings.isDefault() {
+			return newNativeRoundTripper(proxies, settings)
+		}
 		return httpRoundTripper, nil
 	}
 
-	proxyDialer, err := makeProxyDialer(proxyURL, cfg, clientHelloID)
+	if cfg == nil {
+		cfg = &utls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	var pins pinSet
+	if settings != nil {
+		pins = settings.Pins
+		if settings.RootCAs != nil {
+			// The roots apply to an HTTPS proxy as well as
+			// to the front, because makeProxyDialer uses cfg.
+			cfg.RootCAs = settings.RootCAs
+		}
+	}
+	if cfg.ClientSessionCache == nil {
+		cfg.ClientSessionCache = settings.sessionCache()
+	}
+
+	proxyDialer, err := makeProxyDialer(proxies, proxy.Direct, cfg, clientHelloID)
 	if err != nil {
 		return nil, err
 	}
+	// Connections to the front use its front-ip addresses or doh, if any,
+	// even through a proxy.
+	if settings.needsDialer() {
+		proxyDialer = settings.dialer(proxyDialer)
+	}
 
 	// This special-case RoundTripper is used for HTTP requests, which don't
 	// use uTLS but should use the specified proxy.
 	httpRT := httpRoundTripper.Clone()
-	httpRT.Proxy = http.ProxyURL(proxyURL)
+	err = setTransportProxy(httpRT, proxies)
+	if err != nil {
+		return nil, err
+	}
 
 	return &UTLSRoundTripper{
 		clientHelloID: clientHelloID,
 		config:        cfg,
 		proxyDialer:   proxyDialer,
+		pins:          pins,
 		// rt will be set in the first call to RoundTrip.
 		httpRT: httpRT,
 	}, nil
@@ -2,26 +2,31 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	utls "github.com/refraction-networking/utls"
 )
 
 // Test that the name lookup of NewUTLSRoundTripper is case-insensitive.
 func TestNewUTLSRoundTripperCase(t *testing.T) {
-	mixed, err := NewUTLSRoundTripper("HelloFirefox_Auto", nil, nil)
+	mixed, err := NewUTLSRoundTripper("HelloFirefox_Auto", nil, nil, nil)
 	if err != nil {
 		t.Fatalf("error on %q: %v", "HelloFirefox_Auto", err)
 	}
-	upper, err := NewUTLSRoundTripper("HELLOFIREFOX_AUTO", nil, nil)
+	upper, err := NewUTLSRoundTripper("HELLOFIREFOX_AUTO", nil, nil, nil)
 	if err != nil {
 		t.Fatalf("error on %q: %v", "HELLOFIREFOX_AUTO", err)
 	}
-	lower, err := NewUTLSRoundTripper("hellofirefox_auto", nil, nil)
+	lower, err := NewUTLSRoundTripper("hellofirefox_auto", nil, nil, nil)
 	if err != nil {
 		t.Fatalf("error on %q: %v", "hellofirefox_auto", err)
 	}
@@ -95,7 +100,7 @@ func TestUTLSClientHello(t *testing.T) {
 	// We use HelloIOS_11_1 because its lengthy ALPN means we will not
 	// confuse it with a native Go fingerprint, and lack of GREASE means we
 	// do not have to account for many variations.
-	rt, err := NewUTLSRoundTripper("HelloIOS_11_1", &utls.Config{InsecureSkipVerify: true, ServerName: "localhost"}, nil)
+	rt, err := NewUTLSRoundTripper("HelloIOS_11_1", &utls.Config{InsecureSkipVerify: true, ServerName: "localhost"}, nil, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -138,10 +143,11 @@ func TestUTLSClientHello(t *testing.T) {
 func TestUTLSServerName(t *testing.T) {
 	const clientHelloIDName = "HelloFirefox_63"
 
-	// No ServerName, dial IP address. Results in an invalid server_name
-	// extension with a 0-length host_name. Not sure if that's what it
-	// should do, but check if the behavior ever changes.
-	rt, err := NewUTLSRoundTripper(clientHelloIDName, &utls.Config{InsecureSkipVerify: true}, nil)
+	// No ServerName, dial IP address. Results in no server_name
+	// extension, because a server_name may not be an IP address (RFC
+	// 6066 section 3). Older versions of uTLS sent an invalid server_name
+	// extension with a 0-length host_name instead.
+	rt, err := NewUTLSRoundTripper(clientHelloIDName, &utls.Config{InsecureSkipVerify: true}, nil, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -149,13 +155,19 @@ func TestUTLSServerName(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	if !bytes.Contains(buf, []byte("\x00\x00\x00\x05\x00\x03\x00\x00\x00")) {
-		t.Errorf("expected 0-length server_name extension with no ServerName and IP address dial")
+	spec, err := (&utls.Fingerprinter{}).FingerprintClientHello(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(*utls.SNIExtension); ok {
+			t.Errorf("expected no server_name extension with no ServerName and IP address dial")
+		}
 	}
 
 	// No ServerName, dial hostname. server_name extension should come from
 	// the dial address.
-	rt, err = NewUTLSRoundTripper(clientHelloIDName, &utls.Config{InsecureSkipVerify: true}, nil)
+	rt, err = NewUTLSRoundTripper(clientHelloIDName, &utls.Config{InsecureSkipVerify: true}, nil, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -169,7 +181,7 @@ func TestUTLSServerName(t *testing.T) {
 
 	// Given ServerName, dial IP address. server_name extension should from
 	// the ServerName.
-	rt, err = NewUTLSRoundTripper(clientHelloIDName, &utls.Config{InsecureSkipVerify: true, ServerName: "test.example"}, nil)
+	rt, err = NewUTLSRoundTripper(clientHelloIDName, &utls.Config{InsecureSkipVerify: true, ServerName: "test.example"}, nil, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -183,7 +195,7 @@ func TestUTLSServerName(t *testing.T) {
 
 	// Given ServerName, dial hostname. server_name extension should from
 	// the ServerName.
-	rt, err = NewUTLSRoundTripper(clientHelloIDName, &utls.Config{InsecureSkipVerify: true, ServerName: "test.example"}, nil)
+	rt, err = NewUTLSRoundTripper(clientHelloIDName, &utls.Config{InsecureSkipVerify: true, ServerName: "test.example"}, nil, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -228,10 +240,12 @@ func TestUTLSHTTPWithProxy(t *testing.T) {
 	// Try to access the web server through the non-functional proxy.
 	for _, proxyURL := range []url.URL{
 		url.URL{Scheme: "socks5", Host: proxyLn.Addr().String()},
+		url.URL{Scheme: "socks5h", Host: proxyLn.Addr().String()},
+		url.URL{Scheme: "socks4a", Host: proxyLn.Addr().String()},
 		url.URL{Scheme: "http", Host: proxyLn.Addr().String()},
 		url.URL{Scheme: "https", Host: proxyLn.Addr().String()},
 	} {
-		rt, err := NewUTLSRoundTripper("HelloFirefox_63", &utls.Config{InsecureSkipVerify: true}, &proxyURL)
+		rt, err := NewUTLSRoundTripper("HelloFirefox_63", &utls.Config{InsecureSkipVerify: true}, proxyChain{&proxyURL}, nil)
 		if err != nil {
 			panic(err)
 		}
@@ -246,3 +260,130 @@ func TestUTLSHTTPWithProxy(t *testing.T) {
 		}
 	}
 }
+
+// Test that a UTLSRoundTripper switches internal transports when the server
+// starts negotiating a different ALPN protocol.
+func TestUTLSALPNChange(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	}))
+	server.EnableHTTP2 = true
+	// The first connection gets only HTTP/1.1; later ones get only h2.
+	var lock sync.Mutex
+	numConns := 0
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			cfg := server.TLS.Clone()
+			cfg.GetConfigForClient = nil
+			if numConns == 0 {
+				cfg.NextProtos = []string{"http/1.1"}
+			} else {
+				cfg.NextProtos = []string{"h2"}
+			}
+			numConns++
+			return cfg, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	// Set ServerName, because dialing an IP address without it results in
+	// an empty server_name extension, which crypto/tls rejects.
+	rt, err := NewUTLSRoundTripper("HelloFirefox_63", &utls.Config{InsecureSkipVerify: true, ServerName: "example.com"}, nil, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	fetchProto := func() (string, error) {
+		req, err := http.NewRequest("POST", server.URL, bytes.NewReader([]byte("body")))
+		if err != nil {
+			return "", err
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	proto, err := fetchProto()
+	if err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if proto != "HTTP/1.1" {
+		t.Fatalf("first request: expected %q, got %q", "HTTP/1.1", proto)
+	}
+
+	// Force a new connection, which will negotiate h2.
+	rt.(*UTLSRoundTripper).CloseIdleConnections()
+	proto, err = fetchProto()
+	if err != nil {
+		t.Fatalf("request after ALPN change: %v", err)
+	}
+	if proto != "HTTP/2.0" {
+		t.Fatalf("request after ALPN change: expected %q, got %q", "HTTP/2.0", proto)
+	}
+}
+
+// Test that ResponseHeaderTimeout is enforced on the uTLS HTTP/2 path, where
+// http2.Transport does not do it itself.
+func TestUTLSHTTP2ResponseHeaderTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	defer func(saved time.Duration) {
+		httpRoundTripper.ResponseHeaderTimeout = saved
+	}(httpRoundTripper.ResponseHeaderTimeout)
+	httpRoundTripper.ResponseHeaderTimeout = timeout
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(5 * timeout)
+		}
+		w.Write([]byte(req.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	rt, err := NewUTLSRoundTripper("HelloFirefox_63", &utls.Config{InsecureSkipVerify: true, ServerName: "example.com"}, nil, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	// A fast response within the timeout works, and its body is readable
+	// even after the timeout has passed.
+	req, err := http.NewRequest("GET", server.URL+"/fast", nil)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("fast request: %v", err)
+	}
+	time.Sleep(2 * timeout)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("fast request body: %v", err)
+	}
+	if string(body) != "HTTP/2.0" {
+		t.Fatalf("expected an HTTP/2 response, got %q", body)
+	}
+
+	// A slow response times out.
+	req, err = http.NewRequest("GET", server.URL+"/slow", nil)
+	if err != nil {
+		panic(err)
+	}
+	start := time.Now()
+	_, err = rt.RoundTrip(req)
+	if err == nil {
+		t.Fatalf("slow request unexpectedly succeeded")
+	}
+	if time.Since(start) >= 5*timeout {
+		t.Errorf("slow request took %v to time out", time.Since(start))
+	}
+}
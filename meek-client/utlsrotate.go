@@ -0,0 +1,103 @@
+// Rotation among several uTLS fingerprints.
+//
+// A "utls=rotate:<list>" bridge line argument or --utls option names a list of
+// fingerprints, any of which may be used. Each session chooses one at random
+// when it starts and uses it for its whole lifetime, so that the ALPN
+// negotiated with the server stays consistent within a session. The list is
+// comma-separated; each element is a name as accepted by lookupClientHelloID,
+// optionally followed by "*" and a non-negative integer weight (default 1).
+// For example:
+//
+//	utls=rotate:HelloChrome_Auto*3,HelloFirefox_Auto,file:/etc/meek/spec.json
+//
+// File names in the list therefore cannot contain ',' or '*'.
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// The prefix of a uTLS name that refers to a rotation list.
+const utlsRotatePrefix = "rotate:"
+
+type weightedUTLSName struct {
+	name   string
+	weight int64
+}
+
+// Parse the list following "rotate:" and check that every name in it is
+// valid.
+func parseUTLSRotation(list string) ([]weightedUTLSName, error) {
+	var result []weightedUTLSName
+	var total int64
+	for _, elem := range strings.Split(list, ",") {
+		w := weightedUTLSName{name: elem, weight: 1}
+		if i := strings.LastIndex(elem, "*"); i != -1 {
+			var err error
+			w.name = elem[:i]
+			w.weight, err = strconv.ParseInt(elem[i+1:], 10, 32)
+			if err != nil || w.weight < 0 {
+				return nil, fmt.Errorf("bad weight in %q", elem)
+			}
+		}
+		if isUTLSRotation(w.name) {
+			return nil, fmt.Errorf("nested %q in %q", utlsRotatePrefix, elem)
+		}
+		_, err := lookupClientHelloID(w.name)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, w)
+		total += w.weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("all weights are zero")
+	}
+	return result, nil
+}
+
+func isUTLSRotation(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), utlsRotatePrefix)
+}
+
+// If name is a rotation list, choose one of its elements at random according
+// to their weights. Otherwise return name unchanged.
+func chooseUTLSName(name string) (string, error) {
+	if !isUTLSRotation(name) {
+		return name, nil
+	}
+	names, err := parseUTLSRotation(name[len(utlsRotatePrefix):])
+	if err != nil {
+		return "", err
+	}
+	var total int64
+	for _, w := range names {
+		total += w.weight
+	}
+	r, err := rand.Int(rand.Reader, big.NewInt(total))
+	if err != nil {
+		return "", err
+	}
+	x := r.Int64()
+	for _, w := range names {
+		if x < w.weight {
+			return w.name, nil
+		}
+		x -= w.weight
+	}
+	panic("unreachable")
+}
+
+// Check that a uTLS name, which may be a rotation list, is valid.
+func checkUTLSName(name string) error {
+	if isUTLSRotation(name) {
+		_, err := parseUTLSRotation(name[len(utlsRotatePrefix):])
+		return err
+	}
+	_, err := lookupClientHelloID(name)
+	return err
+}
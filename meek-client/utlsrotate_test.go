@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseUTLSRotation(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected []weightedUTLSName
+	}{
+		{"HelloChrome_Auto", []weightedUTLSName{{"HelloChrome_Auto", 1}}},
+		{"HelloChrome_Auto*3,hellofirefox_auto", []weightedUTLSName{{"HelloChrome_Auto", 3}, {"hellofirefox_auto", 1}}},
+		{"HelloChrome_Auto*0,none*2", []weightedUTLSName{{"HelloChrome_Auto", 0}, {"none", 2}}},
+		{"", nil},
+		{"HelloChrome_Auto,", nil},
+		{"HelloNonexistent", nil},
+		{"HelloChrome_Auto*", nil},
+		{"HelloChrome_Auto*-1", nil},
+		{"HelloChrome_Auto*x", nil},
+		{"HelloChrome_Auto*0", nil},
+		{"rotate:HelloChrome_Auto", nil},
+	} {
+		output, err := parseUTLSRotation(test.input)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", test.input, output)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.input, err)
+			continue
+		}
+		if len(output) != len(test.expected) {
+			t.Errorf("%q → %v, expected %v", test.input, output, test.expected)
+			continue
+		}
+		for i := range output {
+			if output[i] != test.expected[i] {
+				t.Errorf("%q → %v, expected %v", test.input, output, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestChooseUTLSName(t *testing.T) {
+	// Names that are not rotation lists are returned unchanged, even if
+	// invalid.
+	for _, name := range []string{"", "HelloChrome_Auto", "HelloNonexistent", "file:/nonexistent"} {
+		chosen, err := chooseUTLSName(name)
+		if err != nil || chosen != name {
+			t.Errorf("%q → %q %v", name, chosen, err)
+		}
+	}
+
+	_, err := chooseUTLSName("rotate:HelloNonexistent")
+	if err == nil {
+		t.Errorf("invalid rotation list did not cause an error")
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		chosen, err := chooseUTLSName("ROTATE:HelloChrome_Auto*3,HelloFirefox_Auto,HelloIOS_Auto*0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[chosen]++
+	}
+	if counts["HelloIOS_Auto"] != 0 {
+		t.Errorf("chose a name with zero weight: %v", counts)
+	}
+	// Expected counts are 750 and 250.
+	if counts["HelloChrome_Auto"] < 600 || counts["HelloFirefox_Auto"] < 150 ||
+		counts["HelloChrome_Auto"]+counts["HelloFirefox_Auto"] != 1000 {
+		t.Errorf("unexpected distribution: %v", counts)
+	}
+}
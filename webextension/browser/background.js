@@ -1,16 +1,19 @@
 // This program is the browser part of the meek-http-helper WebExtension. Its
 // purpose is to receive and execute commands from the native part. It
-// understands two commands: "report-address" and "roundtrip".
+// understands three commands: "report-address", "roundtrip", and "cancel".
 //
 //
 // {
 //   "command": "report-address",
-//   "address": "127.0.0.1:XXXX"
+//   "address": "127.0.0.1:XXXX",
+//   "secret": "...hex..."
 // }
 // The "report-address" command causes the extension to print to a line to
 // stdout:
-//   meek-http-helper: listen 127.0.0.1:XXXX
-// meek-client looks for this line to find out where the helper is listening.
+//   meek-http-helper: listen 127.0.0.1:XXXX secret ...hex...
+// meek-client looks for this line to find out where the helper is listening,
+// and the secret that it must send with every request. The address may instead
+// be "unix:" followed by the path of a Unix domain socket.
 // For this to work, you must set the pref browser.dom.window.dump.enabled.
 //
 //
@@ -21,8 +24,8 @@
 //     "method": "POST",
 //     "url": "https://allowed.example/",
 //     "header": {
-//       "Host": "forbidden.example",
-//       "X-Session-Id": ...,
+//       "Host": ["forbidden.example"],
+//       "X-Session-Id": [...],
 //       ...
 //     },
 //     "proxy": {
@@ -40,6 +43,11 @@
 //   "id": "...ID...",
 //   "response": {
 //     "status": 200,
+//     "header": {
+//       "Content-Type": ["application/octet-stream"],
+//       "Set-Cookie": ["a=1", "b=2"],
+//       ...
+//     },
 //     "body": "...base64..."
 //   }
 // }
@@ -53,6 +61,18 @@
 // The "id" field in the response will be the same as the one in the request,
 // because that is what enables the native part to match up requests and
 // responses.
+//
+//
+// {
+//   "command": "cancel",
+//   "id": "...ID..."
+// }
+// The "cancel" command aborts the "roundtrip" command with the same ID, if it
+// is still in progress. The native part no longer expects a response for it.
+//
+//
+// In "header" objects, each field name maps to an array of values, in order.
+// (For compatibility, a request header value may also be a single string.)
 
 // Decode a base64-encoded string into an ArrayBuffer.
 function base64_decode(enc_str) {
@@ -77,6 +97,37 @@ function base64_encode(dec_buf) {
     return btoa(dec_str);
 }
 
+// Convert a header object, whose values are arrays of strings (or single
+// strings), into an array of {name, value} objects, the form used by
+// webRequest.HttpHeaders.
+// https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/API/webRequest/HttpHeaders
+function headerToArray(header) {
+    let result = [];
+    for (let [name, values] of Object.entries(header)) {
+        if (!Array.isArray(values)) {
+            values = [values];
+        }
+        for (let value of values) {
+            result.push({name, value: String(value)});
+        }
+    }
+    return result;
+}
+
+// Convert an array of {name, value} objects into a header object whose values
+// are arrays of strings, the inverse of headerToArray.
+function arrayToHeader(headers) {
+    // No prototype, so that a field name like "constructor" is not special.
+    let result = Object.create(null);
+    for (let {name, value} of headers) {
+        if (!(name in result)) {
+            result[name] = [];
+        }
+        result[name].push(value);
+    }
+    return result;
+}
+
 // Return a proxy.ProxyInfo according to the given specification.
 //
 // https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/API/proxy/ProxyInfo
@@ -124,21 +175,24 @@ function Mutex() {
 const headersMutex = new Mutex();
 const proxyMutex = new Mutex();
 
-async function roundtrip(params) {
+// The optional signal is an AbortSignal that aborts the request.
+async function roundtrip(params, signal) {
     // Process the incoming request parameters and convert them into a Request.
     // https://developer.mozilla.org/en-US/docs/Web/API/Request/Request#Parameters
     const input = params.url;
+    const headers = headerToArray(params.header != null ? params.header : {});
     const init = {
         method: params.method,
         body: params.body != null ? base64_decode(params.body) : undefined,
         // headers will get further treatment below in headersFn.
-        headers: params.header != null ? params.header : {},
+        headers: headers.map(({name, value}) => [name, value]),
         // Do not read nor write from the browser's HTTP cache.
         cache: "no-store",
         // Don't send cookies.
         credentials: "omit",
         // Don't follow redirects (we'll get resp.status:0 if there is one).
         redirect: "manual",
+        signal,
     };
 
     // Also enforce restrictions on what kinds of requests we are willing to
@@ -164,6 +218,7 @@ async function roundtrip(params) {
     // network communication happens; i.e., it's fast.
     const headersUnlock = await headersMutex.lock();
     let headersCalled = false;
+    let requestId = null;
     function headersFn(details) {
         try {
             // Sanity assertion: per-request listeners are called at most once.
@@ -172,8 +227,13 @@ async function roundtrip(params) {
             }
             headersCalled = true;
 
+            // Remember the request, so that responseHeadersFn saves its
+            // response headers for us.
+            requestId = details.requestId;
+            responseHeadersMap.set(requestId, null);
+
             let removals = new Map();
-            for (let name of Object.keys(init.headers)) {
+            for (let {name} of headers) {
                 removals.set(name.toLowerCase());
             }
             // Also remove some unnecessary or potentially tracking-enabling headers.
@@ -181,11 +241,9 @@ async function roundtrip(params) {
                 removals.set(name.toLowerCase());
             }
             let requestHeaders = details.requestHeaders.filter(header => !removals.has(header.name.toLowerCase()));
-            // Append the requested headers in array form.
-            // https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/API/webRequest/HttpHeaders
-            for (let [name, value] of Object.entries(init.headers)) {
-                requestHeaders.push({name, value});
-            }
+            // Append the requested headers, keeping multiple values for
+            // the same name.
+            requestHeaders.push(...headers);
             return {requestHeaders};
         } catch (error) {
             // In case of any error in the code above, play it safe and cancel
@@ -239,9 +297,17 @@ async function roundtrip(params) {
 
         // Now actually do the request and build a response object.
         let response = await fetch(request);
+        let body = base64_encode(await response.arrayBuffer());
+        // Prefer the header fields as responseHeadersFn saw them. The
+        // fetch API joins repeated fields and hides some, like Set-Cookie.
+        let responseHeaders = responseHeadersMap.get(requestId);
+        if (responseHeaders == null) {
+            responseHeaders = Array.from(response.headers, ([name, value]) => ({name, value}));
+        }
         return {
             status: response.status,
-            body: base64_encode(await response.arrayBuffer()),
+            header: arrayToHeader(responseHeaders),
+            body,
         };
     } finally {
         // With certain errors (e.g. an invalid URL), our onBeforeSendHeaders
@@ -253,8 +319,27 @@ async function roundtrip(params) {
         headersUnlock();
         browser.proxy.onRequest.removeListener(proxyFn);
         proxyUnlock();
+        responseHeadersMap.delete(requestId);
+    }
+}
+
+// Response header fields of requests made by roundtrip, indexed by
+// webRequest requestId. headersFn adds an entry for each of its requests, and
+// responseHeadersFn fills it in. Unlike onBeforeSendHeaders, this listener is
+// static, because a response may arrive long after the request was sent, and
+// we do not want to hold a lock for that long.
+const responseHeadersMap = new Map();
+function responseHeadersFn(details) {
+    if (responseHeadersMap.has(details.requestId)) {
+        responseHeadersMap.set(details.requestId, details.responseHeaders);
     }
 }
+// https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/API/webRequest/onHeadersReceived
+browser.webRequest.onHeadersReceived.addListener(
+    responseHeadersFn,
+    {urls: ["http://*/*", "https://*/*"]},
+    ["responseHeaders"]
+);
 
 // If an error occurs in a proxy.onRequest listener (for instance if a ProxyInfo
 // field is missing or invalid), the browser will ignore the proxy and just
@@ -314,23 +399,44 @@ browser.proxy.settings.set({value: {proxyType: "system", proxyDNS: false}});
 // Connect to our native process.
 const port = browser.runtime.connectNative("meek.http.helper");
 
+// AbortControllers for roundtrips in progress, indexed by ID, for the "cancel"
+// command.
+const roundtripControllers = new Map();
+
 port.onMessage.addListener(message => {
     switch (message.command) {
-        case "roundtrip":
+        case "roundtrip": {
             // Do a roundtrip and send the result back to the native process.
-            roundtrip(message.request)
+            const controller = new AbortController();
+            roundtripControllers.set(message.id, controller);
+            roundtrip(message.request, controller.signal)
                 // Convert any error into an "error" response.
                 .catch(error => ({error: error.message}))
-                .then(response => port.postMessage({id: message.id, response}));
+                .then(response => {
+                    roundtripControllers.delete(message.id);
+                    port.postMessage({id: message.id, response});
+                });
             break;
+        }
+        case "cancel": {
+            // The native part ignores the "error" response that the
+            // aborted roundtrip sends.
+            const controller = roundtripControllers.get(message.id);
+            if (controller != null) {
+                controller.abort();
+            }
+            break;
+        }
         case "report-address":
             // Tell meek-client where our subprocess (the one that actually
             // opens a socket) is listening. For the dump call to have any
             // effect, the pref browser.dom.window.dump.enabled must be true.
             // This output is supposed to be line-oriented, so ignore it if the
-            // address from the native part contains a newline.
-            if (message.address != null && message.address.indexOf("\n") == -1) {
-                dump(`meek-http-helper: listen ${message.address}\n`);
+            // address from the native part contains a newline, or the secret
+            // is anything but hex.
+            if (message.address != null && message.address.indexOf("\n") == -1
+                && message.secret != null && /^[0-9a-f]+$/.test(message.secret)) {
+                dump(`meek-http-helper: listen ${message.address} secret ${message.secret}\n`);
             }
             break;
         default:
@@ -4,6 +4,21 @@
 // program is also in charge of multiplexing the many incoming socket
 // connections over the single shared stdio stream to/from the browser.
 //
+// meek-client may use either of two protocols over the socket. In version 1,
+// each connection carries one request and its response. In version 2, one
+// long-lived connection carries many concurrent requests, each tagged with an
+// ID, and meek-client may cancel a request by its ID. meek-client selects
+// version 2 by beginning the connection with protocolV2Magic.
+//
+// If the environment variable MEEK_HTTP_HELPER_UNIX_SOCKET is set to 1, the
+// socket is a Unix domain socket in a new directory that only the current user
+// can access, instead of a localhost TCP socket.
+//
+// Any local process can connect to a TCP socket, so every request must carry a
+// random secret that this program generates at startup. The secret is reported
+// to the browser along with the listening address, and the browser prints both
+// for meek-client-torbrowser to pass to meek-client.
+//
 // This program does minimal syntax checking. Apart from ensuring that the
 // messages are well-formed JSON with the correct top-level properties, and
 // inspecting the ID, it doesn't care about the contents of messages. It's the
@@ -13,16 +28,22 @@
 package main
 
 import (
+	"bufio"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
 	"sync"
 	"syscall"
 	"time"
@@ -48,8 +69,29 @@ const (
 	// Self-defense against a malfunctioning browser. We'll refuse to
 	// receive WebExtension messages that are longer than this.
 	maxWebExtensionMessageLength = 1000000
+
+	// Self-defense against a malfunctioning meek-client. We'll refuse to
+	// start more than this many concurrent requests on one version 2
+	// connection.
+	maxPendingRequests = 1000
+
+	// The first bytes that meek-client sends on a version 2 connection, and
+	// that we send back to acknowledge. The first 4 bytes, read as a
+	// version 1 length prefix, are greater than maxRequestSpecLength, so a
+	// version 1 helper will refuse the connection.
+	protocolV2Magic = "MEEK-HELPER/2\n"
+
+	// The environment variable that selects a Unix domain socket.
+	unixSocketEnvVar = "MEEK_HTTP_HELPER_UNIX_SOCKET"
 )
 
+// The error that roundTrip returns when its request is cancelled.
+var errRoundTripCanceled = errors.New("request cancelled")
+
+// The secret that meek-client must include in every request. It is set once in
+// main, before any connections are accepted.
+var secret string
+
 // We receive multiple (possibly concurrent) connections over the listening
 // socket, and we must multiplex all their requests/results over the single
 // shared stdio stream to the browser. When roundTrip sends a request to the
@@ -83,6 +125,13 @@ type webExtensionRoundTripRequest struct {
 	Request requestSpec `json:"request"`
 }
 
+// A "cancel" command sent out to the browser over the stdout stream. It tells
+// the browser to abort the request with the given ID.
+type webExtensionCancelRequest struct {
+	Command string `json:"command"` // "cancel"
+	ID      string `json:"id"`
+}
+
 // A message received from the the browser over the stdin stream. It
 // encapsulates a responseSpec along with the ID of the webExtensionResponse
 // that resulted in this response.
@@ -91,36 +140,70 @@ type webExtensionRoundTripResponse struct {
 	Response responseSpec `json:"response"`
 }
 
+// A message received from meek-client over a version 2 connection: either a
+// requestSpec or a cancellation, tagged with an ID chosen by meek-client.
+type muxRequest struct {
+	ID      uint64      `json:"id"`
+	Request requestSpec `json:"request"`
+	Cancel  bool        `json:"cancel"`
+}
+
+// A message sent to meek-client over a version 2 connection.
+type muxResponse struct {
+	ID       uint64       `json:"id"`
+	Response responseSpec `json:"response"`
+}
+
 // Receive a requestSpec (from "meek-client --helper").
 //
 // The meek-client protocol is coincidentally similar to the WebExtension stdio
 // protocol: a 4-byte length, followed by a JSON object of that length. The main
-// differences are the byte order of the length prefix—meek-client's is
-// big-endian, while WebExtension's is native-endian—and that meek-client only
-// sends/receives one object per connection.
+// difference is the byte order of the length prefix—meek-client's is
+// big-endian, while WebExtension's is native-endian. In version 1,
+// meek-client only sends/receives one object per connection.
 func recvRequestSpec(r io.Reader) (requestSpec, error) {
+	var spec requestSpec
+	err := recvMessage(r, &spec)
+	if err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// Receive a length-prefixed JSON message from meek-client and decode it into
+// v.
+func recvMessage(r io.Reader, v interface{}) error {
 	var length uint32
 	err := binary.Read(r, binary.BigEndian, &length)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if length > maxRequestSpecLength {
-		return nil, fmt.Errorf("request spec is too long: %d (max %d)", length, maxRequestSpecLength)
+		return fmt.Errorf("request spec is too long: %d (max %d)", length, maxRequestSpecLength)
 	}
 
 	encodedSpec := make([]byte, length)
 	_, err = io.ReadFull(r, encodedSpec)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var spec requestSpec
-	err = json.Unmarshal(encodedSpec, &spec)
-	if err != nil {
-		return nil, err
-	}
+	return json.Unmarshal(encodedSpec, v)
+}
 
-	return spec, nil
+// Check that req has a "secret" property equal to secret, and remove it so that
+// it is not passed on to the browser.
+func checkSecret(req requestSpec) error {
+	m, ok := req.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("request spec is not an object")
+	}
+	s, _ := m["secret"].(string)
+	delete(m, "secret")
+	if subtle.ConstantTimeCompare([]byte(s), []byte(secret)) != 1 {
+		return fmt.Errorf("request has a missing or incorrect secret")
+	}
+	return nil
 }
 
 // Send a responseSpec (to "meek-client --helper").
@@ -187,7 +270,10 @@ func sendWebExtensionMessage(w io.Writer, message []byte) error {
 // browser. Wait for the browser to send back a webExtensionRoundTripResponse
 // (which actually happens in inFromBrowserLoop--that function uses the ID to
 // find this goroutine again). Return a responseSpec object or an error.
-func roundTrip(req requestSpec, outToBrowserChan chan<- []byte) (responseSpec, error) {
+//
+// If cancel is closed before the response arrives, tell the browser to abort
+// the request and return errRoundTripCanceled.
+func roundTrip(req requestSpec, outToBrowserChan chan<- []byte, cancel <-chan struct{}) (responseSpec, error) {
 	// Generate an ID that will allow us to match a response to this request.
 	idRaw := make([]byte, 8)
 	_, err := rand.Read(idRaw)
@@ -198,8 +284,10 @@ func roundTrip(req requestSpec, outToBrowserChan chan<- []byte) (responseSpec, e
 
 	// This is the channel over which inFromBrowserLoop will send the
 	// response. Register it in requestResponseMap to enable
-	// inFromBrowserLoop to match the corresponding response to it.
-	responseSpecChan := make(chan responseSpec)
+	// inFromBrowserLoop to match the corresponding response to it. It is
+	// buffered so that inFromBrowserLoop does not block if we have
+	// stopped waiting.
+	responseSpecChan := make(chan responseSpec, 1)
 	requestResponseMapLock.Lock()
 	requestResponseMap[id] = responseSpecChan
 	requestResponseMapLock.Unlock()
@@ -230,6 +318,21 @@ func roundTrip(req requestSpec, outToBrowserChan chan<- []byte) (responseSpec, e
 		delete(requestResponseMap, id)
 		requestResponseMapLock.Unlock()
 		err = fmt.Errorf("timed out waiting for browser to reply")
+	case <-cancel:
+		timeout.Stop()
+		requestResponseMapLock.Lock()
+		delete(requestResponseMap, id)
+		requestResponseMapLock.Unlock()
+		// Tell the browser to abort the request.
+		message, err := json.Marshal(&webExtensionCancelRequest{
+			Command: "cancel",
+			ID:      id,
+		})
+		if err != nil {
+			return nil, err
+		}
+		outToBrowserChan <- message
+		return nil, errRoundTripCanceled
 	}
 	return resp, err
 }
@@ -240,26 +343,42 @@ type errorResponseSpec struct {
 	Error string `json:"error"`
 }
 
-// Handle a socket connection, which is used for one request–response roundtrip
-// through the browser. Delegates the real work to roundTrip, which reads the
-// requestSpec from the socket and sends it through the browser. Here, we wrap
+// Handle a socket connection. If the connection begins with protocolV2Magic,
+// hand it to handleConnV2. Otherwise, it is used for one request–response
+// roundtrip through the browser. Delegates the real work to roundTrip, which
+// sends the requestSpec read from the socket through the browser. Here, we wrap
 // any error from roundTrip in an "error" response and send the response back on
 // the socket.
 func handleConn(conn net.Conn, outToBrowserChan chan<- []byte) error {
 	defer conn.Close()
 
-	// Read and decode the request from the socket.
 	err := conn.SetReadDeadline(time.Now().Add(localReadTimeout))
 	if err != nil {
 		return err
 	}
-	req, err := recvRequestSpec(conn)
+	br := bufio.NewReader(conn)
+	// Version 1 requests start with a length, whose 4 bytes never match
+	// the start of protocolV2Magic.
+	prefix, err := br.Peek(4)
+	if err != nil {
+		return err
+	}
+	if string(prefix) == protocolV2Magic[:4] {
+		return handleConnV2(conn, br, outToBrowserChan)
+	}
+
+	// Read and decode the request from the socket.
+	req, err := recvRequestSpec(br)
+	if err != nil {
+		return err
+	}
+	err = checkSecret(req)
 	if err != nil {
 		return err
 	}
 
 	// Pass the parameters to the browser and get the result.
-	resp, err := roundTrip(req, outToBrowserChan)
+	resp, err := roundTrip(req, outToBrowserChan, nil)
 	if err != nil {
 		// In case of error in roundTrip, cook up an error response.
 		resp = &errorResponseSpec{Error: err.Error()}
@@ -273,6 +392,167 @@ func handleConn(conn net.Conn, outToBrowserChan chan<- []byte) error {
 	return sendResponseSpec(conn, resp)
 }
 
+// Handle a version 2 connection, whose magic prefix is still unread in r. Read
+// requests until the connection is closed, doing a roundTrip for each in its
+// own goroutine, and send back responses as they become ready. Closing the
+// connection cancels any requests still in progress.
+func handleConnV2(conn net.Conn, r io.Reader, outToBrowserChan chan<- []byte) error {
+	magic := make([]byte, len(protocolV2Magic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return err
+	}
+	if string(magic) != protocolV2Magic {
+		return fmt.Errorf("bad protocol version 2 magic %q", magic)
+	}
+
+	// writeLock serializes writes to conn.
+	var writeLock sync.Mutex
+	send := func(v interface{}) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		err := conn.SetWriteDeadline(time.Now().Add(localWriteTimeout))
+		if err != nil {
+			return err
+		}
+		return sendResponseSpec(conn, v)
+	}
+	// Acknowledge version 2 by sending the magic back.
+	err = conn.SetWriteDeadline(time.Now().Add(localWriteTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(conn, protocolV2Magic)
+	if err != nil {
+		return err
+	}
+
+	// Channels that cancel each request in progress, indexed by ID.
+	pending := make(map[uint64]chan struct{})
+	var pendingLock sync.Mutex
+	defer func() {
+		pendingLock.Lock()
+		for id, cancel := range pending {
+			close(cancel)
+			delete(pending, id)
+		}
+		pendingLock.Unlock()
+	}()
+
+	// The read deadline set in handleConn stays in force until the first
+	// request passes checkSecret. After that, the connection may be idle
+	// for any length of time between requests.
+	authenticated := false
+	for {
+		var msg muxRequest
+		err := recvMessage(r, &msg)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		pendingLock.Lock()
+		cancel, ok := pending[msg.ID]
+		if msg.Cancel {
+			// Ignore cancellation of a request that is already
+			// finished.
+			if ok {
+				close(cancel)
+				delete(pending, msg.ID)
+			}
+			pendingLock.Unlock()
+			continue
+		}
+		if ok {
+			pendingLock.Unlock()
+			return fmt.Errorf("duplicate request ID %d", msg.ID)
+		}
+		// A wrong secret closes the whole connection, not only
+		// this request.
+		err = checkSecret(msg.Request)
+		if err != nil {
+			pendingLock.Unlock()
+			return err
+		}
+		if len(pending) >= maxPendingRequests {
+			pendingLock.Unlock()
+			return fmt.Errorf("too many concurrent requests (max %d)", maxPendingRequests)
+		}
+		cancel = make(chan struct{})
+		pending[msg.ID] = cancel
+		pendingLock.Unlock()
+
+		if !authenticated {
+			err = conn.SetReadDeadline(time.Time{})
+			if err != nil {
+				return err
+			}
+			authenticated = true
+		}
+
+		go func(id uint64, req requestSpec, cancel chan struct{}) {
+			resp, err := roundTrip(req, outToBrowserChan, cancel)
+			pendingLock.Lock()
+			// If the request is no longer pending, it was
+			// cancelled and meek-client does not want a response.
+			ok := pending[id] == cancel
+			delete(pending, id)
+			pendingLock.Unlock()
+			if !ok {
+				return
+			}
+			if err != nil {
+				resp = &errorResponseSpec{Error: err.Error()}
+			}
+			err = send(&muxResponse{ID: id, Response: resp})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "sending response:", err)
+				// Unblock the read loop.
+				conn.Close()
+			}
+		}(msg.ID, msg.Request, cancel)
+	}
+}
+
+// Open the socket for meek-client to connect to. Return the listener, the
+// address to report to meek-client, and a function that removes any files
+// created for the socket.
+func listen() (net.Listener, string, func(), error) {
+	if os.Getenv(unixSocketEnvVar) != "1" {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return ln, ln.Addr().String(), func() {}, nil
+	}
+
+	// On Unix, ioutil.TempDir creates the directory with mode 0700, so
+	// only the current user can reach the socket inside it. Windows
+	// ignores the mode, and the directory would not be private.
+	if runtime.GOOS == "windows" {
+		return nil, "", nil, errors.New(unixSocketEnvVar + " is not supported on Windows")
+	}
+	dir, err := ioutil.TempDir("", "meek-http-helper-")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	path := filepath.Join(dir, "helper.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		cleanup()
+		return nil, "", nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		ln.Close()
+		cleanup()
+		return nil, "", nil, err
+	}
+	return ln, "unix:" + path, cleanup, nil
+}
+
 // Receive socket connections and dispatch them to handleConn.
 func acceptLoop(ln net.Listener, outToBrowserChan chan<- []byte) error {
 	for {
@@ -292,12 +572,12 @@ func acceptLoop(ln net.Listener, outToBrowserChan chan<- []byte) error {
 	}
 }
 
-// Read messages from the browser over stdin, and send them (matching using the
-// ID field) over the channel that corresponds to the original request. This is
-// the only function allowed to read from stdin.
-func inFromBrowserLoop() error {
+// Read messages from the browser over r (stdin), and send them (matching using
+// the ID field) over the channel that corresponds to the original request. This
+// is the only function allowed to read from stdin.
+func inFromBrowserLoop(r io.Reader) error {
 	for {
-		message, err := recvWebExtensionMessage(os.Stdin)
+		message, err := recvWebExtensionMessage(r)
 		if err != nil {
 			return err
 		}
@@ -317,7 +597,7 @@ func inFromBrowserLoop() error {
 
 		if ok {
 			responseSpecChan <- resp.Response
-			// Each socket Conn is good for one request–response exchange only.
+			// Each ID is good for one request–response exchange only.
 			close(responseSpecChan)
 		}
 		// If !ok, it means that either the browser made up an ID that
@@ -327,11 +607,11 @@ func inFromBrowserLoop() error {
 	}
 }
 
-// Read messages from outToBrowserChan and send them to the browser over the
-// stdout channel. This is the only function allowed to write to stdout.
-func outToBrowserLoop(outToBrowserChan <-chan []byte) error {
+// Read messages from outToBrowserChan and send them to the browser over w
+// (stdout). This is the only function allowed to write to stdout.
+func outToBrowserLoop(w io.Writer, outToBrowserChan <-chan []byte) error {
 	for message := range outToBrowserChan {
-		err := sendWebExtensionMessage(os.Stdout, message)
+		err := sendWebExtensionMessage(w, message)
 		if err != nil {
 			return err
 		}
@@ -340,15 +620,24 @@ func outToBrowserLoop(outToBrowserChan <-chan []byte) error {
 }
 
 func main() {
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	secretRaw := make([]byte, 32)
+	_, err := rand.Read(secretRaw)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	secret = hex.EncodeToString(secretRaw)
+
+	ln, addr, cleanup, err := listen()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	defer cleanup()
 	defer ln.Close()
 
 	outToBrowserChan := make(chan []byte)
-	signalChan := make(chan os.Signal)
+	signalChan := make(chan os.Signal, 1)
 	errChan := make(chan error)
 
 	// Goroutine that handles new socket connections.
@@ -358,12 +647,12 @@ func main() {
 
 	// Goroutine that writes WebExtension messages to stdout.
 	go func() {
-		errChan <- outToBrowserLoop(outToBrowserChan)
+		errChan <- outToBrowserLoop(os.Stdout, outToBrowserChan)
 	}()
 
 	// Goroutine that reads WebExtension messages from stdin.
 	go func() {
-		err := inFromBrowserLoop()
+		err := inFromBrowserLoop(os.Stdin)
 		if err == io.EOF {
 			// EOF is not an error to display.
 			err = nil
@@ -371,13 +660,15 @@ func main() {
 		errChan <- err
 	}()
 
-	// Tell the browser our listening socket address.
+	// Tell the browser our listening socket address and secret.
 	message, err := json.Marshal(struct {
 		Command string `json:"command"`
 		Address string `json:"address"`
+		Secret  string `json:"secret"`
 	}{
 		Command: "report-address",
-		Address: ln.Addr().String(),
+		Address: addr,
+		Secret:  secret,
 	})
 	if err != nil {
 		panic(err)
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func TestMain(m *testing.M) {
+	secret = testSecret
+	os.Exit(m.Run())
+}
+
+// A command that the helper sends to the browser.
+type browserCommand struct {
+	Command string                 `json:"command"`
+	ID      string                 `json:"id"`
+	Request map[string]interface{} `json:"request"`
+}
+
+// testBrowser stands in for the browser half of the WebExtension. It runs
+// inFromBrowserLoop and outToBrowserLoop over pipes in place of stdin and
+// stdout.
+type testBrowser struct {
+	outToBrowserChan chan []byte
+	stdin            *io.PipeWriter
+	stdout           *io.PipeReader
+}
+
+func newTestBrowser(t *testing.T) *testBrowser {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	b := &testBrowser{
+		outToBrowserChan: make(chan []byte),
+		stdin:            stdinW,
+		stdout:           stdoutR,
+	}
+	go inFromBrowserLoop(stdinR)
+	go outToBrowserLoop(stdoutW, b.outToBrowserChan)
+	t.Cleanup(func() {
+		stdinW.Close()
+		stdoutR.Close()
+	})
+	return b
+}
+
+// Receive the next command that the helper sends to the browser.
+func (b *testBrowser) recv(t *testing.T) *browserCommand {
+	t.Helper()
+	message, err := recvWebExtensionMessage(b.stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmd browserCommand
+	err = json.Unmarshal(message, &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cmd
+}
+
+// Send the response to the roundtrip command with the given ID.
+func (b *testBrowser) reply(t *testing.T, id string, resp responseSpec) {
+	t.Helper()
+	message, err := json.Marshal(&webExtensionRoundTripResponse{
+		ID:       id,
+		Response: resp,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sendWebExtensionMessage(b.stdin, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Start handleConn on one end of a pipe and return the other end, along with a
+// channel that receives the return value of handleConn.
+func startConn(t *testing.T, b *testBrowser) (net.Conn, <-chan error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	err := client.SetDeadline(time.Now().Add(10 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- handleConn(server, b.outToBrowserChan)
+	}()
+	return client, errChan
+}
+
+// Start a version 2 connection and check that the helper acknowledges it.
+func startConnV2(t *testing.T, b *testBrowser) (net.Conn, <-chan error) {
+	t.Helper()
+	conn, errChan := startConn(t, b)
+	_, err := io.WriteString(conn, protocolV2Magic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	magic := make([]byte, len(protocolV2Magic))
+	_, err = io.ReadFull(conn, magic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(magic) != protocolV2Magic {
+		t.Fatalf("expected magic %q, got %q", protocolV2Magic, magic)
+	}
+	return conn, errChan
+}
+
+// Send a length-prefixed JSON message, as meek-client would.
+func sendMuxRequest(t *testing.T, conn net.Conn, msg interface{}) {
+	t.Helper()
+	err := sendResponseSpec(conn, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recvMuxResponse(t *testing.T, conn net.Conn) *muxResponse {
+	t.Helper()
+	var resp muxResponse
+	err := recvMessage(conn, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func testRequest(url string) map[string]interface{} {
+	return map[string]interface{}{
+		"method": "POST",
+		"url":    url,
+		"secret": testSecret,
+	}
+}
+
+func waitConnError(t *testing.T, errChan <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for handleConn to return")
+	}
+	return nil
+}
+
+// Test that version 2 responses come back tagged with the IDs of their
+// requests, in the order in which the browser answers them.
+func TestHandleConnV2(t *testing.T) {
+	b := newTestBrowser(t)
+	conn, errChan := startConnV2(t, b)
+
+	sendMuxRequest(t, conn, &muxRequest{ID: 1, Request: testRequest("https://example.com/1")})
+	cmd1 := b.recv(t)
+	sendMuxRequest(t, conn, &muxRequest{ID: 2, Request: testRequest("https://example.com/2")})
+	cmd2 := b.recv(t)
+	for _, cmd := range []*browserCommand{cmd1, cmd2} {
+		if cmd.Command != "roundtrip" {
+			t.Fatalf("expected roundtrip command, got %+v", cmd)
+		}
+	}
+	if cmd1.ID == cmd2.ID {
+		t.Fatalf("requests share browser ID %q", cmd1.ID)
+	}
+	if cmd1.Request["url"] != "https://example.com/1" || cmd2.Request["url"] != "https://example.com/2" {
+		t.Fatalf("unexpected requests %+v %+v", cmd1.Request, cmd2.Request)
+	}
+
+	// Answer the second request first.
+	b.reply(t, cmd2.ID, map[string]interface{}{"status": 202})
+	resp := recvMuxResponse(t, conn)
+	if resp.ID != 2 || resp.Response.(map[string]interface{})["status"] != 202.0 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	b.reply(t, cmd1.ID, map[string]interface{}{"status": 201})
+	resp = recvMuxResponse(t, conn)
+	if resp.ID != 1 || resp.Response.(map[string]interface{})["status"] != 201.0 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	conn.Close()
+	err := waitConnError(t, errChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that cancelling a request tells the browser to abort it, and that
+// meek-client gets no response for it.
+func TestHandleConnV2Cancel(t *testing.T) {
+	b := newTestBrowser(t)
+	conn, _ := startConnV2(t, b)
+
+	sendMuxRequest(t, conn, &muxRequest{ID: 1, Request: testRequest("https://example.com/1")})
+	cmd1 := b.recv(t)
+	sendMuxRequest(t, conn, &muxRequest{ID: 1, Cancel: true})
+	cancel := b.recv(t)
+	if cancel.Command != "cancel" || cancel.ID != cmd1.ID {
+		t.Fatalf("expected cancel command for %q, got %+v", cmd1.ID, cancel)
+	}
+	// A late answer from the browser is dropped.
+	b.reply(t, cmd1.ID, map[string]interface{}{"status": 200})
+	// Cancelling a request that is no longer pending does nothing.
+	sendMuxRequest(t, conn, &muxRequest{ID: 1, Cancel: true})
+
+	sendMuxRequest(t, conn, &muxRequest{ID: 2, Request: testRequest("https://example.com/2")})
+	cmd2 := b.recv(t)
+	if cmd2.Command != "roundtrip" {
+		t.Fatalf("expected roundtrip command, got %+v", cmd2)
+	}
+	b.reply(t, cmd2.ID, map[string]interface{}{"status": 200})
+	resp := recvMuxResponse(t, conn)
+	if resp.ID != 2 {
+		t.Fatalf("expected response to request 2, got %+v", resp)
+	}
+}
+
+// Test that reusing the ID of a pending request closes the connection and
+// cancels the requests in progress.
+func TestHandleConnV2DuplicateID(t *testing.T) {
+	b := newTestBrowser(t)
+	conn, errChan := startConnV2(t, b)
+
+	sendMuxRequest(t, conn, &muxRequest{ID: 1, Request: testRequest("https://example.com/1")})
+	cmd := b.recv(t)
+	sendMuxRequest(t, conn, &muxRequest{ID: 1, Request: testRequest("https://example.com/1")})
+	err := waitConnError(t, errChan)
+	if err == nil || !strings.Contains(err.Error(), "duplicate request ID") {
+		t.Fatalf("expected duplicate ID error, got %v", err)
+	}
+	cancel := b.recv(t)
+	if cancel.Command != "cancel" || cancel.ID != cmd.ID {
+		t.Fatalf("expected cancel command for %q, got %+v", cmd.ID, cancel)
+	}
+	var resp muxResponse
+	err = recvMessage(conn, &resp)
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v %+v", err, resp)
+	}
+}
+
+// Test that a version 2 connection that never sends a request with the secret
+// is closed after localReadTimeout, and that one that has sent one is not.
+func TestHandleConnV2Timeout(t *testing.T) {
+	b := newTestBrowser(t)
+	conn, errChan := startConnV2(t, b)
+	// A cancellation does not need the secret, and must not extend the
+	// deadline.
+	sendMuxRequest(t, conn, &muxRequest{ID: 1, Cancel: true})
+	start := time.Now()
+	err := waitConnError(t, errChan)
+	if err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > localReadTimeout+time.Second {
+		t.Errorf("connection closed after %v, expected about %v", elapsed, localReadTimeout)
+	}
+
+	conn, errChan = startConnV2(t, b)
+	sendMuxRequest(t, conn, &muxRequest{ID: 1, Request: testRequest("https://example.com/1")})
+	cmd := b.recv(t)
+	b.reply(t, cmd.ID, map[string]interface{}{"status": 200})
+	recvMuxResponse(t, conn)
+	select {
+	case err := <-errChan:
+		t.Fatalf("connection closed while idle after authentication: %v", err)
+	case <-time.After(localReadTimeout + 500*time.Millisecond):
+	}
+	conn.Close()
+	err = waitConnError(t, errChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that requests with a missing or incorrect secret are refused on both
+// protocol versions, and that the secret is not passed on to the browser.
+func TestHandleConnSecret(t *testing.T) {
+	badSecrets := []interface{}{
+		nil,
+		"",
+		"wrong",
+		testSecret[:len(testSecret)-1],
+		testSecret + "0",
+		1234,
+	}
+	for _, v2 := range []bool{false, true} {
+		for _, s := range badSecrets {
+			b := newTestBrowser(t)
+			req := testRequest("https://example.com/")
+			if s == nil {
+				delete(req, "secret")
+			} else {
+				req["secret"] = s
+			}
+			var conn net.Conn
+			var errChan <-chan error
+			if v2 {
+				conn, errChan = startConnV2(t, b)
+				sendMuxRequest(t, conn, &muxRequest{ID: 1, Request: req})
+			} else {
+				conn, errChan = startConn(t, b)
+				sendMuxRequest(t, conn, req)
+			}
+			err := waitConnError(t, errChan)
+			if err == nil || !strings.Contains(err.Error(), "secret") {
+				t.Errorf("v2=%v secret %#v: expected secret error, got %v", v2, s, err)
+			}
+			var resp interface{}
+			err = recvMessage(conn, &resp)
+			if err != io.EOF {
+				t.Errorf("v2=%v secret %#v: expected EOF, got %v %+v", v2, s, err, resp)
+			}
+		}
+	}
+
+	// A request that is not an object has no secret.
+	b := newTestBrowser(t)
+	conn, errChan := startConn(t, b)
+	sendMuxRequest(t, conn, []string{testSecret})
+	err := waitConnError(t, errChan)
+	if err == nil {
+		t.Errorf("expected error for non-object request")
+	}
+
+	// The correct secret works, and is removed before the request goes
+	// to the browser.
+	b = newTestBrowser(t)
+	conn, errChan = startConn(t, b)
+	sendMuxRequest(t, conn, testRequest("https://example.com/"))
+	cmd := b.recv(t)
+	if _, ok := cmd.Request["secret"]; ok {
+		t.Errorf("secret was passed to the browser: %+v", cmd.Request)
+	}
+	b.reply(t, cmd.ID, map[string]interface{}{"status": 200})
+	var resp map[string]interface{}
+	err = recvMessage(conn, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp["status"] != 200.0 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	err = waitConnError(t, errChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that the Unix domain socket is private to the current user, and that
+// cleanup removes it.
+func TestListenUnixSocket(t *testing.T) {
+	t.Setenv(unixSocketEnvVar, "1")
+	if runtime.GOOS == "windows" {
+		_, _, _, err := listen()
+		if err == nil {
+			t.Fatal("expected an error on Windows")
+		}
+		return
+	}
+
+	ln, addr, cleanup, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if !strings.HasPrefix(addr, "unix:") {
+		t.Fatalf("address %q does not begin with \"unix:\"", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	dir := filepath.Dir(path)
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0700 {
+		t.Errorf("directory has mode %o, expected 0700", perm)
+	}
+	fi, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		t.Errorf("%s is not a socket", path)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket has mode %o, expected 0600", perm)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	ln.Close()
+	cleanup()
+	_, err = os.Stat(dir)
+	if !os.IsNotExist(err) {
+		t.Errorf("directory %s still exists after cleanup: %v", dir, err)
+	}
+}
+
+// Test that without the environment variable, the socket is on localhost TCP.
+func TestListenTCP(t *testing.T) {
+	t.Setenv(unixSocketEnvVar, "")
+	ln, addr, cleanup, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	defer ln.Close()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "127.0.0.1" {
+		t.Errorf("listening on %q, expected 127.0.0.1", addr)
+	}
+}